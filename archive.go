@@ -0,0 +1,564 @@
+package bagins
+
+/*
+
+"What has it got in its pocketses?"
+
+- Gollum
+
+*/
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format of a bag serialized as a zip file. See also TarFormat
+// and TarGzipFormat.
+const ZipFormat = "zip"
+
+/*
+ArchiveBag is a bag serialized as a tar, gzipped tar or zip file. It is
+read in place, without extracting the archive to disk.
+
+The bag may be at the top level of the archive or, as the BagIt spec
+recommends, in a single top-level directory. ReadArchiveBag indexes the
+archive and parses the bag's manifests and tag files. Validate reads
+each file in the archive once, hashing it with every algorithm it
+needs as it goes.
+
+ArchiveBag is read-only. Paths in the bag always use forward slashes.
+*/
+type ArchiveBag struct {
+	pathToFile string
+	format     string
+	root       string // directory in the archive that holds the bag, or "" for the top level
+	version    string
+	Manifests  []*Manifest
+	tagfiles   map[string]*TagFile // Key is relative path
+	fetchFile  *FetchFile
+	bagItData  []byte
+	files      map[string]int64             // size of each file, key is relative path
+	checksums  map[string]map[string]string // calculated by Validate, path -> algorithm -> digest
+	readErrors map[string]error             // files Validate could not read
+	readError  error                        // error that stopped Validate reading the archive
+}
+
+/*
+Opens the bag serialized in the tar, tar.gz or zip file at pathToFile.
+The format is determined by the file extension, which must be .tar,
+.tar.gz, .tgz or .zip.
+
+As with ReadBag, the tagfiles param lists the tag files to parse, and
+the BagIt version in bagit.txt determines how the manifests are parsed.
+*/
+func ReadArchiveBag(pathToFile string, tagfiles []string) (*ArchiveBag, error) {
+	return ReadArchiveBagWithOptions(pathToFile, tagfiles, nil)
+}
+
+// Opens the bag in the archive at pathToFile as ReadArchiveBag does, with
+// the settings in opts. The archive is always read from the OS file
+// system. See ReadBagWithOptions.
+func ReadArchiveBagWithOptions(pathToFile string, tagfiles []string, opts *ReadBagOptions) (*ArchiveBag, error) {
+	if opts == nil {
+		opts = &ReadBagOptions{}
+	}
+	if err := validateParseMode(opts.ParseMode); err != nil {
+		return nil, err
+	}
+	for _, tName := range tagfiles {
+		if reason := unsafePathReason(tName); reason != "" {
+			return nil, &UnsafePathError{Path: tName, Source: "the list of tag files", Reason: reason}
+		}
+	}
+	format, err := archiveFormat(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	ab := new(ArchiveBag)
+	ab.pathToFile = pathToFile
+	ab.format = format
+	ab.Manifests = make([]*Manifest, 0)
+	ab.tagfiles = make(map[string]*TagFile)
+	ab.files = make(map[string]int64)
+
+	// Index the archive, keeping the contents of any file that might be
+	// bagit.txt, a manifest or a tag file, since we don't know where the
+	// bag starts until we've seen every entry.
+	sizes := make(map[string]int64)
+	contents := make(map[string][]byte)
+	err = ab.eachEntry(func(name string, size int64, r io.Reader) error {
+		sizes[name] = size
+		if isBagLevelFile(name, tagfiles) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("Unable to read %s from %s: %w", name, pathToFile, err)
+			}
+			contents[name] = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ab.root, err = findArchiveRoot(sizes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pathToFile, err)
+	}
+	for name, size := range sizes {
+		if pathInBag, ok := ab.pathInBag(name); ok {
+			ab.files[pathInBag] = size
+		}
+	}
+
+	ab.bagItData = contents[ab.archivePath("bagit.txt")]
+	ab.version, err = parseBagItVersion(ab.bagItData, path.Join(pathToFile, ab.archivePath("bagit.txt")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pathInBag := range ab.ListFiles() {
+		if strings.Contains(pathInBag, "/") || !strings.HasSuffix(pathInBag, ".txt") ||
+			!(strings.HasPrefix(pathInBag, "manifest-") || strings.HasPrefix(pathInBag, "tagmanifest-")) {
+			continue
+		}
+		manifest, err := ab.parseManifest(pathInBag, contents[ab.archivePath(pathInBag)], opts.ParseMode)
+		if err != nil {
+			return nil, err
+		}
+		ab.Manifests = append(ab.Manifests, manifest)
+	}
+	if len(ab.Manifests) == 0 {
+		return nil, fmt.Errorf("Unable to parse a manifest")
+	}
+
+	if data, ok := contents[ab.archivePath("fetch.txt")]; ok {
+		entries, errs := parseFetchData(bytes.NewReader(data), path.Join(pathToFile, ab.archivePath("fetch.txt")), ab.version)
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("Unable to parse fetch file in %s: %w", pathToFile, errors.Join(errs...))
+		}
+		ab.fetchFile = &FetchFile{name: "fetch.txt", Entries: entries, bagItVersion: ab.version}
+	}
+
+	// As in ReadBag, unparsable lines in tag files are ignored.
+	for _, tName := range tagfiles {
+		data, ok := contents[ab.archivePath(path.Clean(tName))]
+		if !ok {
+			continue
+		}
+		tf := &TagFile{name: tName, Data: NewTagFieldList()}
+		fields, _ := parseTagFields(bytes.NewReader(data), tName)
+		tf.Data.SetFields(fields)
+		ab.tagfiles[tName] = tf
+	}
+
+	return ab, nil
+}
+
+// Returns the format of the archive from its file extension.
+func archiveFormat(pathToFile string) (string, error) {
+	lower := strings.ToLower(pathToFile)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return TarFormat, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return TarGzipFormat, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return ZipFormat, nil
+	}
+	return "", fmt.Errorf("Unable to tell the format of %s. "+
+		"File name must end in .tar, .tar.gz, .tgz or .zip", pathToFile)
+}
+
+// Returns true if name, either at the top level of the archive or in a
+// top-level directory, could be bagit.txt, fetch.txt, a manifest or one
+// of the tag files to be parsed.
+func isBagLevelFile(name string, tagfiles []string) bool {
+	candidates := []string{name}
+	if i := strings.Index(name, "/"); i > -1 {
+		candidates = append(candidates, name[i+1:])
+	}
+	for _, candidate := range candidates {
+		if candidate == "bagit.txt" || candidate == "fetch.txt" {
+			return true
+		}
+		if !strings.Contains(candidate, "/") && strings.HasSuffix(candidate, ".txt") &&
+			(strings.HasPrefix(candidate, "manifest-") || strings.HasPrefix(candidate, "tagmanifest-")) {
+			return true
+		}
+		for _, tName := range tagfiles {
+			if candidate == path.Clean(tName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Finds the directory that holds the bag, which is the top level of the
+// archive if it has a bagit.txt, or else the only top-level directory
+// that has one.
+func findArchiveRoot(sizes map[string]int64) (string, error) {
+	if _, ok := sizes["bagit.txt"]; ok {
+		return "", nil
+	}
+	roots := make([]string, 0)
+	for name := range sizes {
+		dir, file := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		if file == "bagit.txt" && dir != "" && !strings.Contains(dir, "/") {
+			roots = append(roots, dir)
+		}
+	}
+	if len(roots) == 0 {
+		return "", fmt.Errorf("Archive has no bagit.txt file at the top level " +
+			"or in a top-level directory")
+	}
+	if len(roots) > 1 {
+		sort.Strings(roots)
+		return "", fmt.Errorf("Archive has more than one bag: %s", strings.Join(roots, ", "))
+	}
+	return roots[0], nil
+}
+
+// Parses a manifest read from the archive.
+func (ab *ArchiveBag) parseManifest(pathInBag string, data []byte, mode ParseMode) (*Manifest, error) {
+	hashName, err := parseAlgoName(pathInBag)
+	if err != nil {
+		return nil, err
+	}
+	manifestType := PayloadManifest
+	if strings.HasPrefix(pathInBag, "tagmanifest-") {
+		manifestType = TagManifest
+	}
+	manifest, err := newManifest(pathInBag, hashName, manifestType)
+	if err != nil {
+		return nil, err
+	}
+	parsed, errs := parseManifest(bytes.NewReader(data), path.Join(ab.pathToFile, ab.archivePath(pathInBag)),
+		hashName, ab.version, mode)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Unable to parse manifest %s in %s: %w", pathInBag, ab.pathToFile, errors.Join(errs...))
+	}
+	manifest.Data = parsed
+	manifest.bagItVersion = ab.version
+	return manifest, nil
+}
+
+// Calls fn for each regular file in the archive, in the order they are
+// stored. name is the slash-separated path of the file in the archive.
+// Entries with names that would be outside the archive are an error.
+func (ab *ArchiveBag) eachEntry(fn func(name string, size int64, r io.Reader) error) error {
+	if ab.format == ZipFormat {
+		return ab.eachZipEntry(fn)
+	}
+	file, err := os.Open(ab.pathToFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if ab.format == TarGzipFormat {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", ab.pathToFile, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", ab.pathToFile, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := ab.cleanEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, header.Size, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Does the work of eachEntry for zip files.
+func (ab *ArchiveBag) eachZipEntry(fn func(name string, size int64, r io.Reader) error) error {
+	zr, err := zip.OpenReader(ab.pathToFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %w", ab.pathToFile, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		name, err := ab.cleanEntryName(f.Name)
+		if err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Unable to read %s from %s: %w", f.Name, ab.pathToFile, err)
+		}
+		err = fn(name, int64(f.UncompressedSize64), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the clean form of an entry name, without a leading "./", or an
+// *UnsafePathError if it would be extracted outside the bag.
+func (ab *ArchiveBag) cleanEntryName(name string) (string, error) {
+	if reason := unsafePathReason(name); reason != "" {
+		return "", &UnsafePathError{Path: name, Source: ab.pathToFile, Reason: reason}
+	}
+	return path.Clean(strings.TrimPrefix(name, "./")), nil
+}
+
+// Converts the name of an archive entry to its path relative to the bag
+// root. Returns false for entries that are not in the bag.
+func (ab *ArchiveBag) pathInBag(name string) (string, bool) {
+	if ab.root == "" {
+		return name, true
+	}
+	if strings.HasPrefix(name, ab.root+"/") {
+		return name[len(ab.root)+1:], true
+	}
+	return "", false
+}
+
+// Converts a path relative to the bag root to the name of the archive entry.
+func (ab *ArchiveBag) archivePath(pathInBag string) string {
+	if ab.root == "" {
+		return pathInBag
+	}
+	return ab.root + "/" + pathInBag
+}
+
+// Returns the path to the archive file.
+func (ab *ArchiveBag) Path() string {
+	return ab.pathToFile
+}
+
+// Returns the format of the archive: TarFormat, TarGzipFormat or ZipFormat.
+func (ab *ArchiveBag) Format() string {
+	return ab.format
+}
+
+// Returns the BagIt version from the bag's bagit.txt file.
+func (ab *ArchiveBag) Version() string {
+	return ab.version
+}
+
+// Returns the manifest of the specified type and algorithm, or nil.
+func (ab *ArchiveBag) GetManifest(manifestType, algorithm string) *Manifest {
+	for _, m := range ab.Manifests {
+		if m.Type() == manifestType && m.Algorithm() == algorithm {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns the manifests of the specified type, either PayloadManifest
+// or TagManifest, or an empty slice.
+func (ab *ArchiveBag) GetManifests(manifestType string) []*Manifest {
+	manifests := make([]*Manifest, 0)
+	for _, m := range ab.Manifests {
+		if m.Type() == manifestType {
+			manifests = append(manifests, m)
+		}
+	}
+	return manifests
+}
+
+// Returns the parsed tag file with the specified name, if it was
+// passed to ReadArchiveBag.
+func (ab *ArchiveBag) TagFile(name string) (*TagFile, error) {
+	if tf, ok := ab.tagfiles[name]; ok {
+		return tf, nil
+	}
+	return nil, fmt.Errorf("Unable to find tagfile %s", name)
+}
+
+// Returns the names of the tag files that were parsed.
+func (ab *ArchiveBag) ListTagFiles() []string {
+	names := make([]string, 0, len(ab.tagfiles))
+	for name := range ab.tagfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the entries in the bag's fetch.txt file, or an
+// empty slice if it has none.
+func (ab *ArchiveBag) FetchEntries() []FetchEntry {
+	if ab.fetchFile == nil {
+		return make([]FetchEntry, 0)
+	}
+	return ab.fetchFile.Entries
+}
+
+// Returns the paths of all files in the bag, relative to the bag root,
+// in sorted order.
+func (ab *ArchiveBag) ListFiles() []string {
+	files := make([]string, 0, len(ab.files))
+	for pathInBag := range ab.files {
+		files = append(files, pathInBag)
+	}
+	sort.Strings(files)
+	return files
+}
+
+/*
+Validate checks the bag in the archive and returns a report of
+everything that is wrong with it. It performs the same checks as
+Bag.Validate(), reading the archive from start to finish once and
+hashing every file listed in a manifest with all of the algorithms
+that list it.
+*/
+func (ab *ArchiveBag) Validate() *ValidationReport {
+	started := time.Now()
+	ab.hashEntries()
+	return validateBag(ab, started)
+}
+
+// Calculates the checksums of every file listed in a manifest.
+func (ab *ArchiveBag) hashEntries() {
+	ab.checksums = make(map[string]map[string]string)
+	ab.readErrors = make(map[string]error)
+	ab.readError = nil
+
+	listedIn := make(map[string][]*Manifest)
+	for _, m := range ab.Manifests {
+		for pathInBag := range m.Data {
+			listedIn[pathInBag] = append(listedIn[pathInBag], m)
+		}
+	}
+
+	ab.readError = ab.eachEntry(func(name string, size int64, r io.Reader) error {
+		pathInBag, ok := ab.pathInBag(name)
+		if !ok || len(listedIn[pathInBag]) == 0 {
+			return nil
+		}
+		hashes := make(map[string]hash.Hash)
+		writers := make([]io.Writer, 0)
+		for _, m := range listedIn[pathInBag] {
+			if _, done := hashes[m.Algorithm()]; !done {
+				hashes[m.Algorithm()] = m.hashFunc()
+				writers = append(writers, hashes[m.Algorithm()])
+			}
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+			ab.readErrors[pathInBag] = err
+			// A tar stream can't be read past a bad entry.
+			if ab.format != ZipFormat {
+				return err
+			}
+			return nil
+		}
+		ab.checksums[pathInBag] = make(map[string]string)
+		for algorithm, h := range hashes {
+			ab.checksums[pathInBag][algorithm] = fmt.Sprintf("%x", h.Sum(nil))
+		}
+		return nil
+	})
+}
+
+// Returns the raw bytes of the bag's bagit.txt file.
+func (ab *ArchiveBag) readBagItFile() ([]byte, error) {
+	if ab.bagItData == nil {
+		return nil, os.ErrNotExist
+	}
+	return ab.bagItData, nil
+}
+
+// Returns the paths of all files in the payload directory,
+// relative to the bag root, in sorted order.
+func (ab *ArchiveBag) listPayloadFiles() ([]string, error) {
+	files := make([]string, 0)
+	for _, pathInBag := range ab.ListFiles() {
+		if strings.HasPrefix(pathInBag, "data/") {
+			files = append(files, pathInBag)
+		}
+	}
+	return files, nil
+}
+
+// Returns the paths in fetch.txt.
+func (ab *ArchiveBag) fetchEntryPaths() []string {
+	paths := make([]string, 0)
+	for _, entry := range ab.FetchEntries() {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+// Returns true if pathInBag is listed in the bag's fetch.txt file.
+func (ab *ArchiveBag) isFetchEntry(pathInBag string) bool {
+	for _, entry := range ab.FetchEntries() {
+		if entry.Path == pathInBag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an *UnsafePathError if pathInBag leads outside the bag. An
+// archive holds no links to follow.
+func (ab *ArchiveBag) checkPath(pathInBag string, source string) error {
+	if reason := unsafePathReason(pathInBag); reason != "" {
+		return &UnsafePathError{Path: pathInBag, Source: source, Reason: reason}
+	}
+	return nil
+}
+
+// Returns true if the archive has a file at pathInBag.
+func (ab *ArchiveBag) fileExists(pathInBag string) bool {
+	_, ok := ab.files[pathInBag]
+	return ok
+}
+
+// Returns the checksum calculated by Validate for the file at pathInBag
+// with the manifest's algorithm.
+func (ab *ArchiveBag) fileChecksum(pathInBag string, manifest *Manifest) (string, error) {
+	if err, ok := ab.readErrors[pathInBag]; ok {
+		return "", err
+	}
+	if digest, ok := ab.checksums[pathInBag][manifest.Algorithm()]; ok {
+		return digest, nil
+	}
+	if ab.readError != nil {
+		return "", ab.readError
+	}
+	return "", fmt.Errorf("File %s was not read from %s", pathInBag, ab.pathToFile)
+}
+
+// Returns the path of the manifest relative to the bag root.
+func (ab *ArchiveBag) manifestPath(manifest *Manifest) string {
+	return manifest.Name()
+}
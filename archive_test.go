@@ -0,0 +1,165 @@
+package bagins_test
+
+import (
+	"archive/zip"
+	"github.com/APTrust/bagins"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Writes a bag with BagWriter to a temp file with the specified
+// extension and returns the path to the file.
+func writeArchiveBag(t *testing.T, ext string, format string) string {
+	file, err := ioutil.TempFile("", "TEST_GO_ARCHIVE_BAG_*"+ext)
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer file.Close()
+	bw, err := bagins.NewBagWriter(file, "archive-bag", []string{"md5", "sha256"}, true,
+		bagins.BagItVersion10, format)
+	if err != nil {
+		t.Fatalf("Unexpected error creating BagWriter: %s", err)
+	}
+	bw.AddReader(strings.NewReader(FIXSTRING), int64(len(FIXSTRING)), "one.txt")
+	bw.AddReader(strings.NewReader(FIXSTRING), int64(len(FIXSTRING)), "dir/two.txt")
+	bw.AddTagfile("bag-info.txt")
+	bagInfo, _ := bw.TagFile("bag-info.txt")
+	bagInfo.Data.AddField(*bagins.NewTagField("Source-Organization", "APTrust"))
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing BagWriter: %s", err)
+	}
+	return file.Name()
+}
+
+// Writes a zip file with the specified contents and returns its path.
+func writeZipFile(t *testing.T, files map[string]string) string {
+	file, err := ioutil.TempFile("", "TEST_GO_ARCHIVE_BAG_*.zip")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	defer file.Close()
+	zw := zip.NewWriter(file)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Unable to write zip file: %s", err)
+	}
+	return file.Name()
+}
+
+func TestReadArchiveBag(t *testing.T) {
+	formats := map[string]string{
+		".tar":    bagins.TarFormat,
+		".tar.gz": bagins.TarGzipFormat,
+		".tgz":    bagins.TarGzipFormat,
+	}
+	for ext, format := range formats {
+		archivePath := writeArchiveBag(t, ext, format)
+		defer os.Remove(archivePath)
+
+		ab, err := bagins.ReadArchiveBag(archivePath, []string{"bag-info.txt"})
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s bag: %s", ext, err)
+		}
+		if ab.Format() != format {
+			t.Errorf("Expected format %s for %s, got %s", format, ext, ab.Format())
+		}
+		if ab.Version() != bagins.BagItVersion10 {
+			t.Errorf("Expected version 1.0, got %s", ab.Version())
+		}
+		if len(ab.GetManifests(bagins.PayloadManifest)) != 2 || len(ab.GetManifests(bagins.TagManifest)) != 2 {
+			t.Errorf("Expected 2 payload and 2 tag manifests, got %d", len(ab.Manifests))
+		}
+		manifest := ab.GetManifest(bagins.PayloadManifest, "md5")
+		if manifest == nil || manifest.Data["data/dir/two.txt"] != FIXVALUE {
+			t.Errorf("manifest-md5.txt was not parsed correctly")
+		}
+		bagInfo, err := ab.TagFile("bag-info.txt")
+		if err != nil {
+			t.Fatalf("bag-info.txt was not parsed: %s", err)
+		}
+		fields := bagInfo.Data.Fields()
+		if len(fields) != 1 || fields[0].Value() != "APTrust" {
+			t.Errorf("bag-info.txt was not parsed correctly: %v", fields)
+		}
+		files := ab.ListFiles()
+		if len(files) != 8 || files[0] != "bag-info.txt" {
+			t.Errorf("Unexpected files in bag: %v", files)
+		}
+		report := ab.Validate()
+		if !report.IsValid() {
+			t.Errorf("%s bag should be valid: %v", ext, report.Errors())
+		}
+		if report.Files["data/one.txt"].Checksums["sha256"] != FIXSHA256 {
+			t.Errorf("Report has wrong sha256 checksum for data/one.txt")
+		}
+	}
+}
+
+func TestReadArchiveBagErrors(t *testing.T) {
+	if _, err := bagins.ReadArchiveBag("bag.rar", nil); err == nil {
+		t.Errorf("ReadArchiveBag should reject unknown extensions")
+	}
+	noBagIt := writeZipFile(t, map[string]string{
+		"bag/manifest-md5.txt": FIXVALUE + " data/one.txt\n",
+		"bag/data/one.txt":     FIXSTRING,
+	})
+	defer os.Remove(noBagIt)
+	if _, err := bagins.ReadArchiveBag(noBagIt, nil); err == nil {
+		t.Errorf("ReadArchiveBag should reject an archive without bagit.txt")
+	}
+	unsafe := writeZipFile(t, map[string]string{
+		"bagit.txt":        "BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n",
+		"../evil.txt":      "evil",
+		"manifest-md5.txt": "",
+	})
+	defer os.Remove(unsafe)
+	if _, err := bagins.ReadArchiveBag(unsafe, nil); err == nil {
+		t.Errorf("ReadArchiveBag should reject entries outside the archive")
+	}
+}
+
+func TestArchiveBagValidateProblems(t *testing.T) {
+	// A 0.97 bag at the top level of a zip file, with a bad
+	// checksum, a missing file and an unmanifested file.
+	archivePath := writeZipFile(t, map[string]string{
+		"bagit.txt": "BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n",
+		"manifest-md5.txt": FIXVALUE + " data/one.txt\n" +
+			FIXVALUE + " data/bad.txt\n" +
+			FIXVALUE + " data/missing.txt\n",
+		"data/one.txt":   FIXSTRING,
+		"data/bad.txt":   strings.ToUpper(FIXSTRING),
+		"data/extra.txt": FIXSTRING,
+	})
+	defer os.Remove(archivePath)
+
+	ab, err := bagins.ReadArchiveBag(archivePath, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	report := ab.Validate()
+	if report.IsValid() {
+		t.Errorf("Bag should not be valid")
+	}
+	expected := map[bagins.ProblemType]string{
+		bagins.ChecksumMismatch: "data/bad.txt",
+		bagins.MissingFile:      "data/missing.txt",
+		bagins.UnmanifestedFile: "data/extra.txt",
+	}
+	for problemType, pathInBag := range expected {
+		problems := report.ProblemsOfType(problemType)
+		if len(problems) != 1 || problems[0].Path != pathInBag {
+			t.Errorf("Expected one %s problem for %s, got %v", problemType, pathInBag, problems)
+		}
+	}
+	if len(report.Problems) != 3 {
+		t.Errorf("Expected 3 problems, got %d: %v", len(report.Problems), report.Errors())
+	}
+	if report.BagPath != archivePath {
+		t.Errorf("Report should have the path to the archive, got %s", report.BagPath)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package bagins
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Returns the access time of the file described by info, or its
+// modification time if the access time isn't known.
+func accessTime(info fs.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Atimespec.Sec), int64(stat.Atimespec.Nsec))
+	}
+	return info.ModTime()
+}
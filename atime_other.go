@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package bagins
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Access times are not read on this OS, so the modification time
+// is used instead.
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package bagins
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Returns the access time of the file described by info, or its
+// modification time if the access time isn't known.
+func accessTime(info fs.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
@@ -18,22 +18,45 @@ package bagins
 */
 
 import (
-	"github.com/APTrust/bagins/bagutil"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// Versions of the BagIt specification this library can create and read.
+// BagItVersion097 is http://tools.ietf.org/html/draft-kunze-bagit-14 and
+// BagItVersion10 is RFC 8493, https://tools.ietf.org/html/rfc8493
+const (
+	BagItVersion097 = "0.97"
+	BagItVersion10  = "1.0"
+)
+
+// DefaultBagItVersion is the version of the bags made by BagInPlace and
+// bagmaker when no version is given.
+const DefaultBagItVersion = BagItVersion097
+
 // Represents the basic structure of a bag which is controlled by methods.
 type Bag struct {
 	pathToFile              string // path to the bag
+	version                 string // BagIt version from bagit.txt
 	payload                 *Payload
 	Manifests               []*Manifest
 	tagfiles                map[string]*TagFile // Key is relative path
 	excludeFromTagManifests map[string]bool
+	fetchFile               *FetchFile // nil unless the bag has fetch.txt
+	fetcher                 Fetcher    // Used by ResolveFetch
+	fsys                    FileSystem // File system the bag is read from and written to
+	autoBagInfo             bool       // Fill in the reserved bag-info.txt fields on Save
+	modTimeFile             string     // Tag file Save writes modification times to, if not empty
+	guard                   *pathGuard // Checks paths from the bag's files stay inside it
 }
 
 // METHODS FOR CREATING AND INITALIZING BAGS
@@ -51,12 +74,49 @@ type Bag struct {
  If param createTagManifests is true, this will also create tag manifests
  with the specified algorithms.
 
+ Param version is the version of the BagIt spec the bag should follow,
+ either BagItVersion097 or BagItVersion10. It is written to bagit.txt and
+ determines how manifests are written and how the bag is validated.
+
  example:
-		NewBag("archive/bags", "bag-34323", ["sha256", "md5"], true)
+		NewBag("archive/bags", "bag-34323", ["sha256", "md5"], true, bagins.BagItVersion10)
+*/
+func NewBag(location string, name string, hashNames []string, createTagManifests bool, version string) (*Bag, error) {
+	return newBag(context.Background(), OSFileSystem{}, location, name, hashNames, createTagManifests, version)
+}
+
+/*
+ Creates a new bag as NewBag does, but stops when ctx is done. If the bag
+ could not be finished, its directory is removed and ctx.Err() is returned.
 */
-func NewBag(location string, name string, hashNames []string, createTagManifests bool) (*Bag, error) {
+func NewBagContext(ctx context.Context, location string, name string, hashNames []string, createTagManifests bool, version string) (*Bag, error) {
+	return newBag(ctx, OSFileSystem{}, location, name, hashNames, createTagManifests, version)
+}
+
+/*
+ Creates a new bag in fsys, as NewBag does. The location is a path in
+ fsys, and the bag reads and writes all of its files through fsys,
+ including the source files passed to AddFile, AddDir and AddCustomTagfile.
+
+ example:
+		fsys := bagins.NewMemFileSystem()
+		NewBagFS(fsys, ".", "bag-34323", ["sha256"], true, bagins.BagItVersion10)
+*/
+func NewBagFS(fsys FileSystem, location string, name string, hashNames []string, createTagManifests bool, version string) (*Bag, error) {
+	return newBag(context.Background(), fsys, location, name, hashNames, createTagManifests, version)
+}
+
+// Does the work of NewBag, NewBagContext and NewBagFS.
+func newBag(ctx context.Context, fsys FileSystem, location string, name string, hashNames []string, createTagManifests bool, version string) (*Bag, error) {
+	if !isSupportedVersion(version) {
+		return nil, fmt.Errorf("Unsupported BagIt version '%s'. Must be %s or %s",
+			version, BagItVersion097, BagItVersion10)
+	}
+
 	// Create the bag object.
 	bag := new(Bag)
+	bag.version = version
+	bag.fsys = fsys
 
 	if bag.Manifests == nil {
 		bag.Manifests = make([]*Manifest, 0)
@@ -64,39 +124,24 @@ func NewBag(location string, name string, hashNames []string, createTagManifests
 
 	// Start with creating the directories.
 	bag.pathToFile = filepath.Join(location, name)
-	err := os.Mkdir(bag.pathToFile, 0755)
+	err := fsys.Mkdir(bag.pathToFile, 0755)
 	if err != nil {
 		return nil, err
 	}
 	//defer bag.Save()
 
 	// Init the manifests and tag manifests
-	for _, hashName := range hashNames {
-		lcHashName := strings.ToLower(hashName)
-		manifest, err := NewManifest(bag.Path(), lcHashName, PayloadManifest)
-		if err != nil {
-			return nil, err
-		}
-		bag.Manifests = append(bag.Manifests, manifest)
-
-		if createTagManifests == true {
-			tagManifestName := fmt.Sprintf("tagmanifest-%s.txt", lcHashName)
-			fullPath := filepath.Join(bag.Path(), tagManifestName)
-			tagmanifest, err := NewManifest(fullPath, lcHashName, TagManifest)
-			if err != nil {
-				return nil, err
-			}
-			bag.Manifests = append(bag.Manifests, tagmanifest)
-		}
+	if err := bag.initManifests(hashNames, createTagManifests); err != nil {
+		return nil, err
 	}
 
 	// Init the payload directory and such.
 	plPath := filepath.Join(bag.Path(), "data")
-	err = os.Mkdir(plPath, 0755)
+	err = fsys.Mkdir(plPath, 0755)
 	if err != nil {
 		return nil, err
 	}
-	bag.payload, err = NewPayload(plPath)
+	bag.payload, err = NewPayloadFS(fsys, plPath)
 	if err != nil {
 		return nil, err
 	}
@@ -110,20 +155,48 @@ func NewBag(location string, name string, hashNames []string, createTagManifests
 	}
 	bag.tagfiles["bagit.txt"] = tf
 
-	errors := bag.Save()
-	if err != nil && len(errors) > 0 {
-		message := ""
-		for _, e := range errors {
-			message = fmt.Sprintf("%s, %s", message, e.Error())
-		}
-		return nil, fmt.Errorf(message)
+	errs := bag.SaveContext(ctx)
+	if ctx.Err() != nil {
+		removeAll(fsys, bag.pathToFile)
+		return nil, ctx.Err()
+	}
+	if len(errs) > 0 {
+		removeAll(fsys, bag.pathToFile)
+		return nil, errors.Join(errs...)
 	}
 
 	return bag, nil
 }
 
+// Adds a payload manifest for each of hashNames to a new bag, and
+// a tag manifest for each if createTagManifests is true.
+func (b *Bag) initManifests(hashNames []string, createTagManifests bool) error {
+	for _, hashName := range hashNames {
+		lcHashName := strings.ToLower(hashName)
+		manifest, err := NewManifestFS(b.fsys, b.Path(), lcHashName, PayloadManifest)
+		if err != nil {
+			return err
+		}
+		manifest.bagItVersion = b.version
+		b.Manifests = append(b.Manifests, manifest)
+
+		if createTagManifests == true {
+			tagManifestName := fmt.Sprintf("tagmanifest-%s.txt", lcHashName)
+			fullPath := filepath.Join(b.Path(), tagManifestName)
+			tagmanifest, err := NewManifestFS(b.fsys, fullPath, lcHashName, TagManifest)
+			if err != nil {
+				return err
+			}
+			tagmanifest.bagItVersion = b.version
+			b.Manifests = append(b.Manifests, tagmanifest)
+		}
+	}
+	return nil
+}
+
 // Creates the required bagit.txt file as per the specification
 // http://tools.ietf.org/html/draft-kunze-bagit-09#section-2.1.1
+// with the bag's BagIt version.
 func (b *Bag) createBagItFile() (*TagFile, error) {
 	if err := b.AddTagfile("bagit.txt"); err != nil {
 		return nil, err
@@ -132,7 +205,7 @@ func (b *Bag) createBagItFile() (*TagFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	bagit.Data.AddField(*NewTagField("BagIt-Version", "0.97"))
+	bagit.Data.AddField(*NewTagField("BagIt-Version", b.version))
 	bagit.Data.AddField(*NewTagField("Tag-File-Character-Encoding", "UTF-8"))
 
 	return bagit, nil
@@ -141,10 +214,53 @@ func (b *Bag) createBagItFile() (*TagFile, error) {
 /*
 	Reads the directory provided as the root of a new bag and attemps to parse the file
 	contents into payload, manifests and tagfiles.
+
+	The BagIt version is read from bagit.txt and determines how manifests
+	are parsed. Version 1.0 bags whose bagit.txt starts with a byte order
+	mark are rejected, as required by RFC 8493.
 */
 func ReadBag(pathToFile string, tagfiles []string) (*Bag, error) {
+	return ReadBagFS(OSFileSystem{}, pathToFile, tagfiles)
+}
+
+/*
+	Reads the bag at pathToFile in fsys, as ReadBag does. To validate
+	a bag in any io/fs.FS, pass it through NewReadOnlyFileSystem.
+*/
+func ReadBagFS(fsys FileSystem, pathToFile string, tagfiles []string) (*Bag, error) {
+	return ReadBagWithOptions(pathToFile, tagfiles, &ReadBagOptions{FileSystem: fsys})
+}
+
+// ReadBagOptions holds the settings for ReadBagWithOptions and
+// ReadArchiveBagWithOptions. The zero value, or a nil pointer, reads
+// manifests leniently from the OS file system, as ReadBag does.
+type ReadBagOptions struct {
+	FileSystem FileSystem // File system the bag is on, OSFileSystem if nil. Not used for archives
+	ParseMode  ParseMode  // How manifests are parsed, ParseLenient if empty
+}
+
+/*
+	Reads the bag at pathToFile as ReadBag does, with the settings in opts.
+	With ParseStrict, every bad line in every manifest is reported, and
+	the returned error holds a *ParseError for each of them, which can be
+	found with errors.As.
+
+	example:
+
+		bag, err := bagins.ReadBagWithOptions("/bags/partner-bag", []string{},
+			&bagins.ReadBagOptions{ParseMode: bagins.ParseStrict})
+*/
+func ReadBagWithOptions(pathToFile string, tagfiles []string, opts *ReadBagOptions) (*Bag, error) {
+	if opts == nil {
+		opts = &ReadBagOptions{}
+	}
+	if err := validateParseMode(opts.ParseMode); err != nil {
+		return nil, err
+	}
+	fsys := defaultFileSystem(opts.FileSystem)
+
 	// validate existence
-	fi, err := os.Stat(pathToFile)
+	fi, err := fsys.Stat(pathToFile)
 	if err != nil {
 		return nil, err
 	}
@@ -153,50 +269,61 @@ func ReadBag(pathToFile string, tagfiles []string) (*Bag, error) {
 	}
 
 	// Get the payload directory.
-	payload, err := NewPayload(filepath.Join(pathToFile, "data"))
+	payload, err := NewPayloadFS(fsys, filepath.Join(pathToFile, "data"))
 	if err != nil {
 		return nil, err
 	}
 
 	// Get the bag root directory.
 	bag := new(Bag)
+	bag.fsys = fsys
 	bag.pathToFile = pathToFile
 	bag.payload = payload
 	bag.tagfiles = make(map[string]*TagFile)
 	bag.excludeFromTagManifests = make(map[string]bool)
 
-	errors := bag.findManifests()
-	if errors != nil {
-		errorMessage := ""
-		for _, e := range errors {
-			errorMessage = fmt.Sprintf("%s; %s", errorMessage, e.Error())
-		}
-		return nil, fmt.Errorf(errorMessage)
+	bag.version, err = readBagItVersion(fsys, filepath.Join(pathToFile, "bagit.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := bag.findManifests(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 	if len(bag.Manifests) == 0 {
 		return nil, fmt.Errorf("Unable to parse a manifest")
 	}
 
+	var parseErrors []error
 	for i := range bag.Manifests {
 		manifest := bag.Manifests[i]
 		manifestPath := manifest.Name()
 		if filepath.Dir(manifestPath) != bag.pathToFile {
 			manifestPath = filepath.Join(bag.pathToFile, manifest.Name())
 		}
-		if _, err := os.Stat(manifestPath); err != nil {
-			return nil, fmt.Errorf("Can't find manifest: %v", err)
+		if _, err := fsys.Stat(manifestPath); err != nil {
+			return nil, fmt.Errorf("Can't find manifest: %w", err)
 		}
-		parsedManifest, errs := ReadManifest(manifestPath)
-		if errs != nil && len(errs) > 0 {
-			errors := ""
-			for _, e := range(errs) {
-				errors = fmt.Sprintf("%s; %s", errors, e.Error())
-			}
-			return nil, fmt.Errorf("Unable to parse manifest %s: %s", manifestPath, errors)
+		parsedManifest, errs := readManifest(fsys, manifestPath, bag.version, opts.ParseMode)
+		if len(errs) > 0 {
+			parseErrors = append(parseErrors,
+				fmt.Errorf("Unable to parse manifest %s: %w", manifestPath, errors.Join(errs...)))
 		} else {
 			bag.Manifests[i] = parsedManifest
 		}
 	}
+	if len(parseErrors) > 0 {
+		return nil, errors.Join(parseErrors...)
+	}
+
+	fetchPath := filepath.Join(bag.pathToFile, "fetch.txt")
+	if _, err := fsys.Stat(fetchPath); err == nil {
+		fetchFile, errs := readFetchFile(fsys, fetchPath, bag.version)
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("Unable to parse fetch file %s: %w", fetchPath, errors.Join(errs...))
+		}
+		bag.fetchFile = fetchFile
+	}
 
 	/*
        Note that we are parsing tags from the expected tag files, and
@@ -213,7 +340,11 @@ func ReadBag(pathToFile string, tagfiles []string) (*Bag, error) {
        octet streams for the purpose of checksum verification.
     */
 	for _, tName := range tagfiles {
-		tf, errs := ReadTagFile(filepath.Join(bag.pathToFile, tName))
+		tagFilePath, err := bag.safeJoin(tName, "the list of tag files")
+		if err != nil {
+			return nil, err
+		}
+		tf, errs := ReadTagFileFS(fsys, tagFilePath)
 		// Warn on Stderr only if we're running as bagmaker
 		if len(errs) != 0 && strings.Index(os.Args[0], "bagmaker") > -1 {
 			log.Println("While parsing tagfiles:", errs)
@@ -226,6 +357,44 @@ func ReadBag(pathToFile string, tagfiles []string) (*Bag, error) {
 	return bag, nil
 }
 
+// Returns the BagIt-Version from the bagit.txt file at pathToFile, or an
+// empty string if the bag has no bagit.txt. Returns an error if the file
+// can't be parsed or if it is a version 1.0 bagit.txt that starts with a
+// byte order mark.
+func readBagItVersion(fsys FileSystem, pathToFile string) (string, error) {
+	data, err := fs.ReadFile(fsys, pathToFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return parseBagItVersion(data, pathToFile)
+}
+
+// Returns the BagIt-Version from the contents of a bagit.txt file.
+// name is only used in error messages.
+func parseBagItVersion(data []byte, name string) (string, error) {
+	fields, errs := parseTagFields(bytes.NewReader(data), name)
+	if len(errs) > 0 {
+		return "", fmt.Errorf("Unable to parse %s: %w", name, errs[0])
+	}
+	version := ""
+	for _, field := range fields {
+		if field.Label() == "BagIt-Version" {
+			version = field.Value()
+		}
+	}
+	if version == BagItVersion10 && hasByteOrderMark(data) {
+		return "", fmt.Errorf("%s must not begin with a byte order mark", name)
+	}
+	return version, nil
+}
+
+// Returns true if version is one of the BagIt versions this library supports.
+func isSupportedVersion(version string) bool {
+	return version == BagItVersion097 || version == BagItVersion10
+}
+
 // Finds all payload and tag manifests in an existing bag.
 // This is used by ReadBag, not when creating a bag.
 func (b *Bag) findManifests() ([]error){
@@ -242,7 +411,7 @@ func (b *Bag) findManifests() ([]error){
 
 			if strings.HasPrefix(filePath, payloadManifestPrefix) ||
 				strings.HasPrefix(filePath, tagManifestPrefix) {
-				manifest, errors := ReadManifest(filePath)
+				manifest, errors := readManifest(b.fsys, filePath, b.version, ParseLenient)
 				if errors != nil && len(errors) > 0 {
 					return errors
 				}
@@ -270,13 +439,46 @@ func (b *Bag) AddFile(src string, dst string) error {
 	return err
 }
 
+/*
+  Writes the contents of r to the data directory under the relative path
+  and filename provided in the dst parameter, hashing it for every
+  payload manifest as it is written. See Payload.AddReader.
+  example:
+			resp, err := http.Get("https://example.com/report.pdf")
+			...
+			err = b.AddReader(resp.Body, "reports/report.pdf")
+*/
+func (b *Bag) AddReader(r io.Reader, dst string) error {
+	_, err := b.payload.AddReader(r, dst, b.GetManifests(PayloadManifest))
+	return err
+}
+
+// Performs a Bag.AddReader that stops when ctx is done. Pass the number
+// of bytes r holds as size, or -1 if it is not known. See
+// Payload.AddReaderContext.
+func (b *Bag) AddReaderContext(ctx context.Context, r io.Reader, dst string, size int64) error {
+	_, err := b.payload.AddReaderContext(ctx, r, dst, size, b.GetManifests(PayloadManifest))
+	return err
+}
+
 // Performans a Bag.AddFile on all files found under the src
 // location including all subdirectories.
 // example:
 //			errs := b.AddDir("/tmp/mypreservationfiles")
 func (b *Bag) AddDir(src string) (errs []error) {
+	return b.AddDirContext(context.Background(), src)
+}
+
+// Performs a Bag.AddDir that stops when ctx is done, reporting progress
+// to the function set with SetProgressFunc. Files that were being copied
+// when ctx was done are removed, and ctx.Err() is the last error returned.
+// Files that were finished stay in the bag.
+// example:
+//			ctx, cancel := context.WithCancel(context.Background())
+//			errs := b.AddDirContext(ctx, "/tmp/mypreservationfiles")
+func (b *Bag) AddDirContext(ctx context.Context, src string) (errs []error) {
 	payloadManifests := b.GetManifests(PayloadManifest)
-	_, errs = b.payload.AddAll(src, payloadManifests)
+	_, errs = b.payload.AddAllContext(ctx, src, payloadManifests)
 	return errs
 }
 
@@ -303,10 +505,10 @@ func (b *Bag) AddDir(src string) (errs []error) {
 */
 func (b *Bag) AddTagfile(name string) error {
 	tagFilePath := filepath.Join(b.Path(), name)
-	if err := os.MkdirAll(filepath.Dir(tagFilePath), 0766); err != nil {
+	if err := b.fsys.MkdirAll(filepath.Dir(tagFilePath), 0766); err != nil {
 		return err
 	}
-	tf, err := NewTagFile(tagFilePath)
+	tf, err := NewTagFileFS(b.fsys, tagFilePath)
 	if err != nil {
 		return err
 	}
@@ -357,16 +559,17 @@ func (b *Bag) AddCustomTagfile(sourcePath string, destPath string, includeInTagM
 	}
 
 	if absSourcePath != absDestPath {
-		sourceFile, err := os.Open(absSourcePath)
+		destFilePath := filepath.Join(b.pathToFile, destPath)
+		sourceFile, err := b.fsys.Open(sourcePath)
 		if err != nil {
 			return err
 		}
 		defer sourceFile.Close()
 
-		if err = os.MkdirAll(filepath.Dir(absDestPath), 0766); err != nil {
+		if err = b.fsys.MkdirAll(filepath.Dir(destFilePath), 0766); err != nil {
 			return err
 		}
-		destFile, err := os.Create(absDestPath)
+		destFile, err := b.fsys.Create(destFilePath)
 		if err != nil {
 			return err
 		}
@@ -420,16 +623,20 @@ func (b *Bag) ListTagFiles() []string {
 }
 
 // Returns a list of unparsed tag files, which includes any file
-// not a manifest, not in the data directory, and not among the
-// tag files passed into ReadBag().
+// not a manifest, not in the data directory, not fetch.txt, and not
+// among the tag files passed into ReadBag(). Symbolic links are handled
+// by the symlink policy, with the bag directory as the root.
 func (b *Bag) UnparsedTagFiles() ([]string, error) {
 	var files []string
 
 	// WalkDir function to collect files in the bag..
-	visit := func(pathToFile string, info os.FileInfo, err error) error {
+	visit := func(pathToFile string, info fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && pathToFile == b.payload.Name() {
+			return fs.SkipDir
+		}
 
 		relativePath, err := filepath.Rel(b.Path(), pathToFile)
 		if err != nil {
@@ -440,8 +647,9 @@ func (b *Bag) UnparsedTagFiles() ([]string, error) {
 		isManifest := (strings.HasPrefix(relativePath, "tagmanifest-") ||
 			strings.HasPrefix(relativePath, "manifest-"))
 		_, isParsedTagFile := b.tagfiles[relativePath]
+		isFetchFile := b.fetchFile != nil && relativePath == "fetch.txt"
 
-		if !info.IsDir() && !isPayload && !isParsedTagFile && !isManifest {
+		if !info.IsDir() && !isPayload && !isParsedTagFile && !isManifest && !isFetchFile {
 			if relativePath != "." {
 				files = append(files, relativePath)
 			}
@@ -449,7 +657,8 @@ func (b *Bag) UnparsedTagFiles() ([]string, error) {
 		return err
 	}
 
-	if err := filepath.Walk(b.Path(), visit); err != nil {
+	walker := newLinkWalker(b.fsys, b.Path(), b.payload.symlinks)
+	if err := walker.walk(visit, nil); err != nil {
 		return nil, err
 	}
 
@@ -470,6 +679,76 @@ func (b *Bag) BagInfo() (*TagFile, error) {
 	return tf, nil
 }
 
+/*
+ Returns bag-info.txt wrapped in a BagInfo, for getting and setting its
+ reserved fields. Like BagInfo, it returns an error if the bag does not
+ have a bag-info.txt tag file.
+ example:
+			info, err := b.Info()
+			info.SetSourceOrganization("APTrust")
+*/
+func (b *Bag) Info() (*BagInfo, error) {
+	tf, err := b.BagInfo()
+	if err != nil {
+		return nil, err
+	}
+	return NewBagInfo(tf), nil
+}
+
+/*
+ Turns the automatic filling in of reserved bag-info.txt fields on or off.
+ It is off by default. When it is on, every Save writes these fields:
+
+	Payload-Oxum: the octets and file count of the payload, as octets.count
+	Bag-Size: the size of the payload for people to read, such as "1.5 MB"
+	Bagging-Date: today's date, unless the field is already set
+
+ Turning it on adds bag-info.txt to the bag if it is not there. A
+ bag-info.txt that is on disk but was not parsed by ReadBag is read first,
+ so its fields are kept.
+*/
+func (b *Bag) SetAutoBagInfo(auto bool) error {
+	b.autoBagInfo = auto
+	if !auto {
+		return nil
+	}
+	return b.loadBagInfo()
+}
+
+// Makes sure bag-info.txt is one of the bag's parsed tag files, reading
+// it if it is on disk, or adding it if it is not.
+func (b *Bag) loadBagInfo() error {
+	if _, err := b.BagInfo(); err == nil {
+		return nil
+	}
+	bagInfoPath := filepath.Join(b.Path(), "bag-info.txt")
+	if _, err := b.fsys.Stat(bagInfoPath); err == nil {
+		tf, errs := ReadTagFileFS(b.fsys, bagInfoPath)
+		if len(errs) > 0 {
+			return errs[0]
+		}
+		b.tagfiles["bag-info.txt"] = tf
+		return nil
+	}
+	return b.AddTagfile("bag-info.txt")
+}
+
+// Sets the reserved bag-info.txt fields that Save fills in
+// when SetAutoBagInfo is on.
+func (b *Bag) updateBagInfo() error {
+	info, err := b.Info()
+	if err != nil {
+		return err
+	}
+	octets, count := b.payload.OctetStreamSum()
+	info.SetPayloadOxum(octets, count)
+	info.SetBagSize(humanSize(octets))
+	if info.Data.Value(BaggingDate) == "" {
+		info.SetBaggingDate(time.Now())
+	}
+	return nil
+}
+
 
 // Returns the manifest with the specified algorithm and type,
 // or nil. For example, GetManifest(PayloadManifest, "sha256")
@@ -498,7 +777,84 @@ func (b *Bag) GetManifests(manifestType string) ([]*Manifest) {
 	return manifests
 }
 
-// TODO create methods for managing fetch file.
+// METHODS FOR MANAGING THE FETCH FILE
+
+/*
+ Adds an entry to fetch.txt for a payload file that is not in the bag but
+ can be retrieved from url. The dst param is the file's path relative to
+ the data directory, as in AddFile, and length is its size in bytes or
+ FetchLengthUnknown.
+
+ Param checksums must contain a digest for the algorithm of each payload
+ manifest, keyed by algorithm name, because the spec requires fetched
+ files to be listed in the payload manifests. fetch.txt is written when
+ the bag is saved. Returns an error if dst is not inside the data
+ directory.
+
+ example:
+			err := b.AddFetchEntry("https://example.com/big.tar", 1048576,
+				"big.tar", map[string]string{"sha256": "0b0b0b0b"})
+*/
+func (b *Bag) AddFetchEntry(url string, length int64, dst string, checksums map[string]string) error {
+	dst, err := payloadRelPath(dst)
+	if err != nil {
+		return err
+	}
+	pathInBag := filepath.Join("data", dst)
+	payloadManifests := b.GetManifests(PayloadManifest)
+	for _, m := range payloadManifests {
+		if _, ok := checksums[m.Algorithm()]; !ok {
+			return fmt.Errorf("Fetch entry for %s needs a %s checksum for %s",
+				pathInBag, m.Algorithm(), filepath.Base(m.Name()))
+		}
+	}
+	if b.fetchFile == nil {
+		fetchFile, err := newFetchFile(b.fsys, filepath.Join(b.Path(), "fetch.txt"))
+		if err != nil {
+			return err
+		}
+		fetchFile.bagItVersion = b.version
+		b.fetchFile = fetchFile
+	}
+	for _, m := range payloadManifests {
+		m.Data[pathInBag] = checksums[m.Algorithm()]
+	}
+	b.fetchFile.Entries = append(b.fetchFile.Entries, FetchEntry{
+		URL:    url,
+		Length: length,
+		Path:   filepath.ToSlash(pathInBag),
+	})
+	return nil
+}
+
+// Returns the entries in the bag's fetch.txt file, or an
+// empty slice if the bag has none.
+func (b *Bag) FetchEntries() []FetchEntry {
+	entries := make([]FetchEntry, 0)
+	if b.fetchFile != nil {
+		entries = append(entries, b.fetchFile.Entries...)
+	}
+	return entries
+}
+
+// Sets the Fetcher that ResolveFetch uses to download the files
+// listed in fetch.txt. Pass nil to use DefaultFetcher.
+func (b *Bag) SetFetcher(fetcher Fetcher) {
+	b.fetcher = fetcher
+}
+
+// Returns true if pathInBag is listed in the bag's fetch.txt file.
+func (b *Bag) isFetchEntry(pathInBag string) bool {
+	if b.fetchFile == nil {
+		return false
+	}
+	for _, entry := range b.fetchFile.Entries {
+		if filepath.FromSlash(entry.Path) == pathInBag {
+			return true
+		}
+	}
+	return false
+}
 
 // METHODS FOR MANAGING OR RETURNING INFORMATION ABOUT THE BAG ITSELF
 
@@ -507,27 +863,156 @@ func (b *Bag) Path() string {
 	return b.pathToFile
 }
 
+// Returns the file system the bag is read from and written to.
+func (b *Bag) FileSystem() FileSystem {
+	return b.fsys
+}
+
+/*
+ Sets the number of files the bag copies and hashes at the same time in
+ AddDir, and in RunChecksums on its manifests. Zero or less means one
+ per CPU, which is the default. See Payload.SetWorkers.
+*/
+func (b *Bag) SetWorkers(workers int) {
+	b.payload.SetWorkers(workers)
+	for _, m := range b.Manifests {
+		m.SetWorkers(workers)
+	}
+}
+
+/*
+ Sets how AddFile and AddDir put files into the payload directory. See
+ Payload.SetIngestStrategy.
+ example:
+			b.SetIngestStrategy(bagins.IngestHardLink)
+*/
+func (b *Bag) SetIngestStrategy(strategy IngestStrategy) {
+	b.payload.SetIngestStrategy(strategy)
+}
+
+/*
+ Sets the filter that chooses which files AddDir adds. See
+ Payload.SetFilter.
+ example:
+			err := b.SetFilter(bagins.DefaultFilter())
+*/
+func (b *Bag) SetFilter(filter *Filter) error {
+	return b.payload.SetFilter(filter)
+}
+
+/*
+ Sets what AddFile and AddDir do with symbolic links, and how they are
+ treated when the files in the bag are listed and validated. See
+ Payload.SetSymlinkPolicy.
+ example:
+			err := b.SetSymlinkPolicy(bagins.SymlinkSkip)
+*/
+func (b *Bag) SetSymlinkPolicy(policy SymlinkPolicy) error {
+	return b.payload.SetSymlinkPolicy(policy)
+}
+
+/*
+ Sets the line ending of every manifest and tag manifest in the bag,
+ either LineEndingLF, the default, or LineEndingCRLF. See
+ Manifest.SetLineEnding.
+ example:
+			err := b.SetLineEnding(bagins.LineEndingCRLF)
+*/
+func (b *Bag) SetLineEnding(lineEnding LineEnding) error {
+	for _, m := range b.Manifests {
+		if err := m.SetLineEnding(lineEnding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the files and directories AddDir skipped because of the
+// filter or the symlink policy. See Payload.SkippedFiles.
+func (b *Bag) SkippedFiles() []SkippedFile {
+	return b.payload.SkippedFiles()
+}
+
+// Returns the strategy used for each file added with AddFile and
+// AddDir, keyed by its path in the bag. See Payload.IngestStrategies.
+func (b *Bag) IngestStrategies() map[string]IngestStrategy {
+	return b.payload.IngestStrategies()
+}
+
+/*
+ Sets a function that AddDir reports its progress to, as does
+ RunChecksums on the bag's manifests. Pass nil to stop reporting
+ progress. See ProgressFunc.
+*/
+func (b *Bag) SetProgressFunc(fn ProgressFunc) {
+	b.payload.SetProgressFunc(fn)
+	for _, m := range b.Manifests {
+		m.SetProgressFunc(fn)
+	}
+}
+
+// Returns the version of the BagIt spec the bag follows, as written in
+// its bagit.txt file. Returns an empty string for bags read without a
+// bagit.txt file.
+func (b *Bag) Version() string {
+	return b.version
+}
+
 /*
  This method writes all the relevant tag and manifest files to finish off the
  bag.
 */
 func (b *Bag) Save() (errs []error) {
+	return b.SaveContext(context.Background())
+}
+
+/*
+ Performs a Save that stops before writing the next file once ctx is
+ done, returning ctx.Err() as the last error. A bag whose save was
+ stopped is incomplete until it is saved again.
+*/
+func (b *Bag) SaveContext(ctx context.Context) (errs []error) {
 
 	errors := b.savePayloadManifests()
 	if len(errors) > 0 {
 		errs = append(errs, errors...)
 	}
 
-	errors = b.calculateChecksumsForManagedTagFiles()
+	if b.fetchFile != nil && ctx.Err() == nil {
+		if err := b.fetchFile.Create(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return append(errs, err)
+	}
+	if b.modTimeFile != "" {
+		if err := b.saveModTimes(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if b.autoBagInfo {
+		if err := b.updateBagInfo(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errors = b.calculateChecksumsForManagedTagFiles(ctx)
 	if len(errors) > 0 {
 		errs = append(errs, errors...)
 	}
 
-	errors = b.calculateChecksumsForCustomTagFiles()
+	if err := ctx.Err(); err != nil {
+		return append(errs, err)
+	}
+	errors = b.calculateChecksumsForCustomTagFiles(ctx)
 	if len(errors) > 0 {
 		errs = append(errs, errors...)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return append(errs, err)
+	}
 	errors = b.saveTagManifests()
 	if len(errors) > 0 {
 		errs = append(errs, errors...)
@@ -549,10 +1034,13 @@ func (b *Bag) savePayloadManifests() (errs []error) {
 	return errs
 }
 
-func (b *Bag) calculateChecksumsForManagedTagFiles() (errs []error) {
+func (b *Bag) calculateChecksumsForManagedTagFiles(ctx context.Context) (errs []error) {
 	tagManifests := b.GetManifests(TagManifest)
 	for _, tf := range b.tagfiles {
-		if err := os.MkdirAll(filepath.Dir(tf.Name()), 0766); err != nil {
+		if ctx.Err() != nil {
+			return errs
+		}
+		if err := b.fsys.MkdirAll(filepath.Dir(tf.Name()), 0766); err != nil {
 			errs = append(errs, err)
 		}
 		if err := tf.Create(); err != nil {
@@ -561,10 +1049,10 @@ func (b *Bag) calculateChecksumsForManagedTagFiles() (errs []error) {
 		// Add tag file checksums to tag manifests
 		for i := range tagManifests {
 			manifest := tagManifests[i]
-			checksum, err := bagutil.FileChecksum(tf.Name(), manifest.hashFunc())
+			checksum, err := fileChecksum(b.fsys, tf.Name(), manifest.hashFunc())
 			if err != nil {
 				errors := []error {
-					fmt.Errorf("Error calculating %s checksum for file %s: %v",
+					fmt.Errorf("Error calculating %s checksum for file %s: %w",
 						manifest.Algorithm(), tf.Name(), err),
 				}
 				return errors
@@ -576,7 +1064,7 @@ func (b *Bag) calculateChecksumsForManagedTagFiles() (errs []error) {
 	return errs
 }
 
-func (b *Bag) calculateChecksumsForCustomTagFiles() (errs []error) {
+func (b *Bag) calculateChecksumsForCustomTagFiles(ctx context.Context) (errs []error) {
 	// Calculate checksums that go into the tag manifests.
 	nonPayloadFiles, err := b.UnparsedTagFiles()
 	if err != nil {
@@ -587,7 +1075,13 @@ func (b *Bag) calculateChecksumsForCustomTagFiles() (errs []error) {
 	for _, m := range payloadManifests {
 		nonPayloadFiles = append(nonPayloadFiles, m.Name())
 	}
+	if b.fetchFile != nil {
+		nonPayloadFiles = append(nonPayloadFiles, b.fetchFile.Name())
+	}
 	for _, file := range nonPayloadFiles {
+		if ctx.Err() != nil {
+			return errs
+		}
 		relativeFilePath := strings.Replace(file, b.pathToFile + "/", "", 1)
 		if _, exclude := b.excludeFromTagManifests[relativeFilePath]; exclude {
 			continue
@@ -599,10 +1093,10 @@ func (b *Bag) calculateChecksumsForCustomTagFiles() (errs []error) {
 		}
 		for i := range tagManifests {
 			manifest := tagManifests[i]
-			checksum, err := bagutil.FileChecksum(absPathToFile, manifest.hashFunc())
+			checksum, err := fileChecksum(b.fsys, absPathToFile, manifest.hashFunc())
 			if err != nil {
 				errors := []error {
-					fmt.Errorf("Error calculating %s checksum for file %s: %v",
+					fmt.Errorf("Error calculating %s checksum for file %s: %w",
 						manifest.Algorithm(), file, err),
 				}
 				return errors
@@ -627,14 +1121,22 @@ func (b *Bag) saveTagManifests() (errs []error) {
 /*
  Walks the bag directory and subdirectories and returns the
  filepaths found inside and any errors skipping files in the
- payload directory.
+ payload directory. Symbolic links are handled by the symlink policy,
+ with the bag directory as the root. Links the policy does not allow
+ are left out, and returned together as the error along with the
+ other files.
 */
 func (b *Bag) ListFiles() ([]string, error) {
 
 	var files []string
+	var linkErrs []error
 
 	// WalkDir function to collect files in the bag..
-	visit := func(pathToFile string, info os.FileInfo, err error) error {
+	visit := func(pathToFile string, info fs.DirEntry, err error) error {
+		if isSymlinkError(err) {
+			linkErrs = append(linkErrs, err)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -651,9 +1153,10 @@ func (b *Bag) ListFiles() ([]string, error) {
 		return err
 	}
 
-	if err := filepath.Walk(b.Path(), visit); err != nil {
+	walker := newLinkWalker(b.fsys, b.Path(), b.payload.symlinks)
+	if err := walker.walk(visit, nil); err != nil {
 		return nil, err
 	}
 
-	return files, nil
+	return files, errors.Join(linkErrs...)
 }
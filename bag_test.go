@@ -2,10 +2,13 @@ package bagins_test
 
 import (
 	//	"fmt"
+	"context"
+	"errors"
 	"github.com/APTrust/bagins"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +18,7 @@ const (
 )
 
 func setupTestBag(bagName string) (*bagins.Bag, error) {
-	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5"}, false)
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5"}, false, bagins.BagItVersion097)
 	if err != nil {
 		return nil, err
 	}
@@ -24,7 +27,7 @@ func setupTestBag(bagName string) (*bagins.Bag, error) {
 
 // Setups up a bag with some custom tag files.
 func setupCustomBag(bagName string) (*bagins.Bag, error) {
-	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5", "sha256"}, true)
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5", "sha256"}, true, bagins.BagItVersion097)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +97,7 @@ func TestNewBag(t *testing.T) {
 
 	// It should raise an error if the destination dir does not exist.
 	badLocation := filepath.Join(os.TempDir(), "/GOTESTNOT_EXISTs/")
-	_, err := bagins.NewBag(badLocation, "_GOFAILBAG_", []string{"md5"}, false)
+	_, err := bagins.NewBag(badLocation, "_GOFAILBAG_", []string{"md5"}, false, bagins.BagItVersion097)
 	if err == nil {
 		t.Error("NewBag function does not recognize when a directory does not exist!")
 	}
@@ -103,11 +106,18 @@ func TestNewBag(t *testing.T) {
 	os.MkdirAll(filepath.Join(badLocation, "_GOFAILBAG_"), 0766)
 	defer os.RemoveAll(badLocation)
 
-	_, err = bagins.NewBag(badLocation, "_GOFAILBAG_", []string{"md5"}, false)
+	_, err = bagins.NewBag(badLocation, "_GOFAILBAG_", []string{"md5"}, false, bagins.BagItVersion097)
 	if err == nil {
 		t.Error("Error not thrown when bag already exists as expected.")
 	}
 
+	// It should raise an error for an unsupported BagIt version.
+	_, err = bagins.NewBag(os.TempDir(), "_GOFAILBAG_VERSION_", []string{"md5"}, false, "0.96")
+	if err == nil {
+		os.RemoveAll(filepath.Join(os.TempDir(), "_GOFAILBAG_VERSION_"))
+		t.Error("NewBag did not reject unsupported BagIt version 0.96")
+	}
+
 	// It should create a bag without any errors.
 	bagName := "_GOTEST_NEWBAG_"
 	bag, err := setupTestBag("_GOTEST_NEWBAG_")
@@ -132,6 +142,32 @@ func TestNewBag(t *testing.T) {
 	}
 }
 
+func TestNewBagContext(t *testing.T) {
+	// A cancelled bag should not be left half made.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bagPath := filepath.Join(os.TempDir(), "_GOTEST_NEWBAGCONTEXT_")
+	defer os.RemoveAll(bagPath)
+	_, err := bagins.NewBagContext(ctx, os.TempDir(), "_GOTEST_NEWBAGCONTEXT_", []string{"md5"}, true, bagins.BagItVersion10)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(bagPath); !os.IsNotExist(err) {
+		t.Errorf("NewBagContext left the bag directory behind")
+	}
+
+	bag, err := bagins.NewBagContext(context.Background(), os.TempDir(), "_GOTEST_NEWBAGCONTEXT_", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	if errs := bag.SaveContext(ctx); len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Expected context.Canceled from SaveContext, got %v", errs)
+	}
+	if errs := bag.SaveContext(context.Background()); len(errs) > 0 {
+		t.Errorf("Unexpected errors saving bag: %v", errs)
+	}
+}
+
 func TestReadBag(t *testing.T) {
 
 	// It should return an error when passed a path that doesn't exist.
@@ -199,6 +235,97 @@ func TestReadBag(t *testing.T) {
 	if baginfo == nil {
 		t.Errorf("Baginfo unexpectedly nil.")
 	}
+	if testBag.Version() != bagins.BagItVersion097 {
+		t.Errorf("Expected version %s, got '%s'", bagins.BagItVersion097, testBag.Version())
+	}
+}
+
+func TestReadBagStrict(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "strict-bag", []string{"md5", "sha1"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddFile("src/one.txt", "one.txt")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	strict := &bagins.ReadBagOptions{FileSystem: fsys, ParseMode: bagins.ParseStrict}
+	if _, err := bagins.ReadBagWithOptions("strict-bag", []string{}, strict); err != nil {
+		t.Errorf("Unexpected error reading a good bag strictly: %s", err)
+	}
+
+	// Corrupt both manifests.
+	writeMemFile(t, fsys, "strict-bag/manifest-md5.txt", FIXVALUE+" data/one.txt\n"+FIXVALUE+" data/one.txt\n")
+	writeMemFile(t, fsys, "strict-bag/manifest-sha1.txt", "not-a-checksum data/one.txt\n")
+	if _, err := bagins.ReadBagFS(fsys, "strict-bag", []string{}); err != nil {
+		t.Errorf("Unexpected error reading the bag leniently: %s", err)
+	}
+	_, err = bagins.ReadBagWithOptions("strict-bag", []string{}, strict)
+	if err == nil {
+		t.Fatal("Expected an error reading corrupt manifests strictly")
+	}
+	for _, name := range []string{"manifest-md5.txt line 2", "manifest-sha1.txt line 1"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected the error to report %s, got %s", name, err)
+		}
+	}
+	var parseErr *bagins.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Problem != bagins.DuplicatePath {
+		t.Errorf("Expected a ParseError for the duplicate path, got %v", err)
+	}
+}
+
+func TestBagItVersion10(t *testing.T) {
+	fi, _ := ioutil.TempFile("", "TEST_GO_VERSION10_")
+	fi.WriteString(FIXSTRING)
+	fi.Close()
+	defer os.Remove(fi.Name())
+
+	bagName := "__GO_TEST_VERSION10_BAG__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"sha256"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+
+	// It should write the version to bagit.txt.
+	bagit, _ := ioutil.ReadFile(filepath.Join(bagPath, "bagit.txt"))
+	if !strings.Contains(string(bagit), "BagIt-Version:  1.0") {
+		t.Errorf("bagit.txt does not contain version 1.0:\n%s", bagit)
+	}
+
+	// It should percent-encode CR, LF and % in manifest paths.
+	oddName := "100%\nodd\r.txt"
+	if err := bag.AddFile(fi.Name(), oddName); err != nil {
+		t.Fatalf("Unexpected error adding file: %s", err)
+	}
+	bag.Save()
+	manifest, _ := ioutil.ReadFile(filepath.Join(bagPath, "manifest-sha256.txt"))
+	if !strings.Contains(string(manifest), "data/100%25%0Aodd%0D.txt") {
+		t.Errorf("Manifest path is not percent-encoded:\n%s", manifest)
+	}
+
+	// It should decode the paths again when reading the bag.
+	rBag, err := bagins.ReadBag(bagPath, []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if rBag.Version() != bagins.BagItVersion10 {
+		t.Errorf("Expected version %s, got '%s'", bagins.BagItVersion10, rBag.Version())
+	}
+	sha256 := rBag.GetManifest(bagins.PayloadManifest, "sha256")
+	if _, ok := sha256.Data[filepath.Join("data", oddName)]; !ok {
+		t.Errorf("Decoded path %q not found in manifest %v", oddName, sha256.Data)
+	}
+
+	// It should refuse to read a 1.0 bag whose bagit.txt has a byte order mark.
+	ioutil.WriteFile(filepath.Join(bagPath, "bagit.txt"), append([]byte("\xEF\xBB\xBF"), bagit...), 0644)
+	if _, err := bagins.ReadBag(bagPath, []string{}); err == nil {
+		t.Errorf("ReadBag should reject a 1.0 bagit.txt with a byte order mark")
+	}
 }
 
 func TestReadCustomBag(t *testing.T) {
@@ -251,7 +378,7 @@ func TestReadCustomBag(t *testing.T) {
 		}
 		// Payload md5 manifest should have one entry
 		if len(payloadManifests[0].Data) != 1 {
-			t.Errorf("Payload manifest should have one entry, found %s", len(payloadManifests[0].Data))
+			t.Errorf("Payload manifest should have one entry, found %d", len(payloadManifests[0].Data))
 		}
 		for key, value := range payloadManifests[0].Data {
 			dataFilePath := filepath.Join("data", fi.Name())
@@ -268,7 +395,7 @@ func TestReadCustomBag(t *testing.T) {
 		}
 		// Payload sha256 manifest should have one entry
 		if len(payloadManifests[1].Data) != 1 {
-			t.Errorf("Payload manifest should have one entry, found %s", len(payloadManifests[1].Data))
+			t.Errorf("Payload manifest should have one entry, found %d", len(payloadManifests[1].Data))
 		}
 		for key, value := range payloadManifests[1].Data {
 			dataFilePath := filepath.Join("data", fi.Name())
@@ -333,7 +460,7 @@ func TestReadTagFileBag(t *testing.T) {
 		}
 		// Payload md5 manifest should have one entry
 		if len(payloadManifests[0].Data) != 1 {
-			t.Errorf("Payload manifest should have one entry, found %s", len(payloadManifests[0].Data))
+			t.Errorf("Payload manifest should have one entry, found %d", len(payloadManifests[0].Data))
 		}
 		for key, value := range payloadManifests[0].Data {
 			dataFilePath := filepath.Join("data", testFileName)
@@ -350,7 +477,7 @@ func TestReadTagFileBag(t *testing.T) {
 		}
 		// Payload sha256 manifest should have one entry
 		if len(payloadManifests[1].Data) != 1 {
-			t.Errorf("Payload manifest should have one entry, found %s", len(payloadManifests[1].Data))
+			t.Errorf("Payload manifest should have one entry, found %d", len(payloadManifests[1].Data))
 		}
 		for key, value := range payloadManifests[1].Data {
 			dataFilePath := filepath.Join("data", testFileName)
@@ -0,0 +1,247 @@
+package bagins
+
+/*
+
+"Go where you must go, and hope!"
+
+- Faramir
+
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Labels reserved for bag-info.txt by the BagIt spec, see
+// https://tools.ietf.org/html/rfc8493#section-2.2.2
+const (
+	SourceOrganization        = "Source-Organization"
+	OrganizationAddress       = "Organization-Address"
+	ContactName               = "Contact-Name"
+	ContactPhone              = "Contact-Phone"
+	ContactEmail              = "Contact-Email"
+	ExternalDescription       = "External-Description"
+	BaggingDate               = "Bagging-Date"
+	ExternalIdentifier        = "External-Identifier"
+	BagSize                   = "Bag-Size"
+	PayloadOxum               = "Payload-Oxum"
+	BagGroupIdentifier        = "Bag-Group-Identifier"
+	BagCount                  = "Bag-Count"
+	InternalSenderIdentifier  = "Internal-Sender-Identifier"
+	InternalSenderDescription = "Internal-Sender-Description"
+)
+
+// Layout of the Bagging-Date field, as YYYY-MM-DD.
+const BaggingDateLayout = "2006-01-02"
+
+/*
+BagInfo wraps the bag-info.txt tag file with getters and setters for the
+reserved labels. Getters for text fields return the first value with the
+label, or an empty string. Setters replace every value with the label.
+Repeated fields, such as several Contact-Name lines, can be read with
+Data.Values and added with Data.AddField.
+*/
+type BagInfo struct {
+	*TagFile
+}
+
+// Returns a BagInfo for reading and writing the reserved fields of tf.
+func NewBagInfo(tf *TagFile) *BagInfo {
+	return &BagInfo{tf}
+}
+
+func (bi *BagInfo) SourceOrganization() string {
+	return bi.Data.Value(SourceOrganization)
+}
+
+func (bi *BagInfo) SetSourceOrganization(value string) {
+	bi.Data.SetValue(SourceOrganization, value)
+}
+
+func (bi *BagInfo) OrganizationAddress() string {
+	return bi.Data.Value(OrganizationAddress)
+}
+
+func (bi *BagInfo) SetOrganizationAddress(value string) {
+	bi.Data.SetValue(OrganizationAddress, value)
+}
+
+func (bi *BagInfo) ContactName() string {
+	return bi.Data.Value(ContactName)
+}
+
+func (bi *BagInfo) SetContactName(value string) {
+	bi.Data.SetValue(ContactName, value)
+}
+
+func (bi *BagInfo) ContactPhone() string {
+	return bi.Data.Value(ContactPhone)
+}
+
+func (bi *BagInfo) SetContactPhone(value string) {
+	bi.Data.SetValue(ContactPhone, value)
+}
+
+func (bi *BagInfo) ContactEmail() string {
+	return bi.Data.Value(ContactEmail)
+}
+
+func (bi *BagInfo) SetContactEmail(value string) {
+	bi.Data.SetValue(ContactEmail, value)
+}
+
+func (bi *BagInfo) ExternalDescription() string {
+	return bi.Data.Value(ExternalDescription)
+}
+
+func (bi *BagInfo) SetExternalDescription(value string) {
+	bi.Data.SetValue(ExternalDescription, value)
+}
+
+func (bi *BagInfo) ExternalIdentifier() string {
+	return bi.Data.Value(ExternalIdentifier)
+}
+
+func (bi *BagInfo) SetExternalIdentifier(value string) {
+	bi.Data.SetValue(ExternalIdentifier, value)
+}
+
+func (bi *BagInfo) BagGroupIdentifier() string {
+	return bi.Data.Value(BagGroupIdentifier)
+}
+
+func (bi *BagInfo) SetBagGroupIdentifier(value string) {
+	bi.Data.SetValue(BagGroupIdentifier, value)
+}
+
+func (bi *BagInfo) InternalSenderIdentifier() string {
+	return bi.Data.Value(InternalSenderIdentifier)
+}
+
+func (bi *BagInfo) SetInternalSenderIdentifier(value string) {
+	bi.Data.SetValue(InternalSenderIdentifier, value)
+}
+
+func (bi *BagInfo) InternalSenderDescription() string {
+	return bi.Data.Value(InternalSenderDescription)
+}
+
+func (bi *BagInfo) SetInternalSenderDescription(value string) {
+	bi.Data.SetValue(InternalSenderDescription, value)
+}
+
+// Returns the Bag-Size field, such as "260 GB". It is meant for people
+// to read, see PayloadOxum for an exact size.
+func (bi *BagInfo) BagSize() string {
+	return bi.Data.Value(BagSize)
+}
+
+func (bi *BagInfo) SetBagSize(value string) {
+	bi.Data.SetValue(BagSize, value)
+}
+
+// Returns the Bagging-Date field. Returns a zero time and no error
+// if the field is not set.
+func (bi *BagInfo) BaggingDate() (time.Time, error) {
+	value := bi.Data.Value(BaggingDate)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(BaggingDateLayout, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s '%s': %w", BaggingDate, value, err)
+	}
+	return date, nil
+}
+
+// Sets the Bagging-Date field to the day of date, as YYYY-MM-DD.
+func (bi *BagInfo) SetBaggingDate(date time.Time) {
+	bi.Data.SetValue(BaggingDate, date.Format(BaggingDateLayout))
+}
+
+// Returns the number of octets and the number of files in the payload
+// from the Payload-Oxum field. Returns -1, -1 and no error if the
+// field is not set.
+func (bi *BagInfo) PayloadOxum() (octets int64, count int, err error) {
+	value := bi.Data.Value(PayloadOxum)
+	if value == "" {
+		return -1, -1, nil
+	}
+	return parsePayloadOxum(value)
+}
+
+// Sets the Payload-Oxum field, as octets.count.
+func (bi *BagInfo) SetPayloadOxum(octets int64, count int) {
+	bi.Data.SetValue(PayloadOxum, fmt.Sprintf("%d.%d", octets, count))
+}
+
+// Returns the number of this bag in its group and the number of bags
+// in the group from the Bag-Count field, such as "3 of 7". total is 0
+// if the field says the total is not known, as in "3 of ?". Returns
+// 0, 0 and no error if the field is not set.
+func (bi *BagInfo) BagCount() (n int, total int, err error) {
+	value := strings.TrimSpace(bi.Data.Value(BagCount))
+	if value == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Fields(value)
+	if len(parts) != 3 || parts[1] != "of" {
+		return 0, 0, fmt.Errorf("Invalid %s '%s'. Must be like '3 of 7'", BagCount, value)
+	}
+	if n, err = strconv.Atoi(parts[0]); err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("Invalid %s '%s'. Must be like '3 of 7'", BagCount, value)
+	}
+	if parts[2] == "?" {
+		return n, 0, nil
+	}
+	if total, err = strconv.Atoi(parts[2]); err != nil || total < n {
+		return 0, 0, fmt.Errorf("Invalid %s '%s'. Must be like '3 of 7'", BagCount, value)
+	}
+	return n, total, nil
+}
+
+// Sets the Bag-Count field to "n of total", or "n of ?" if total is
+// 0 or less.
+func (bi *BagInfo) SetBagCount(n int, total int) {
+	if total <= 0 {
+		bi.Data.SetValue(BagCount, fmt.Sprintf("%d of ?", n))
+		return
+	}
+	bi.Data.SetValue(BagCount, fmt.Sprintf("%d of %d", n, total))
+}
+
+// Parses a Payload-Oxum value of the form octets.count.
+func parsePayloadOxum(value string) (int64, int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ".")
+	if len(parts) != 2 {
+		return -1, -1, fmt.Errorf("Invalid %s '%s'. Must be octets.count", PayloadOxum, value)
+	}
+	octets, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || octets < 0 {
+		return -1, -1, fmt.Errorf("Invalid %s '%s'. Must be octets.count", PayloadOxum, value)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 0 {
+		return -1, -1, fmt.Errorf("Invalid %s '%s'. Must be octets.count", PayloadOxum, value)
+	}
+	return octets, count, nil
+}
+
+// Returns size in a form for people to read, such as "1.5 MB", using
+// units of 1024 bytes.
+func humanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	units := []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+	value := float64(size) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,125 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBagInfo(t *testing.T) {
+	tf, _ := bagins.NewTagFile("bag-info.txt")
+	info := bagins.NewBagInfo(tf)
+
+	info.SetSourceOrganization("APTrust")
+	info.SetExternalIdentifier("bag-123")
+	info.SetBagGroupIdentifier("group-9")
+	if info.SourceOrganization() != "APTrust" || info.ExternalIdentifier() != "bag-123" ||
+		info.BagGroupIdentifier() != "group-9" {
+		t.Errorf("Text fields were not set: %v", tf.Data.Fields())
+	}
+	if tf.Data.Value(bagins.SourceOrganization) != "APTrust" {
+		t.Errorf("BagInfo did not set the field in the tag file")
+	}
+
+	if date, err := info.BaggingDate(); err != nil || !date.IsZero() {
+		t.Errorf("Unset Bagging-Date should be zero, got %v, %v", date, err)
+	}
+	info.SetBaggingDate(time.Date(2016, 6, 1, 15, 4, 5, 0, time.UTC))
+	if tf.Data.Value(bagins.BaggingDate) != "2016-06-01" {
+		t.Errorf("Bagging-Date written as %s", tf.Data.Value(bagins.BaggingDate))
+	}
+	if date, err := info.BaggingDate(); err != nil || date.Day() != 1 || date.Month() != 6 {
+		t.Errorf("BaggingDate returned %v, %v", date, err)
+	}
+
+	info.SetPayloadOxum(279164409832, 1198)
+	if tf.Data.Value(bagins.PayloadOxum) != "279164409832.1198" {
+		t.Errorf("Payload-Oxum written as %s", tf.Data.Value(bagins.PayloadOxum))
+	}
+	if octets, count, err := info.PayloadOxum(); err != nil || octets != 279164409832 || count != 1198 {
+		t.Errorf("PayloadOxum returned %d, %d, %v", octets, count, err)
+	}
+	tf.Data.SetValue(bagins.PayloadOxum, "12345")
+	if _, _, err := info.PayloadOxum(); err == nil {
+		t.Errorf("PayloadOxum should reject a value without a file count")
+	}
+
+	info.SetBagCount(3, 0)
+	if tf.Data.Value(bagins.BagCount) != "3 of ?" {
+		t.Errorf("Bag-Count written as %s", tf.Data.Value(bagins.BagCount))
+	}
+	info.SetBagCount(3, 7)
+	if n, total, err := info.BagCount(); err != nil || n != 3 || total != 7 {
+		t.Errorf("BagCount returned %d, %d, %v", n, total, err)
+	}
+	for _, bad := range []string{"3", "3 of 2", "three of 7", "0 of 7"} {
+		tf.Data.SetValue(bagins.BagCount, bad)
+		if _, _, err := info.BagCount(); err == nil {
+			t.Errorf("BagCount should reject '%s'", bad)
+		}
+	}
+}
+
+func TestBagAutoBagInfo(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", strings.Repeat("x", 2048))
+
+	bag, err := bagins.NewBagFS(fsys, ".", "test-bag", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	if _, err := bag.Info(); err == nil {
+		t.Errorf("New bags should not have bag-info.txt until it is asked for")
+	}
+	if err := bag.SetAutoBagInfo(true); err != nil {
+		t.Fatalf("Unexpected error turning on bag-info.txt: %s", err)
+	}
+	info, err := bag.Info()
+	if err != nil {
+		t.Fatalf("SetAutoBagInfo did not add bag-info.txt: %s", err)
+	}
+	info.SetSourceOrganization("APTrust")
+	if errs := bag.AddDir("src"); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	data, _ := fs.ReadFile(fsys, "test-bag/bag-info.txt")
+	for _, expected := range []string{"Payload-Oxum:  2092.2", "Bag-Size:  2.0 KB",
+		"Bagging-Date:  " + time.Now().Format("2006-01-02"), "Source-Organization:  APTrust"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("bag-info.txt is missing '%s':\n%s", expected, data)
+		}
+	}
+
+	// Reading the bag back should keep the fields that were set,
+	// and update the payload fields on the next save.
+	rBag, err := bagins.ReadBagFS(fsys, "test-bag", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	writeMemFile(t, fsys, "test-bag/data/three.txt", "three")
+	rBag.AddFile("test-bag/data/three.txt", "three.txt")
+	if err := rBag.SetAutoBagInfo(true); err != nil {
+		t.Fatalf("Unexpected error turning on bag-info.txt: %s", err)
+	}
+	info, _ = rBag.Info()
+	info.SetBaggingDate(time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC))
+	if errs := rBag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	if info.SourceOrganization() != "APTrust" || info.Data.Value(bagins.BaggingDate) != "2016-06-01" {
+		t.Errorf("Save changed fields it should have kept: %v", info.Data.Fields())
+	}
+	if octets, count, _ := info.PayloadOxum(); octets != 2097 || count != 3 {
+		t.Errorf("Payload-Oxum not updated, got %d.%d", octets, count)
+	}
+	if report := rBag.Validate(); !report.IsValid() {
+		t.Errorf("Bag should be valid: %v", report.Errors())
+	}
+}
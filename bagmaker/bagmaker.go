@@ -8,9 +8,11 @@ package main
 //
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/APTrust/bagins"
+	"os"
 	"strings"
 	"time"
 )
@@ -21,14 +23,28 @@ var (
 	payload      string
 	algo         string
 	tagmanifests string
+	version      string
+	inplace      string
+	link         string
+	symlinks     string
+	preserve     string
+	mtimes       string
+	jsonOutput   string
 )
 
 func init() {
 	flag.StringVar(&dir, "dir", "", "Directory to create the bag.")
 	flag.StringVar(&name, "name", "", "Name for the bag root directory.")
 	flag.StringVar(&payload, "payload", "", "Directory of files to parse into the bag")
-	flag.StringVar(&algo, "algo", "md5", "Checksum algorithm to use.  md5, sha1, sha224, sha256, sha512, sha384")
+	flag.StringVar(&algo, "algo", "md5", "Checksum algorithm to use.  md5, sha1, sha224, sha256, sha512, sha384, sha3-256, sha3-512")
 	flag.StringVar(&tagmanifests, "tagmanifests", "", "Set to true to create tag manifests. Default is false.")
+	flag.StringVar(&version, "version", bagins.DefaultBagItVersion, "BagIt version of the bag. 0.97 or 1.0")
+	flag.StringVar(&inplace, "inplace", "", "Set to true to turn the payload directory itself into a bag.")
+	flag.StringVar(&link, "link", "", "Set to hardlink or reflink to link payload files instead of copying them.")
+	flag.StringVar(&symlinks, "symlinks", "", "What to do with symbolic links: follow, skip, error or preserve.")
+	flag.StringVar(&preserve, "preserve", "", "Set to true to keep the modes and times of payload files.")
+	flag.StringVar(&mtimes, "mtimes", "", "Name of a tag file to record the original modification times in.")
+	flag.StringVar(&jsonOutput, "json", "", "Set to true to print the result as JSON.")
 
 	flag.Parse()
 }
@@ -36,27 +52,70 @@ func init() {
 func usage() {
 
 	usage := `
-Usage: ./bagmaker -dir <value> -name <value> -payload <value> [-algo <value>]
+Usage: ./bagmaker -dir <value> -name <value> -payload <value> [-algo <value>] [-version <value>] [-link <value>] [-symlinks <value>]
+                  [-preserve <value>] [-mtimes <value>] [-json <value>]
+       ./bagmaker -inplace true -payload <value> [-algo <value>] [-version <value>] [-symlinks <value>] [-json <value>]
+
+bagmaker exits with status 1 if there are any errors.
 
 Flags:
 
     -algo <value>
      Checksum algorithm to use.  md5, sha1, sha224, sha256,
-     sha512, or sha384. Defaults to md5. Use commas (without
+     sha512, sha384, sha3-256 or sha3-512. Defaults to md5. Use commas (without
 	 spaces) to specify multiple algorithms. E.g. md5,sha256
 
     -dir <value>
      Directory to create the bag.
 
+    -inplace <value>
+     Set to true to turn the payload directory into a bag without
+     copying its files. They are moved into a data directory inside
+     it. -dir and -name are not used, and -link, -preserve and
+     -mtimes can't be used. Default is false.
+
+    -json <value>
+     Set to true to print the result as a single JSON object, for
+     programs that run bagmaker. It has the command (create or
+     inplace), bag_path, ok, the number of payload files added with
+     each ingest strategy, elapsed_seconds, and a list of errors,
+     each with a code and a message. Default is false.
+
+    -link <value>
+     Set to hardlink to hard link payload files into the bag, or
+     reflink to clone them on file systems that support it, such as
+     Btrfs and XFS. Files that can't be linked are copied. Default
+     is to copy every file.
+
+    -mtimes <value>
+     Name of a tag file, such as mtimes.txt, to record the original
+     modification time of each payload file in.
+
     -name <value>
      Name for the bag root directory.
 
     -payload <value>
      Directory of files to copy into the bag.
 
+    -preserve <value>
+     Set to true to give the copied payload files the permission bits,
+     access times and modification times of the originals. Default is
+     false.
+
+    -symlinks <value>
+     What to do with symbolic links in the payload directory. follow
+     adds the files they point to, skip leaves them out, error stops
+     with an error, and preserve adds links to files as links.
+     Followed and preserved links must point inside the payload
+     directory. Defaults to follow.
+
     -tagmanifests <value>
      Set to true to create tag manifests. Default is false.
 
+    -version <value>
+     Version of the BagIt spec the bag should follow. 0.97 or 1.0.
+     Defaults to 0.97.
+
      Example:
 
      Put all of /home/joe into a bag called joes_bag in the current working
@@ -65,22 +124,96 @@ Flags:
 
      bagmaker -payload /home/joe -name joes_bag -dir . -algo md5,sha256 -tagmanifests true
 
+     Turn /archive/joe into a bag, moving its files into /archive/joe/data.
+
+     bagmaker -payload /archive/joe -inplace true -algo sha256
+
 `
 	fmt.Println(usage)
 }
 
+// Result of a command, printed with -json true.
+type result struct {
+	Command        string         `json:"command"` // create or inplace
+	BagPath        string         `json:"bag_path"`
+	OK             bool           `json:"ok"`
+	Files          map[string]int `json:"files"` // Payload files added, keyed by ingest strategy
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	Errors         []resultError  `json:"errors"`
+}
+
+type resultError struct {
+	Code    string `json:"code"` // See bagins.ErrorCode, or usage
+	Message string `json:"message"`
+}
+
 func main() {
+	res := &result{Command: "create", Files: make(map[string]int), Errors: make([]resultError, 0)}
+	begin := time.Now()
+	if inplace == "true" {
+		res.Command = "inplace"
+		bagInPlace(res)
+	} else {
+		createBag(res)
+	}
+	res.OK = len(res.Errors) == 0
+	res.ElapsedSeconds = time.Since(begin).Seconds()
+	if jsonOutput == "true" {
+		out, _ := json.Marshal(res)
+		fmt.Println(string(out))
+	} else if res.OK {
+		fmt.Println("END: elapsed in", res.ElapsedSeconds, "seconds.")
+	}
+	if !res.OK {
+		os.Exit(1)
+	}
+}
 
-	if dir == "" {
+// Records a usage error, printing the usage unless the result is
+// printed as JSON.
+func (res *result) usage(message string) {
+	res.Errors = append(res.Errors, resultError{Code: "usage", Message: message})
+	if jsonOutput != "true" {
 		usage()
+	}
+}
+
+// Records err, printing it after label unless the result is printed
+// as JSON.
+func (res *result) fail(label string, err error) {
+	res.Errors = append(res.Errors, resultError{Code: bagins.ErrorCode(err), Message: err.Error()})
+	if jsonOutput != "true" {
+		fmt.Println(label, err)
+	}
+}
+
+// Counts the payload files of bag by the strategy used to add them.
+func (res *result) countFiles(bag *bagins.Bag) {
+	for _, strategy := range bag.IngestStrategies() {
+		res.Files[string(strategy)]++
+	}
+}
+
+func createBag(res *result) {
+	if dir == "" {
+		res.usage("-dir is required")
 		return
 	}
 	if name == "" {
-		usage()
+		res.usage("-name is required")
 		return
 	}
 	if payload == "" {
-		usage()
+		res.usage("-payload is required")
+		return
+	}
+
+	if link != "" && link != string(bagins.IngestHardLink) && link != string(bagins.IngestReflink) {
+		res.usage("-link must be hardlink or reflink")
+		return
+	}
+	if !validSymlinkPolicy(symlinks) {
+		res.usage("-symlinks must be follow, skip, error or preserve")
 		return
 	}
 
@@ -91,25 +224,90 @@ func main() {
 		createTagManifests = true
 	}
 
-	begin := time.Now()
-
-	bag, err := bagins.NewBag(dir, name, algoList, createTagManifests)
+	bag, err := bagins.NewBag(dir, name, algoList, createTagManifests, version)
 	if err != nil {
-		fmt.Println("Bag Error:", err)
+		res.fail("Bag Error:", err)
 		return
 	}
+	res.BagPath = bag.Path()
+
+	if link != "" {
+		bag.SetIngestStrategy(bagins.IngestStrategy(link))
+	}
+	if symlinks != "" {
+		if err := bag.SetSymlinkPolicy(bagins.SymlinkPolicy(symlinks)); err != nil {
+			res.fail("Symlinks Error:", err)
+			return
+		}
+	}
+	if preserve == "true" {
+		if err := bag.SetPreserveMetadata(true); err != nil {
+			res.fail("Preserve Error:", err)
+			return
+		}
+	}
+	if mtimes != "" {
+		if err := bag.SetModTimeFile(mtimes); err != nil {
+			res.fail("Mtimes Error:", err)
+			return
+		}
+	}
 
 	errs := bag.AddDir(payload)
 	for idx := range errs {
-		fmt.Println("AddDir Error:", errs[idx])
+		res.fail("AddDir Error:", errs[idx])
 		return
 	}
 
-	bag.Save()
+	res.countFiles(bag)
+	if link != "" && jsonOutput != "true" {
+		fmt.Printf("Linked %d files, copied %d files.\n",
+			res.Files[link], res.Files[string(bagins.IngestCopy)])
+	}
 
-	elapsed := time.Since(begin)
-	fmt.Println("END: elapsed in", elapsed.Seconds(), "seconds.")
-	return
+	for _, err := range bag.Save() {
+		res.fail("Save Error:", err)
+	}
+}
+
+func bagInPlace(res *result) {
+	if payload == "" {
+		res.usage("-payload is required")
+		return
+	}
+	if !validSymlinkPolicy(symlinks) {
+		res.usage("-symlinks must be follow, skip, error or preserve")
+		return
+	}
+	// Files are moved rather than copied, so there is nothing to
+	// link, and their metadata is kept anyway.
+	if link != "" || preserve != "" || mtimes != "" {
+		res.usage("-link, -preserve and -mtimes can't be used with -inplace")
+		return
+	}
+	opts := &bagins.BagInPlaceOptions{
+		Version:            version,
+		CreateTagManifests: tagmanifests == "true",
+		SymlinkPolicy:      bagins.SymlinkPolicy(symlinks),
+	}
+	bag, errs := bagins.BagInPlace(payload, parseAlgorithms(algo), opts)
+	res.BagPath = payload
+	if bag != nil {
+		res.BagPath = bag.Path()
+		res.countFiles(bag)
+	}
+	for idx := range errs {
+		res.fail("BagInPlace Error:", errs[idx])
+	}
+}
+
+// Returns true if policy is empty or one of the symlink policies.
+func validSymlinkPolicy(policy string) bool {
+	switch bagins.SymlinkPolicy(policy) {
+	case "", bagins.SymlinkFollow, bagins.SymlinkSkip, bagins.SymlinkError, bagins.SymlinkPreserve:
+		return true
+	}
+	return false
 }
 
 // Parses command line arguments to go into the
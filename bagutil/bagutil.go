@@ -17,12 +17,16 @@ import (
 	_ "crypto/md5"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
+	"crypto/sha3"
 	_ "crypto/sha512"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // Performs a checksum with the hsh.Hash.Sum() method passed to the function
@@ -46,26 +50,85 @@ func PathSeparator() string {
 	return string(byte(os.PathSeparator))
 }
 
+var (
+	hashesMu sync.RWMutex
+	hashes   = map[string]func() hash.Hash{
+		"md5":      crypto.MD5.New,
+		"sha1":     crypto.SHA1.New,
+		"sha224":   crypto.SHA224.New,
+		"sha256":   crypto.SHA256.New,
+		"sha384":   crypto.SHA384.New,
+		"sha512":   crypto.SHA512.New,
+		"sha3-256": func() hash.Hash { return sha3.New256() },
+		"sha3-512": func() hash.Hash { return sha3.New512() },
+	}
+)
+
+/*
+Makes the hash algorithm name available to LookupHash, and so to
+manifests named manifest-<name>.txt and tagmanifest-<name>.txt. Names
+are not case sensitive. Registering a name again replaces its hash.
+md5, sha1, sha224, sha256, sha384, sha512, sha3-256 and sha3-512 are
+registered to begin with. Others, such as BLAKE2b, can be registered
+from the packages that implement them.
+
+example:
+
+	bagutil.RegisterHash("sha512-256", sha512.New512_256)
+	bagutil.RegisterHash("blake2b-256", func() hash.Hash {
+		h, _ := blake2b.New256(nil) // golang.org/x/crypto/blake2b
+		return h
+	})
+*/
+func RegisterHash(name string, newHash func() hash.Hash) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+	hashes[strings.ToLower(name)] = newHash
+}
+
+// Returns the names of the registered hash algorithms, in sorted order.
+func RegisteredHashes() []string {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ErrUnsupportedAlgorithm matches every *UnsupportedAlgorithmError with
+// errors.Is.
+var ErrUnsupportedAlgorithm = errors.New("unsupported hash algorithm")
+
+// UnsupportedAlgorithmError is returned by LookupHash for a hash
+// algorithm that has not been registered.
+type UnsupportedAlgorithmError struct {
+	Algorithm string   // The name that was looked up
+	Supported []string // The registered names, in sorted order
+}
+
+func (e *UnsupportedAlgorithmError) Error() string {
+	return fmt.Sprintf("Invalid hash name %s: "+
+		"Must be one of %s. "+
+		"Do you have a manifest-%s.txt file somewhere in your bag?",
+		e.Algorithm, strings.Join(e.Supported, ", "), e.Algorithm)
+}
+
+func (e *UnsupportedAlgorithmError) Is(target error) bool {
+	return target == ErrUnsupportedAlgorithm
+}
+
 // Returns a new hash function based on a lookup of the algo string
-// passed to the function.  Returns an error if the algo string does not match
-// any of the available cryto hashes.
+// passed to the function.  Returns an *UnsupportedAlgorithmError if the
+// algo string does not match any of the registered hashes. See RegisterHash.
 func LookupHash(algo string) (func() hash.Hash, error) {
-	switch strings.ToLower(algo) {
-	case "md5":
-		return crypto.MD5.New, nil
-	case "sha1":
-		return crypto.SHA1.New, nil
-	case "sha256":
-		return crypto.SHA256.New, nil
-	case "sha512":
-		return crypto.SHA512.New, nil
-	case "sha224":
-		return crypto.SHA224.New, nil
-	case "sha384":
-		return crypto.SHA384.New, nil
+	hashesMu.RLock()
+	newHash, ok := hashes[strings.ToLower(algo)]
+	hashesMu.RUnlock()
+	if ok {
+		return newHash, nil
 	}
-	return nil, fmt.Errorf("Invalid hash name %s: " +
-		"Must be one of md5, sha1, sha256, sha512, sha224, sha284. " +
-		"Do you have a manifest-%s.txt file somewhere in your bag?",
-		algo, algo)
+	return nil, &UnsupportedAlgorithmError{Algorithm: algo, Supported: RegisteredHashes()}
 }
@@ -2,18 +2,22 @@
 package bagutil
 
 import (
+	"crypto/sha512"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
 var test_list map[string]string = map[string]string{
-	"md5":    "9e107d9d372bb6826bd81d3542a419d6",
-	"sha1":   "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
-	"sha256": "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
-	"sha512": "07e547d9586f6a73f73fbac0435ed76951218fb7d0c8d788a309d785436bbb642e93a252a954f23912547d1e8a3b5ed6e1bfd7097821233fa0538f3db854fee6",
-	"sha224": "730e109bd7a8a32b1cb9d9a09aa2325d2430587ddbc0c38bad911525",
-	"sha384": "ca737f1014a48f4c0b6dd43cb177b0afd9e5169367544c494011e3317dbf9a509cb1e5dc1e85a941bbee3d7f2afbc9b1",
+	"md5":      "9e107d9d372bb6826bd81d3542a419d6",
+	"sha1":     "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+	"sha256":   "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+	"sha512":   "07e547d9586f6a73f73fbac0435ed76951218fb7d0c8d788a309d785436bbb642e93a252a954f23912547d1e8a3b5ed6e1bfd7097821233fa0538f3db854fee6",
+	"sha224":   "730e109bd7a8a32b1cb9d9a09aa2325d2430587ddbc0c38bad911525",
+	"sha384":   "ca737f1014a48f4c0b6dd43cb177b0afd9e5169367544c494011e3317dbf9a509cb1e5dc1e85a941bbee3d7f2afbc9b1",
+	"sha3-256": "69070dda01975c8c120c3aada1b282394e7f032fa9cf32f4cb2259a0897dfc04",
+	"sha3-512": "01dedd5de4ef14642445ba5f5b97c15e47b9ad931326e4b0727cd94cefc44fff23f07bf543139939b49128caf436dc1bdee54fcb24023a08d9403f9b4bf0d450",
 }
 var test_string string = "The quick brown fox jumps over the lazy dog"
 
@@ -36,3 +40,26 @@ func TestFileChecksum(t *testing.T) {
 	}
 	os.Remove(testFile.Name())
 }
+
+func TestRegisterHash(t *testing.T) {
+	if _, err := LookupHash("sha512-256"); err == nil {
+		t.Fatal("Expected an error looking up an unregistered hash")
+	} else if !strings.Contains(err.Error(), "sha384, sha512") {
+		t.Errorf("Expected the error to list the registered hashes, got %s", err)
+	}
+	RegisterHash("SHA512-256", sha512.New512_256)
+	newHash, err := LookupHash("sha512-256")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up a registered hash: %s", err)
+	}
+	if newHash().Size() != 32 {
+		t.Errorf("Expected the registered hash, got one of size %d", newHash().Size())
+	}
+	found := false
+	for _, name := range RegisteredHashes() {
+		found = found || name == "sha512-256"
+	}
+	if !found {
+		t.Errorf("Expected sha512-256 in %v", RegisteredHashes())
+	}
+}
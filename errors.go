@@ -0,0 +1,103 @@
+package bagins
+
+/*
+
+"I wish it need not have happened in my time."
+
+- Frodo Baggins
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/APTrust/bagins/bagutil"
+	"io/fs"
+)
+
+/*
+Errors about the contents of a bag are returned as the types in this
+file, along with *ParseError for lines of manifests, fetch.txt and tag
+files that can't be parsed, and *UnsafePathError for paths that lead
+outside the bag. Use errors.As to get their details, or errors.Is with
+the sentinels below to test for a kind of error. ValidationProblems
+unwrap to the same types, so the errors from ValidationReport.Errors()
+can be tested the same way.
+*/
+var (
+	ErrChecksumMismatch     = errors.New("checksum mismatch")
+	ErrMissingFile          = errors.New("missing file")
+	ErrUnmanifestedFile     = errors.New("unmanifested file")
+	ErrUnsupportedAlgorithm = bagutil.ErrUnsupportedAlgorithm
+)
+
+// UnsupportedAlgorithmError is returned for a hash algorithm that has
+// not been registered with bagutil.RegisterHash.
+type UnsupportedAlgorithmError = bagutil.UnsupportedAlgorithmError
+
+// ChecksumMismatchError is returned for a file whose checksum does not
+// match its manifest entry.
+type ChecksumMismatchError struct {
+	Path      string // Path in the manifest
+	Manifest  string // Path of the manifest
+	Algorithm string
+	Expected  string // Checksum listed in the manifest
+	Actual    string // Checksum calculated from the file
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum for %s should be %s according to %s, but was %s",
+		e.Algorithm, e.Path, e.Expected, e.Manifest, e.Actual)
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// MissingFileError is returned for a file listed in a manifest that
+// does not exist. It unwraps to the error from opening the file, if
+// there was one.
+type MissingFileError struct {
+	Path     string // Path in the manifest
+	Manifest string // Path of the manifest
+	Err      error
+}
+
+func (e *MissingFileError) Error() string {
+	return fmt.Sprintf("File %s is listed in %s but does not exist", e.Path, e.Manifest)
+}
+
+func (e *MissingFileError) Is(target error) bool {
+	return target == ErrMissingFile
+}
+
+func (e *MissingFileError) Unwrap() error {
+	return e.Err
+}
+
+// UnmanifestedFileError is returned for a payload file that is not
+// listed in a payload manifest.
+type UnmanifestedFileError struct {
+	Path     string // Relative to the bag root
+	Manifest string // Path of the manifest, or empty if it is in none of them
+}
+
+func (e *UnmanifestedFileError) Error() string {
+	if e.Manifest == "" {
+		return fmt.Sprintf("File %s is not listed in any payload manifest", e.Path)
+	}
+	return fmt.Sprintf("File %s is not listed in %s", e.Path, e.Manifest)
+}
+
+func (e *UnmanifestedFileError) Is(target error) bool {
+	return target == ErrUnmanifestedFile
+}
+
+// Returns the error for reading the file at pathInBag, listed in
+// manifest, which is a *MissingFileError if it does not exist.
+func fileReadError(pathInBag string, manifest string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &MissingFileError{Path: pathInBag, Manifest: manifest, Err: err}
+	}
+	return err
+}
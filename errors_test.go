@@ -0,0 +1,156 @@
+package bagins_test
+
+import (
+	"errors"
+	"github.com/APTrust/bagins"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fails to create any file named manifest-md5.txt.
+type noManifestFS struct {
+	bagins.FileSystem
+}
+
+func (n noManifestFS) Create(name string) (io.WriteCloser, error) {
+	if filepath.Base(name) == "manifest-md5.txt" {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+	}
+	return n.FileSystem.Create(name)
+}
+
+func TestManifestTypedErrors(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "bag/data/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "bag/data/two.txt", "changed")
+	m, _ := bagins.NewManifestFS(fsys, "bag", "md5", bagins.PayloadManifest)
+	m.Data[filepath.Join("data", "one.txt")] = FIXVALUE
+	m.Data[filepath.Join("data", "two.txt")] = FIXVALUE
+	m.Data[filepath.Join("data", "three.txt")] = FIXVALUE
+
+	errs := m.RunChecksums()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	var missing *bagins.MissingFileError
+	if !errors.As(errs[0], &missing) || missing.Path != filepath.Join("data", "three.txt") ||
+		!errors.Is(errs[0], bagins.ErrMissingFile) || !errors.Is(errs[0], fs.ErrNotExist) {
+		t.Errorf("Expected a MissingFileError for three.txt, got %v", errs[0])
+	}
+	var mismatch *bagins.ChecksumMismatchError
+	if !errors.As(errs[1], &mismatch) || !errors.Is(errs[1], bagins.ErrChecksumMismatch) {
+		t.Fatalf("Expected a ChecksumMismatchError, got %v", errs[1])
+	}
+	if mismatch.Path != filepath.Join("data", "two.txt") || mismatch.Algorithm != "md5" ||
+		mismatch.Expected != FIXVALUE || mismatch.Actual == FIXVALUE || mismatch.Manifest != m.Name() {
+		t.Errorf("Wrong details in %#v", mismatch)
+	}
+
+	_, err := bagins.NewManifestFS(fsys, "bag", "sha404", bagins.PayloadManifest)
+	var unsupported *bagins.UnsupportedAlgorithmError
+	if !errors.As(err, &unsupported) || unsupported.Algorithm != "sha404" ||
+		!errors.Is(err, bagins.ErrUnsupportedAlgorithm) {
+		t.Errorf("Expected an UnsupportedAlgorithmError, got %v", err)
+	}
+}
+
+func TestValidationTypedErrors(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "typed-bag", []string{"md5"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddDir("src")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	writeMemFile(t, fsys, "typed-bag/data/one.txt", "changed")
+	fsys.Remove("typed-bag/data/two.txt")
+	writeMemFile(t, fsys, "typed-bag/data/three.txt", FIXSTRING)
+
+	targets := map[error]bool{
+		bagins.ErrChecksumMismatch: false,
+		bagins.ErrMissingFile:      false,
+		bagins.ErrUnmanifestedFile: false,
+	}
+	for _, err := range bag.Validate().Errors() {
+		for target := range targets {
+			if errors.Is(err, target) {
+				targets[target] = true
+			}
+		}
+	}
+	for target, found := range targets {
+		if !found {
+			t.Errorf("Expected a validation error matching %v", target)
+		}
+	}
+	for _, err := range bag.Validate().Errors() {
+		var unmanifested *bagins.UnmanifestedFileError
+		if errors.As(err, &unmanifested) && unmanifested.Path != filepath.Join("data", "three.txt") {
+			t.Errorf("Expected three.txt to be unmanifested, got %s", unmanifested.Path)
+		}
+	}
+}
+
+func TestReadBagParseErrors(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	bag, err := bagins.NewBagFS(fsys, ".", "fetch-bag", []string{"md5"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.Save()
+	writeMemFile(t, fsys, "fetch-bag/fetch.txt", "http://example.com/a.txt 10 data/a.txt\nnonsense\n")
+
+	_, err = bagins.ReadBagFS(fsys, "fetch-bag", []string{})
+	var parseErr *bagins.ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	if parseErr.File != filepath.Join("fetch-bag", "fetch.txt") || parseErr.Line != 2 ||
+		parseErr.Problem != bagins.MalformedLine {
+		t.Errorf("Wrong details in %#v", parseErr)
+	}
+}
+
+func TestNewBagSaveError(t *testing.T) {
+	fsys := noManifestFS{bagins.NewMemFileSystem()}
+	_, err := bagins.NewBagFS(fsys, ".", "unsaved-bag", []string{"md5"}, false, bagins.BagItVersion10)
+	if !errors.Is(err, fs.ErrPermission) || !strings.Contains(err.Error(), "manifest-md5.txt") {
+		t.Errorf("Expected the error saving the manifest, got %v", err)
+	}
+	if _, err := fsys.Stat("unsaved-bag"); err == nil {
+		t.Error("Expected the bag directory to be removed")
+	}
+}
+
+// Fails to open any file named manifest-md5.txt once fail is set.
+type unreadableManifestFS struct {
+	bagins.FileSystem
+	fail bool
+}
+
+func (u *unreadableManifestFS) Open(name string) (fs.File, error) {
+	if u.fail && filepath.Base(name) == "manifest-md5.txt" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return u.FileSystem.Open(name)
+}
+
+func TestTagManifestErrorsWrapped(t *testing.T) {
+	fsys := &unreadableManifestFS{FileSystem: bagins.NewMemFileSystem()}
+	bag, err := bagins.NewBagFS(fsys, ".", "tag-bag", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	fsys.fail = true
+	errs := bag.Save()
+	if len(errs) == 0 || !errors.Is(errs[0], fs.ErrPermission) {
+		t.Errorf("Expected an error matching fs.ErrPermission, got %v", errs)
+	}
+}
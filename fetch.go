@@ -0,0 +1,373 @@
+package bagins
+
+/*
+
+"Many that live deserve death. And some that die deserve life. Can you
+give it to them? Then do not be too eager to deal out death in judgement."
+
+- Gandalf the Grey
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Length of a fetch entry whose size is not known. It is written
+// to fetch.txt as "-".
+const FetchLengthUnknown int64 = -1
+
+// FetchEntry is a single line of fetch.txt, describing a payload file
+// that is not in the bag and the URL it can be retrieved from.
+// Path is relative to the bag root and always starts with "data/".
+type FetchEntry struct {
+	URL    string
+	Length int64 // Size in bytes, or FetchLengthUnknown
+	Path   string
+}
+
+/*
+FetchFile represents the fetch.txt file of a "holey" bag, which lists
+payload files that must be downloaded before the bag is complete.
+
+For more information see:
+
+	http://tools.ietf.org/html/draft-kunze-bagit-14#section-2.2.3
+	https://tools.ietf.org/html/rfc8493#section-2.2.3
+*/
+type FetchFile struct {
+	name         string // Path to fetch.txt
+	Entries      []FetchEntry
+	bagItVersion string     // BagIt version of the bag the fetch file belongs to
+	fsys         FileSystem // File system the fetch file is read from and written to
+}
+
+// Returns a pointer to a new, empty fetch file at the specified path, or
+// an error if the directory it should be written to does not exist.
+func NewFetchFile(name string) (*FetchFile, error) {
+	return newFetchFile(OSFileSystem{}, name)
+}
+
+// Returns a new, empty fetch file at the specified path in fsys.
+func newFetchFile(fsys FileSystem, name string) (*FetchFile, error) {
+	if _, err := fsys.Stat(filepath.Dir(name)); err != nil {
+		return nil, fmt.Errorf("Unable to create fetch file %s: %w", name, err)
+	}
+	f := new(FetchFile)
+	f.name = filepath.Clean(name)
+	f.Entries = make([]FetchEntry, 0)
+	f.fsys = fsys
+	return f, nil
+}
+
+/*
+Reads and parses a fetch.txt file. Error slice may comprise multiple
+parsing errors, one for each line that can't be parsed or that names a
+file outside the data directory.
+*/
+func ReadFetchFile(name string) (*FetchFile, []error) {
+	return readFetchFile(OSFileSystem{}, name, "")
+}
+
+// Reads a fetch file in fsys as ReadFetchFile does, decoding file
+// paths as required by the specified BagIt version.
+func readFetchFile(fsys FileSystem, name string, bagItVersion string) (*FetchFile, []error) {
+	var errs []error
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	defer file.Close()
+
+	f, err := newFetchFile(fsys, name)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	f.bagItVersion = bagItVersion
+	f.Entries, errs = parseFetchData(file, name, bagItVersion)
+	return f, errs
+}
+
+// Returns the path of the fetch file.
+func (f *FetchFile) Name() string {
+	return f.name
+}
+
+// Writes the fetch entries to the fetch file.
+func (f *FetchFile) Create() error {
+	return writeFile(defaultFileSystem(f.fsys), f.name, []byte(f.ToString()))
+}
+
+// Returns the contents of the fetch file in the form of a string.
+// This is an alternative to Create(), which writes to disk.
+func (f *FetchFile) ToString() string {
+	var buf bytes.Buffer
+	for _, entry := range f.Entries {
+		length := "-"
+		if entry.Length != FetchLengthUnknown {
+			length = strconv.FormatInt(entry.Length, 10)
+		}
+		fmt.Fprintf(&buf, "%s %s %s\n", entry.URL, length,
+			encodeManifestPath(entry.Path, f.bagItVersion))
+	}
+	return buf.String()
+}
+
+// Parses the lines of fetch.txt, which have the form "URL LENGTH FILENAME".
+// Lines that can't be parsed, or whose path is not in the payload, are
+// returned as a *ParseError naming name.
+func parseFetchData(file io.Reader, name string, bagItVersion string) ([]FetchEntry, []error) {
+	var errs []error
+	re := regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.+)$`)
+
+	entries := make([]FetchEntry, 0)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		data := re.FindStringSubmatch(line)
+		if data == nil {
+			errs = append(errs, &ParseError{File: name, Line: lineNumber, Problem: MalformedLine,
+				Detail: fmt.Sprintf("expected a URL, a length and a path, got %q", line)})
+			continue
+		}
+		length := FetchLengthUnknown
+		if data[2] != "-" {
+			parsed, err := strconv.ParseInt(data[2], 10, 64)
+			if err != nil || parsed < 0 {
+				errs = append(errs, &ParseError{File: name, Line: lineNumber, Problem: InvalidLength,
+					Detail: fmt.Sprintf("invalid length '%s'", data[2])})
+				continue
+			}
+			length = parsed
+		}
+		pathInBag := data[3]
+		if bagItVersion == BagItVersion10 {
+			pathInBag = decodeManifestPath(pathInBag)
+		}
+		if !isPayloadPath(pathInBag) {
+			errs = append(errs, &ParseError{File: name, Line: lineNumber, Problem: PathOutsidePayload,
+				Detail: fmt.Sprintf("path '%s' is not in the data directory", pathInBag)})
+			continue
+		}
+		entries = append(entries, FetchEntry{URL: data[1], Length: length, Path: pathInBag})
+	}
+	if scanner.Err() != nil {
+		errs = append(errs, scanner.Err())
+	}
+	return entries, errs
+}
+
+// Returns true if the slash-separated pathInBag is inside the payload
+// directory. RFC 8493 section 2.2.3 only allows fetch.txt to list
+// payload files.
+func isPayloadPath(pathInBag string) bool {
+	return strings.HasPrefix(path.Clean(pathInBag), "data/")
+}
+
+// FETCHERS
+
+// Fetcher retrieves the content at a URL listed in fetch.txt. The caller
+// closes the returned reader. Implementations should stop promptly when
+// ctx is cancelled.
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) (io.ReadCloser, error)
+}
+
+// FileFetcher retrieves file:// URLs from the local file system. It is
+// not part of DefaultFetcher, because a fetch.txt from a bag that is not
+// trusted could name any file the process can read. Only use it for
+// bags from trusted sources.
+type FileFetcher struct{}
+
+// Opens the local file named by a file:// URL.
+func (f FileFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("FileFetcher can't fetch %s URL %s", u.Scheme, rawURL)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.FromSlash(u.Path))
+}
+
+// HTTPFetcher retrieves http:// and https:// URLs with a GET request.
+// If Client is nil, http.DefaultClient is used.
+type HTTPFetcher struct {
+	Client *http.Client
+}
+
+// Requests the URL and returns the response body. Responses with a
+// status other than 200 are returned as errors.
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", rawURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// SchemeFetcher passes each URL to the Fetcher registered for its
+// scheme. Keys are lower-case schemes such as "http" or "file".
+type SchemeFetcher map[string]Fetcher
+
+// Fetches rawURL with the Fetcher registered for its scheme.
+func (sf SchemeFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, ok := sf[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("No fetcher for URL scheme '%s' in %s", u.Scheme, rawURL)
+	}
+	return fetcher.Fetch(ctx, rawURL)
+}
+
+// DefaultFetcher is used by Bag.ResolveFetch() when no other Fetcher
+// has been set with Bag.SetFetcher(). It handles http and https URLs.
+// To fetch file URLs as well, set a SchemeFetcher that includes a
+// FileFetcher. See FileFetcher.
+var DefaultFetcher Fetcher = SchemeFetcher{
+	"http":  &HTTPFetcher{},
+	"https": &HTTPFetcher{},
+}
+
+/*
+ResolveFetch downloads every file listed in fetch.txt that is not already
+in the bag and writes it into the payload directory. Each file is
+checked against the length in fetch.txt and the checksums in every
+payload manifest while it is downloaded, and only moved into place if
+it matches. Files that fail verification are discarded.
+
+Files are retrieved with the Fetcher set by Bag.SetFetcher(), or with
+DefaultFetcher. Returns one error for each file that could not be
+fetched. A file that does not match a manifest is reported as a
+*ChecksumMismatchError, and one missing from a manifest as an
+*UnmanifestedFileError. Cancelling ctx stops the remaining downloads.
+*/
+func (b *Bag) ResolveFetch(ctx context.Context) []error {
+	var errs []error
+	if b.fetchFile == nil {
+		return errs
+	}
+	fetcher := b.fetcher
+	if fetcher == nil {
+		fetcher = DefaultFetcher
+	}
+	payloadManifests := b.GetManifests(PayloadManifest)
+	for _, entry := range b.fetchFile.Entries {
+		if err := ctx.Err(); err != nil {
+			return append(errs, err)
+		}
+		absPath, err := b.safeJoin(filepath.FromSlash(entry.Path), "fetch.txt")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := b.fsys.Stat(absPath); err == nil {
+			continue
+		}
+		if err := b.fetchEntry(ctx, fetcher, entry, payloadManifests); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Downloads a single fetch entry into a temp file next to its final
+// location, verifies it, and renames it into place.
+func (b *Bag) fetchEntry(ctx context.Context, fetcher Fetcher, entry FetchEntry, manifests []*Manifest) error {
+	absPath := filepath.Join(b.Path(), filepath.FromSlash(entry.Path))
+	manifestKey := filepath.FromSlash(entry.Path)
+
+	src, err := fetcher.Fetch(ctx, entry.URL)
+	if err != nil {
+		return fmt.Errorf("Error fetching %s from %s: %w", entry.Path, entry.URL, err)
+	}
+	defer src.Close()
+
+	if err := b.fsys.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	tmpName, err := tempFileName(b.fsys, filepath.Dir(absPath), ".fetch-")
+	if err != nil {
+		return err
+	}
+	tmp, err := b.fsys.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer b.fsys.Remove(tmpName)
+
+	writers := []io.Writer{tmp}
+	hashes := make([]hash.Hash, len(manifests))
+	for i, m := range manifests {
+		hashes[i] = m.hashFunc()
+		writers = append(writers, hashes[i])
+	}
+	// Read no more than one byte past the length in fetch.txt, which is
+	// enough to tell that the file is too long.
+	var reader io.Reader = src
+	if entry.Length != FetchLengthUnknown {
+		reader = io.LimitReader(src, entry.Length+1)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error fetching %s from %s: %w", entry.Path, entry.URL, err)
+	}
+
+	if entry.Length != FetchLengthUnknown && size > entry.Length {
+		return fmt.Errorf("Fetched more than %d bytes for %s from %s, the length in fetch.txt",
+			entry.Length, entry.Path, entry.URL)
+	}
+	if entry.Length != FetchLengthUnknown && size != entry.Length {
+		return fmt.Errorf("Fetched %d bytes for %s from %s, but fetch.txt says %d",
+			size, entry.Path, entry.URL, entry.Length)
+	}
+	for i, m := range manifests {
+		expected, ok := m.Data[manifestKey]
+		if !ok {
+			return &UnmanifestedFileError{Path: manifestKey, Manifest: b.manifestPath(m)}
+		}
+		actual := fmt.Sprintf("%x", hashes[i].Sum(nil))
+		if !strings.EqualFold(actual, expected) {
+			return &ChecksumMismatchError{Path: manifestKey, Manifest: b.manifestPath(m),
+				Algorithm: m.Algorithm(), Expected: expected, Actual: actual}
+		}
+	}
+	return b.fsys.Rename(tmpName, absPath)
+}
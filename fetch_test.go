@@ -0,0 +1,211 @@
+package bagins_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/APTrust/bagins"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha256 of FIXSTRING
+const FIXSHA256 = "ef537f25c895bfa782526529a9b63d97aa631564d5d789c2b765448c8635fb6c"
+
+func TestReadFetchFile(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), "_GOTEST_READFETCHFILE_fetch.txt")
+	content := "http://example.com/one.txt 44 data/one.txt\r\n" +
+		"file:///tmp/two.txt - data/dir/file with spaces.txt\r\n" +
+		"this line is broken\n" +
+		"http://example.com/three.txt lots data/three.txt\n" +
+		"http://example.com/bag-info.txt - data/../bag-info.txt\n"
+	ioutil.WriteFile(testPath, []byte(content), 0644)
+	defer os.Remove(testPath)
+
+	f, errs := bagins.ReadFetchFile(testPath)
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 parse errors, got %d: %v", len(errs), errs)
+	}
+	var parseErr *bagins.ParseError
+	if len(errs) == 3 && (!errors.As(errs[2], &parseErr) || parseErr.Problem != bagins.PathOutsidePayload) {
+		t.Errorf("Expected a %s ParseError for bag-info.txt, got %v", bagins.PathOutsidePayload, errs[2])
+	}
+	if len(f.Entries) != 2 {
+		t.Fatalf("Expected 2 fetch entries, got %d", len(f.Entries))
+	}
+	if f.Entries[0].URL != "http://example.com/one.txt" || f.Entries[0].Length != 44 ||
+		f.Entries[0].Path != "data/one.txt" {
+		t.Errorf("First fetch entry parsed incorrectly: %v", f.Entries[0])
+	}
+	if f.Entries[1].Length != bagins.FetchLengthUnknown ||
+		f.Entries[1].Path != "data/dir/file with spaces.txt" {
+		t.Errorf("Second fetch entry parsed incorrectly: %v", f.Entries[1])
+	}
+
+	// It should write the entries back out in the same format.
+	f.Entries = f.Entries[:1]
+	if str := f.ToString(); str != "http://example.com/one.txt 44 data/one.txt\n" {
+		t.Errorf("ToString() returned %q", str)
+	}
+}
+
+func TestAddFetchEntry(t *testing.T) {
+	bagName := "__GO_TEST_ADD_FETCH_ENTRY__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := setupCustomBag(bagName)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up custom bag: %s", err)
+	}
+
+	// It should require a checksum for every payload manifest.
+	err = bag.AddFetchEntry("http://example.com/one.txt", 44, "one.txt",
+		map[string]string{"md5": FIXVALUE})
+	if err == nil {
+		t.Errorf("AddFetchEntry should require a sha256 checksum")
+	}
+
+	// It should reject paths outside the data directory.
+	err = bag.AddFetchEntry("http://example.com/x", 44, "../../x",
+		map[string]string{"md5": FIXVALUE, "sha256": FIXSHA256})
+	if err == nil {
+		t.Errorf("AddFetchEntry should reject a path outside the data directory")
+	}
+
+	err = bag.AddFetchEntry("http://example.com/one.txt", 44, "one.txt",
+		map[string]string{"md5": FIXVALUE, "sha256": FIXSHA256})
+	if err != nil {
+		t.Fatalf("Unexpected error adding fetch entry: %s", err)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected error saving bag: %v", errs)
+	}
+
+	// It should write fetch.txt and record it in the tag manifests.
+	content, err := ioutil.ReadFile(filepath.Join(bagPath, "fetch.txt"))
+	if err != nil {
+		t.Fatalf("fetch.txt was not written: %s", err)
+	}
+	if string(content) != "http://example.com/one.txt 44 data/one.txt\n" {
+		t.Errorf("Unexpected fetch.txt content %q", content)
+	}
+	for _, m := range bag.GetManifests(bagins.TagManifest) {
+		if _, ok := m.Data["fetch.txt"]; !ok {
+			t.Errorf("fetch.txt is missing from tagmanifest-%s.txt", m.Algorithm())
+		}
+	}
+
+	// ReadBag should parse it, and it should not be an unparsed tag file.
+	rBag, err := bagins.ReadBag(bagPath, []string{"bag-info.txt", "aptrust-info.txt"})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	entries := rBag.FetchEntries()
+	if len(entries) != 1 || entries[0].Path != "data/one.txt" {
+		t.Errorf("ReadBag did not parse fetch.txt: %v", entries)
+	}
+	unparsed, _ := rBag.UnparsedTagFiles()
+	if sliceContains(unparsed, "fetch.txt") {
+		t.Errorf("fetch.txt should not be an unparsed tag file")
+	}
+
+	// The bag is not complete until the file is fetched.
+	report := rBag.Validate()
+	if len(report.ProblemsOfType(bagins.UnfetchedFile)) != 2 {
+		t.Errorf("Expected 2 unfetched file problems, got %v", report.Errors())
+	}
+	if len(report.ProblemsOfType(bagins.MissingFile)) != 0 {
+		t.Errorf("Unfetched files should not be reported as missing")
+	}
+}
+
+func TestResolveFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/good.txt" {
+			fmt.Fprint(w, FIXSTRING)
+		} else if r.URL.Path == "/endless.txt" {
+			for i := 0; i < 1024; i++ {
+				if _, err := fmt.Fprint(w, FIXSTRING); err != nil {
+					return
+				}
+			}
+		} else if r.URL.Path == "/corrupt.txt" {
+			fmt.Fprint(w, strings.ToUpper(FIXSTRING))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	srcFile, _ := ioutil.TempFile("", "TEST_GO_RESOLVE_FETCH_")
+	srcFile.WriteString(FIXSTRING)
+	srcFile.Close()
+	defer os.Remove(srcFile.Name())
+
+	bagName := "__GO_TEST_RESOLVE_FETCH__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5", "sha256"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	checksums := map[string]string{"md5": FIXVALUE, "sha256": FIXSHA256}
+	bag.AddFetchEntry(server.URL+"/good.txt", int64(len(FIXSTRING)), "http/good.txt", checksums)
+	bag.AddFetchEntry("file://"+filepath.ToSlash(srcFile.Name()), bagins.FetchLengthUnknown, "local.txt", checksums)
+	bag.AddFetchEntry(server.URL+"/corrupt.txt", bagins.FetchLengthUnknown, "corrupt.txt", checksums)
+	bag.AddFetchEntry(server.URL+"/missing.txt", bagins.FetchLengthUnknown, "missing.txt", checksums)
+	bag.AddFetchEntry(server.URL+"/endless.txt", int64(len(FIXSTRING)), "endless.txt", checksums)
+	bag.Save()
+
+	// file URLs are only fetched when a caller opts in.
+	if _, err := bagins.DefaultFetcher.Fetch(context.Background(), "file://"+filepath.ToSlash(srcFile.Name())); err == nil {
+		t.Errorf("DefaultFetcher should not fetch file URLs")
+	}
+	bag.SetFetcher(bagins.SchemeFetcher{"file": bagins.FileFetcher{}, "http": &bagins.HTTPFetcher{}})
+
+	// It should fetch the two good files and fail on the other three.
+	errs := bag.ResolveFetch(context.Background())
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 errors resolving fetch.txt, got %d: %v", len(errs), errs)
+	}
+	mismatches := 0
+	for _, err := range errs {
+		if errors.Is(err, bagins.ErrChecksumMismatch) {
+			mismatches++
+		}
+	}
+	if mismatches != 1 {
+		t.Errorf("Expected a ChecksumMismatchError for corrupt.txt, got %v", errs)
+	}
+	for _, name := range []string{"http/good.txt", "local.txt"} {
+		content, err := ioutil.ReadFile(filepath.Join(bagPath, "data", name))
+		if err != nil || string(content) != FIXSTRING {
+			t.Errorf("File %s was not fetched correctly: %v", name, err)
+		}
+	}
+	// It should discard files that don't match the manifests.
+	for _, name := range []string{"corrupt.txt", "endless.txt"} {
+		if _, err := os.Stat(filepath.Join(bagPath, "data", name)); !os.IsNotExist(err) {
+			t.Errorf("Fetched file %s should have been discarded", name)
+		}
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(bagPath, "data"))
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".fetch-") {
+			t.Errorf("Temp file %s was left in the payload directory", fi.Name())
+		}
+	}
+
+	// It should stop when the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs = bag.ResolveFetch(ctx)
+	if len(errs) != 1 || errs[0] != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", errs)
+	}
+}
@@ -0,0 +1,719 @@
+package bagins
+
+/*
+
+"I feel thin, sort of stretched, if you know what I mean: like butter
+that has been scraped over too much bread."
+
+- Bilbo Baggins
+
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+WriteFS is the write side of a FileSystem. Its methods behave like the
+functions of the same name in the os package.
+*/
+type WriteFS interface {
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldName, newName string) error
+}
+
+/*
+LinkFS is implemented by file systems that can give a file a second
+name without copying it, as os.Link does. Payloads use it to add files
+with IngestHardLink.
+*/
+type LinkFS interface {
+	Link(oldName, newName string) error
+}
+
+/*
+ReflinkFS is implemented by file systems that can make a copy of a file
+that shares its storage until either copy is changed, such as Btrfs and
+XFS on Linux. Reflink must fail without creating newName if it can't
+make such a copy. Payloads use it to add files with IngestReflink.
+*/
+type ReflinkFS interface {
+	Reflink(oldName, newName string) error
+}
+
+/*
+MetadataFS is implemented by file systems that can set the permission
+bits and times of a file, as os.Chmod and os.Chtimes do. Payloads use
+it to keep the metadata of the files they copy, see
+Payload.SetPreserveMetadata.
+*/
+type MetadataFS interface {
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+/*
+FileSystem is the storage that a Bag and its Payload, Manifests and
+TagFiles are read from and written to. The read side is an io/fs.FS
+with Stat, so a FileSystem works with fs.WalkDir, fs.ReadFile and the
+other helpers in io/fs.
+
+Everything a bag reads and writes goes through its FileSystem,
+including the source files passed to AddFile, AddDir and
+AddCustomTagfile. Bags created with NewBag and read with ReadBag use
+OSFileSystem. Use NewBagFS and ReadBagFS for other file systems.
+*/
+type FileSystem interface {
+	fs.StatFS
+	WriteFS
+}
+
+// Returns fsys, or OSFileSystem if fsys is nil.
+func defaultFileSystem(fsys FileSystem) FileSystem {
+	if fsys == nil {
+		return OSFileSystem{}
+	}
+	return fsys
+}
+
+// Writes data to the named file in fsys, creating its directory if needed.
+func writeFile(fsys FileSystem, name string, data []byte) error {
+	if err := fsys.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Removes the named file or directory from fsys, along with everything
+// in it, deepest entries first. A symbolic link is removed, not what it
+// points to.
+func removeAll(fsys FileSystem, name string) error {
+	if isSymlink(fsys, name) {
+		return fsys.Remove(name)
+	}
+	var names []string
+	err := fs.WalkDir(fsys, name, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, pth)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := fsys.Remove(names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the hex digest of the named file in fsys, as
+// bagutil.FileChecksum does for files on disk.
+func fileChecksum(fsys FileSystem, name string, hsh hash.Hash) (string, error) {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	if _, err := io.Copy(hsh, src); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hsh.Sum(nil)), nil
+}
+
+// Returns a name for a temporary file in dir that does not exist yet.
+func tempFileName(fsys FileSystem, dir string, prefix string) (string, error) {
+	suffix := make([]byte, 8)
+	for i := 0; i < 10; i++ {
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%s%x", prefix, suffix))
+		if _, err := fsys.Stat(name); os.IsNotExist(err) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to create a temp file name in %s", dir)
+}
+
+// OS FILE SYSTEM
+
+/*
+OSFileSystem reads and writes files on disk through the os package.
+
+Unlike os.DirFS, names are passed to the os package unchanged, so they
+are OS paths that may be absolute or relative to the working directory,
+just as the paths given to NewBag and ReadBag.
+*/
+type OSFileSystem struct{}
+
+// Opens the named file for reading.
+func (OSFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// Returns a FileInfo describing the named file.
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Reads the named directory and returns its entries sorted by name.
+func (OSFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// Creates or truncates the named file.
+func (OSFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// Creates the named directory.
+func (OSFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+// Creates the named directory along with any parents that don't exist.
+func (OSFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+// Removes the named file or empty directory.
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Renames oldName to newName, replacing newName if it is a file.
+func (OSFileSystem) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+// Creates newName as a hard link to oldName.
+func (OSFileSystem) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+// Changes the permission bits of the named file.
+func (OSFileSystem) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Changes the access and modification times of the named file.
+func (OSFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Creates newName as a symbolic link to oldName.
+func (OSFileSystem) Symlink(oldName, newName string) error {
+	return os.Symlink(oldName, newName)
+}
+
+// Returns the destination of the named symbolic link.
+func (OSFileSystem) ReadLink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Returns a FileInfo describing the named file, or the symbolic link
+// if it is one.
+func (OSFileSystem) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Creates newName as a copy-on-write clone of oldName. It only works
+// on Linux, on file systems that support the FICLONE ioctl.
+func (OSFileSystem) Reflink(oldName, newName string) error {
+	return reflink(oldName, newName)
+}
+
+// READ-ONLY FILE SYSTEM
+
+// Returned by the write methods of a read-only FileSystem.
+var ErrReadOnly = errors.New("file system is read-only")
+
+type readOnlyFileSystem struct {
+	fsys fs.FS
+}
+
+/*
+Returns a FileSystem that reads from fsys and returns ErrReadOnly for
+every write. Use it to read and validate bags in any io/fs.FS, such as
+an fs.Sub of os.DirFS, an embed.FS or a zip.Reader, with ReadBagFS.
+Names must follow the io/fs rules, see fs.ValidPath.
+*/
+func NewReadOnlyFileSystem(fsys fs.FS) FileSystem {
+	return &readOnlyFileSystem{fsys: fsys}
+}
+
+func (r *readOnlyFileSystem) Open(name string) (fs.File, error) {
+	return r.fsys.Open(name)
+}
+
+func (r *readOnlyFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+func (r *readOnlyFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(r.fsys, name)
+}
+
+func (r *readOnlyFileSystem) ReadLink(name string) (string, error) {
+	return readLink(r.fsys, name)
+}
+
+func (r *readOnlyFileSystem) Lstat(name string) (fs.FileInfo, error) {
+	return lstat(r.fsys, name)
+}
+
+func (r *readOnlyFileSystem) Create(name string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: ErrReadOnly}
+}
+
+func (r *readOnlyFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+}
+
+func (r *readOnlyFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+}
+
+func (r *readOnlyFileSystem) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (r *readOnlyFileSystem) Rename(oldName, newName string) error {
+	return &fs.PathError{Op: "rename", Path: oldName, Err: ErrReadOnly}
+}
+
+// IN-MEMORY FILE SYSTEM
+
+/*
+MemFileSystem keeps files and directories in memory. It is safe for
+concurrent use.
+
+Names follow the io/fs rules, see fs.ValidPath: they are clean,
+slash-separated paths relative to the root of the file system. Paths
+built with filepath.Join are converted to slashes first, so they work
+on any OS.
+*/
+type MemFileSystem struct {
+	mutex    sync.RWMutex
+	entries  map[string]*memEntry       // Key is clean path, "." is the root
+	children map[string]map[string]bool // Keys of the entries in each directory, by the directory's key
+}
+
+// A file or directory in a MemFileSystem.
+type memEntry struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// Returns a new, empty in-memory file system.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		entries: map[string]*memEntry{
+			".": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+		},
+		children: make(map[string]map[string]bool),
+	}
+}
+
+// Adds or replaces the entry with the clean name, and lists it in its
+// directory. The caller holds the lock.
+func (m *MemFileSystem) putEntry(name string, entry *memEntry) {
+	m.entries[name] = entry
+	dir := path.Dir(name)
+	if m.children[dir] == nil {
+		m.children[dir] = make(map[string]bool)
+	}
+	m.children[dir][name] = true
+}
+
+// Removes the entry with the clean name from the entries and from its
+// directory. The caller holds the lock.
+func (m *MemFileSystem) deleteEntry(name string) {
+	delete(m.entries, name)
+	dir := path.Dir(name)
+	delete(m.children[dir], name)
+	if len(m.children[dir]) == 0 {
+		delete(m.children, dir)
+	}
+}
+
+// Appends the keys of everything inside the directory dir, at any
+// depth, to names. The caller holds the lock.
+func (m *MemFileSystem) descendants(dir string, names []string) []string {
+	for name := range m.children[dir] {
+		names = append(names, name)
+		names = m.descendants(name, names)
+	}
+	return names
+}
+
+// Converts name to the key used in the entries map.
+func (m *MemFileSystem) clean(op string, name string) (string, error) {
+	cleaned := filepath.ToSlash(name)
+	if !fs.ValidPath(cleaned) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return cleaned, nil
+}
+
+// Returns an error unless the parent of the clean name is a directory.
+func (m *MemFileSystem) checkParent(op string, name string, cleaned string) error {
+	parent, ok := m.entries[path.Dir(cleaned)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Opens the named file or directory for reading. The file's contents
+// are not affected by writes made after it is opened.
+func (m *MemFileSystem) Open(name string) (fs.File, error) {
+	cleaned, err := m.clean("open", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	info := entry.info(cleaned)
+	if entry.mode.IsDir() {
+		return &memDir{info: info, entries: m.readDir(cleaned)}, nil
+	}
+	return &memFile{info: info, Reader: bytes.NewReader(entry.data)}, nil
+}
+
+// Returns a FileInfo describing the named file.
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	cleaned, err := m.clean("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return entry.info(cleaned), nil
+}
+
+// Reads the named directory and returns its entries sorted by name.
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	cleaned, err := m.clean("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return m.readDir(cleaned), nil
+}
+
+// Returns the sorted entries of a directory. The caller holds the lock.
+func (m *MemFileSystem) readDir(dir string) []fs.DirEntry {
+	dirEntries := make([]fs.DirEntry, 0, len(m.children[dir]))
+	for name := range m.children[dir] {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(m.entries[name].info(name)))
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries
+}
+
+// Returns the contents of the named file.
+func (m *MemFileSystem) ReadFile(name string) ([]byte, error) {
+	cleaned, err := m.clean("read", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]byte(nil), entry.data...), nil
+}
+
+// Creates or truncates the named file. Its parent directory must exist.
+// Data is visible to readers as soon as it is written.
+func (m *MemFileSystem) Create(name string) (io.WriteCloser, error) {
+	cleaned, err := m.clean("create", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.checkParent("create", name, cleaned); err != nil {
+		return nil, err
+	}
+	if entry, ok := m.entries[cleaned]; ok && entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	entry := &memEntry{mode: 0644, modTime: time.Now()}
+	m.putEntry(cleaned, entry)
+	return &memWriter{fs: m, entry: entry}, nil
+}
+
+// Creates the named directory. Its parent directory must exist.
+func (m *MemFileSystem) Mkdir(name string, perm fs.FileMode) error {
+	cleaned, err := m.clean("mkdir", name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.entries[cleaned]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.checkParent("mkdir", name, cleaned); err != nil {
+		return err
+	}
+	m.putEntry(cleaned, &memEntry{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()})
+	return nil
+}
+
+// Creates the named directory along with any parents that don't exist.
+func (m *MemFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	cleaned, err := m.clean("mkdir", name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dirs := make([]string, 0)
+	for dir := cleaned; dir != "."; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entry, ok := m.entries[dirs[i]]
+		if !ok {
+			m.putEntry(dirs[i], &memEntry{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()})
+		} else if !entry.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+	}
+	return nil
+}
+
+// Removes the named file or empty directory.
+func (m *MemFileSystem) Remove(name string) error {
+	cleaned, err := m.clean("remove", name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if cleaned == "." || (entry.mode.IsDir() && len(m.children[cleaned]) > 0) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	m.deleteEntry(cleaned)
+	return nil
+}
+
+// Changes the permission bits of the named file or directory.
+func (m *MemFileSystem) Chmod(name string, mode fs.FileMode) error {
+	cleaned, err := m.clean("chmod", name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	entry.mode = entry.mode.Type() | mode.Perm()
+	return nil
+}
+
+// Changes the modification time of the named file or directory.
+// Access times are not kept, so atime is ignored.
+func (m *MemFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	cleaned, err := m.clean("chtimes", name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.entries[cleaned]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	entry.modTime = mtime
+	return nil
+}
+
+// Renames oldName to newName. A file replaces any file at newName.
+// A directory is moved along with everything in it, and newName
+// must not exist.
+func (m *MemFileSystem) Rename(oldName, newName string) error {
+	oldClean, err := m.clean("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newClean, err := m.clean("rename", newName)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.entries[oldClean]
+	if !ok || oldClean == "." {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if err := m.checkParent("rename", newName, newClean); err != nil {
+		return err
+	}
+	if oldClean == newClean {
+		return nil
+	}
+	if existing, ok := m.entries[newClean]; ok && (entry.mode.IsDir() || existing.mode.IsDir()) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	if entry.mode.IsDir() && strings.HasPrefix(newClean, oldClean+"/") {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+	}
+	children := m.descendants(oldClean, nil)
+	m.deleteEntry(oldClean)
+	m.putEntry(newClean, entry)
+	for _, name := range children {
+		child := m.entries[name]
+		m.deleteEntry(name)
+		m.putEntry(newClean+name[len(oldClean):], child)
+	}
+	return nil
+}
+
+// Returns a FileInfo for the entry with the clean name.
+func (e *memEntry) info(name string) *memFileInfo {
+	return &memFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(e.data)),
+		mode:    e.mode,
+		modTime: e.modTime,
+	}
+}
+
+// Implements fs.FileInfo for MemFileSystem.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// A file opened for reading from a MemFileSystem.
+type memFile struct {
+	*bytes.Reader
+	info *memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// A directory opened from a MemFileSystem.
+type memDir struct {
+	info    *memFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// Returns the next n entries in the directory, or all remaining
+// entries if n <= 0, as described for fs.ReadDirFile.
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// A file opened for writing in a MemFileSystem.
+type memWriter struct {
+	fs    *MemFileSystem
+	entry *memEntry
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.fs.mutex.Lock()
+	defer w.fs.mutex.Unlock()
+	w.entry.data = append(w.entry.data, p...)
+	w.entry.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,164 @@
+package bagins_test
+
+import (
+	"errors"
+	"github.com/APTrust/bagins"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Writes content to name in fsys, creating its directory.
+func writeMemFile(t *testing.T, fsys bagins.FileSystem, name string, content string) {
+	if err := fsys.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("Unable to create directory for %s: %s", name, err)
+	}
+	w, err := fsys.Create(name)
+	if err != nil {
+		t.Fatalf("Unable to create %s: %s", name, err)
+	}
+	io.WriteString(w, content)
+	w.Close()
+}
+
+func TestMemFileSystem(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "dir/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "dir/sub/two.txt", "two")
+	writeMemFile(t, fsys, "three.txt", "three")
+
+	// The read side should behave as io/fs requires.
+	if err := fstest.TestFS(fsys, "dir/one.txt", "dir/sub/two.txt", "three.txt"); err != nil {
+		t.Errorf("MemFileSystem does not behave as an fs.FS: %s", err)
+	}
+
+	data, err := fs.ReadFile(fsys, filepath.Join("dir", "one.txt"))
+	if err != nil || string(data) != FIXSTRING {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+	if _, err := fsys.Create("missing/file.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Create should fail when the directory does not exist, got %v", err)
+	}
+	if err := fsys.Mkdir("dir", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir should fail when the directory exists, got %v", err)
+	}
+	if _, err := fsys.Open("../outside.txt"); err == nil {
+		t.Errorf("Open should reject paths outside the file system")
+	}
+
+	// Renaming a directory should move everything in it.
+	if err := fsys.Rename("dir", "moved"); err != nil {
+		t.Fatalf("Unexpected error renaming directory: %s", err)
+	}
+	if _, err := fsys.Stat("moved/sub/two.txt"); err != nil {
+		t.Errorf("Rename did not move the contents of the directory: %s", err)
+	}
+	if _, err := fsys.Stat("dir/one.txt"); !os.IsNotExist(err) {
+		t.Errorf("Rename left the old directory in place")
+	}
+	if err := fstest.TestFS(fsys, "moved/one.txt", "moved/sub/two.txt", "three.txt"); err != nil {
+		t.Errorf("MemFileSystem does not behave as an fs.FS after a rename: %s", err)
+	}
+
+	if err := fsys.Remove("moved/sub"); err == nil {
+		t.Errorf("Remove should not remove a directory that is not empty")
+	}
+	if err := fsys.Remove("moved/sub/two.txt"); err != nil {
+		t.Errorf("Unexpected error removing file: %s", err)
+	}
+	if err := fsys.Remove("moved/sub"); err != nil {
+		t.Errorf("Unexpected error removing empty directory: %s", err)
+	}
+}
+
+func TestBagInMemFileSystem(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/dir/two.txt", FIXSTRING)
+	writeMemFile(t, fsys, "custom.xml", "<custom/>")
+	if err := fsys.Mkdir("bags", 0755); err != nil {
+		t.Fatalf("Unable to create bags directory: %s", err)
+	}
+
+	bagName := "__GO_TEST_MEM_FS_BAG__"
+	bag, err := bagins.NewBagFS(fsys, "bags", bagName, []string{"md5", "sha256"}, true,
+		bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	if errs := bag.AddDir("src"); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding directory: %v", errs)
+	}
+	bag.AddTagfile("bag-info.txt")
+	bagInfo, _ := bag.BagInfo()
+	bagInfo.Data.AddField(*bagins.NewTagField("Source-Organization", "APTrust"))
+	if err := bag.AddCustomTagfile("custom.xml", "custom/custom.xml", true); err != nil {
+		t.Errorf("Unexpected error adding custom tag file: %s", err)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	// Nothing should have been written to disk.
+	if _, err := os.Stat(filepath.Join("bags", bagName)); !os.IsNotExist(err) {
+		t.Errorf("Bag was written to disk")
+	}
+
+	data, err := fs.ReadFile(fsys, "bags/"+bagName+"/manifest-md5.txt")
+	if err != nil || !strings.Contains(string(data), FIXVALUE+" data/dir/two.txt") {
+		t.Errorf("manifest-md5.txt was not written correctly: %q, %v", data, err)
+	}
+
+	rBag, err := bagins.ReadBagFS(fsys, "bags/"+bagName, []string{"bag-info.txt"})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	report := rBag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Bag should be valid: %v", report.Errors())
+	}
+	bagInfo, err = rBag.BagInfo()
+	if err != nil || len(bagInfo.Data.Fields()) != 1 {
+		t.Errorf("bag-info.txt was not read back: %v", err)
+	}
+
+	// Changing a payload file should make the bag invalid.
+	writeMemFile(t, fsys, "bags/"+bagName+"/data/one.txt", "changed")
+	report = rBag.Validate()
+	if len(report.ProblemsOfType(bagins.ChecksumMismatch)) != 2 {
+		t.Errorf("Expected 2 checksum mismatches, got %v", report.Errors())
+	}
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"bag/bagit.txt":        {Data: []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")},
+		"bag/manifest-md5.txt": {Data: []byte(FIXVALUE + " data/one.txt\n")},
+		"bag/data/one.txt":     {Data: []byte(FIXSTRING)},
+	}
+	fsys := bagins.NewReadOnlyFileSystem(mapFS)
+	bag, err := bagins.ReadBagFS(fsys, "bag", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if bag.Version() != bagins.BagItVersion10 {
+		t.Errorf("Expected version 1.0, got %s", bag.Version())
+	}
+	report := bag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Bag should be valid: %v", report.Errors())
+	}
+	if report.Files["data/one.txt"].Checksums["md5"] != FIXVALUE {
+		t.Errorf("Report has wrong checksum for data/one.txt")
+	}
+
+	// It should refuse to write.
+	errs := bag.Save()
+	if len(errs) == 0 || !errors.Is(errs[0], bagins.ErrReadOnly) {
+		t.Errorf("Save should fail with ErrReadOnly, got %v", errs)
+	}
+}
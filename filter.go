@@ -0,0 +1,121 @@
+package bagins
+
+/*
+
+"It is a strange fate that we should suffer so much fear and doubt
+over so small a thing."
+
+- Boromir
+
+*/
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// SkipReason says why AddAll skipped a file or directory.
+type SkipReason string
+
+const (
+	// The name starts with a dot and Filter.SkipHidden is set.
+	SkippedHidden SkipReason = "hidden"
+	// The file or directory matches one of Filter.Exclude.
+	SkippedExcluded SkipReason = "excluded"
+	// The file matches none of Filter.Include.
+	SkippedNotIncluded SkipReason = "not_included"
+	// Filter.Predicate returned false.
+	SkippedByPredicate SkipReason = "predicate"
+	// The file is a symbolic link and the SymlinkPolicy is SymlinkSkip.
+	SkippedSymlink SkipReason = "symlink"
+)
+
+// SkippedFile is a file or directory that AddAll did not add. Nothing
+// under a skipped directory is added, or listed separately.
+type SkippedFile struct {
+	Path   string // Path of the source file, as found in the walk
+	Reason SkipReason
+	IsDir  bool
+}
+
+/*
+Filter chooses which files under the source directory AddAll adds. Set
+it with Payload.SetFilter or Bag.SetFilter.
+
+Patterns are matched with path.Match against both the path of the file
+relative to the source directory, with forward slashes, and its base
+name. So "*.tmp" matches temp files anywhere, while "logs/*.txt" only
+matches text files directly in logs.
+
+The checks run in the order of the fields. Exclude, SkipHidden and
+Predicate apply to directories as well as files, and a skipped
+directory is not walked. Include only applies to files.
+*/
+type Filter struct {
+	SkipHidden bool     // Skip files and directories whose names start with "."
+	Exclude    []string // Skip files and directories that match any of these
+	Include    []string // If not empty, only add files that match one of these
+	// If not nil, called with the relative path of each file and
+	// directory that passed the other checks. Return false to skip it.
+	Predicate func(relPath string, d fs.DirEntry) bool
+}
+
+// Returns a Filter that skips hidden files and the clutter operating
+// systems, editors and version control leave in directories.
+func DefaultFilter() *Filter {
+	return &Filter{
+		SkipHidden: true,
+		Exclude: []string{
+			"Thumbs.db", "desktop.ini", "ehthumbs.db", "Icon\r",
+			"*~", "*.swp", "*.swo", "#*#",
+			"__MACOSX", "CVS",
+		},
+	}
+}
+
+// Returns an error if any of the filter's patterns are malformed.
+func (f *Filter) validate() error {
+	for _, pattern := range append(append([]string{}, f.Exclude...), f.Include...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Returns why the file or directory at relPath should be skipped,
+// or an empty string if it should be added. A nil Filter skips nothing.
+func (f *Filter) skip(relPath string, d fs.DirEntry) SkipReason {
+	if f == nil {
+		return ""
+	}
+	if f.SkipHidden && strings.HasPrefix(d.Name(), ".") {
+		return SkippedHidden
+	}
+	if matchAny(f.Exclude, relPath) {
+		return SkippedExcluded
+	}
+	if !d.IsDir() && len(f.Include) > 0 && !matchAny(f.Include, relPath) {
+		return SkippedNotIncluded
+	}
+	if f.Predicate != nil && !f.Predicate(relPath, d) {
+		return SkippedByPredicate
+	}
+	return ""
+}
+
+// Returns true if relPath or its base name matches any of patterns.
+func matchAny(patterns []string, relPath string) bool {
+	base := path.Base(relPath)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
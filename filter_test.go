@@ -0,0 +1,105 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// Sets up a staging directory full of clutter in a new MemFileSystem.
+func setupClutteredSource(t *testing.T) bagins.FileSystem {
+	fsys := bagins.NewMemFileSystem()
+	for _, name := range []string{
+		"src/one.txt", "src/.DS_Store", "src/Thumbs.db", "src/two.txt.swp",
+		"src/docs/three.txt", "src/docs/notes.txt~", "src/docs/image.tif",
+		"src/.git/config", "src/logs/run.log", "src/logs/old/run.log",
+	} {
+		writeMemFile(t, fsys, name, FIXSTRING)
+	}
+	fsys.Mkdir("bag", 0755)
+	return fsys
+}
+
+// Adds the cluttered source to a payload with filter, and returns
+// the payload and the manifest.
+func addFiltered(t *testing.T, fsys bagins.FileSystem, filter *bagins.Filter) (*bagins.Payload, *bagins.Manifest) {
+	p, _ := bagins.NewPayloadFS(fsys, "bag")
+	m, _ := bagins.NewManifestFS(fsys, ".", "md5", bagins.PayloadManifest)
+	if err := p.SetFilter(filter); err != nil {
+		t.Fatalf("Unexpected error setting filter: %s", err)
+	}
+	if _, errs := p.AddAll("src", []*bagins.Manifest{m}); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	return p, m
+}
+
+func TestPayloadFilter(t *testing.T) {
+	fsys := setupClutteredSource(t)
+	p, m := addFiltered(t, fsys, bagins.DefaultFilter())
+	if len(m.Data) != 5 {
+		t.Errorf("Expected 5 files added, got %v", m.Data)
+	}
+	for _, name := range []string{"data/one.txt", "data/docs/three.txt", "data/docs/image.tif",
+		"data/logs/run.log", "data/logs/old/run.log"} {
+		if _, ok := m.Data[name]; !ok {
+			t.Errorf("%s was not added", name)
+		}
+	}
+
+	// The hidden directory should be skipped as a whole.
+	skipped := make(map[string]bagins.SkipReason)
+	for _, s := range p.SkippedFiles() {
+		skipped[s.Path] = s.Reason
+	}
+	expected := map[string]bagins.SkipReason{
+		"src/.DS_Store":       bagins.SkippedHidden,
+		"src/.git":            bagins.SkippedHidden,
+		"src/Thumbs.db":       bagins.SkippedExcluded,
+		"src/two.txt.swp":     bagins.SkippedExcluded,
+		"src/docs/notes.txt~": bagins.SkippedExcluded,
+	}
+	if len(skipped) != len(expected) {
+		t.Errorf("Expected %d skipped files, got %v", len(expected), skipped)
+	}
+	for name, reason := range expected {
+		if skipped[name] != reason {
+			t.Errorf("Expected %s to be skipped as %s, got %q", name, reason, skipped[name])
+		}
+	}
+}
+
+func TestPayloadFilterIncludeAndPredicate(t *testing.T) {
+	fsys := setupClutteredSource(t)
+	filter := &bagins.Filter{
+		SkipHidden: true,
+		Include:    []string{"*.txt", "logs/*"},
+		Predicate: func(relPath string, d fs.DirEntry) bool {
+			return relPath != "logs/old"
+		},
+	}
+	p, m := addFiltered(t, fsys, filter)
+	if len(m.Data) != 3 {
+		t.Errorf("Expected 3 files added, got %v", m.Data)
+	}
+	for _, name := range []string{"data/one.txt", "data/docs/three.txt", "data/logs/run.log"} {
+		if _, ok := m.Data[name]; !ok {
+			t.Errorf("%s was not added", name)
+		}
+	}
+	var reasons []string
+	for _, s := range p.SkippedFiles() {
+		if s.Path == "src/logs/old" && (!s.IsDir || s.Reason != bagins.SkippedByPredicate) {
+			t.Errorf("Expected logs/old to be skipped by the predicate, got %+v", s)
+		}
+		reasons = append(reasons, string(s.Reason))
+	}
+	if !strings.Contains(strings.Join(reasons, ","), string(bagins.SkippedNotIncluded)) {
+		t.Errorf("Expected files skipped as not included, got %v", reasons)
+	}
+
+	if err := p.SetFilter(&bagins.Filter{Exclude: []string{"[bad"}}); err == nil {
+		t.Errorf("SetFilter should reject malformed patterns")
+	}
+}
@@ -0,0 +1,234 @@
+package bagins
+
+/*
+
+"Don't be hasty, that is my motto."
+
+- Treebeard
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FixityResult holds the checksums of a single file listed in a bag's
+// manifests, calculated in one read of the file with every algorithm
+// the manifests that list it use.
+type FixityResult struct {
+	Path     string            // Relative to the bag root, as in the manifests
+	Expected map[string]string // Checksums from the manifests, keyed by algorithm
+	Actual   map[string]string // Checksums calculated, keyed by algorithm. Empty if Err is set
+	Err      error             // Why the file could not be read, or nil
+}
+
+// Returns the algorithms whose calculated checksum does not match the
+// manifest, ignoring case, in sorted order.
+func (r *FixityResult) Mismatches() []string {
+	mismatches := make([]string, 0)
+	if r.Err != nil {
+		return mismatches
+	}
+	for algorithm, expected := range r.Expected {
+		if !strings.EqualFold(r.Actual[algorithm], expected) {
+			mismatches = append(mismatches, algorithm)
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches
+}
+
+// Returns true if the file was read and every checksum matches.
+func (r *FixityResult) IsValid() bool {
+	return r.Err == nil && len(r.Mismatches()) == 0
+}
+
+/*
+CheckFixity calculates the checksum of every file listed in the bag's
+payload and tag manifests. Unlike running Manifest.RunChecksums for each
+manifest, each file is read only once, and hashed with all of the
+algorithms that list it at the same time. A bag with md5, sha256 and
+sha512 manifests is read once rather than three times.
+
+Files are hashed by a pool of workers, see SetWorkers, and progress is
+reported to the function set with SetProgressFunc. Results are returned
+in order of their paths. Files that can't be read, including paths that
+lead outside the bag, have a result with Err set.
+*/
+func (b *Bag) CheckFixity() []*FixityResult {
+	results, _ := b.CheckFixityContext(context.Background())
+	return results
+}
+
+// Performs CheckFixity, stopping when ctx is done. Only the files that
+// were checked are returned, along with ctx.Err().
+func (b *Bag) CheckFixityContext(ctx context.Context) ([]*FixityResult, error) {
+	expected := make(map[string]map[string]string)
+	hashFuncs := make(map[string]func() hash.Hash)
+	for _, manifest := range b.Manifests {
+		hashFuncs[manifest.Algorithm()] = manifest.hashFunc
+		for pathInBag, checksum := range manifest.Data {
+			if expected[pathInBag] == nil {
+				expected[pathInBag] = make(map[string]string)
+			}
+			expected[pathInBag][manifest.Algorithm()] = checksum
+		}
+	}
+	paths := make([]string, 0, len(expected))
+	for pathInBag := range expected {
+		paths = append(paths, pathInBag)
+	}
+	sort.Strings(paths)
+
+	results := make([]*FixityResult, len(paths))
+	absPaths := make([]string, len(paths))
+	for i, pathInBag := range paths {
+		results[i] = &FixityResult{
+			Path:     pathInBag,
+			Expected: expected[pathInBag],
+			Actual:   make(map[string]string),
+		}
+		absPaths[i], results[i].Err = b.safeJoin(pathInBag, "the manifests")
+	}
+
+	// Only stat the files when someone is listening.
+	var bytesTotal int64
+	if b.payload.progress != nil {
+		for i, absPath := range absPaths {
+			if results[i].Err != nil {
+				continue
+			}
+			if info, err := b.fsys.Stat(absPath); err == nil {
+				bytesTotal += info.Size()
+			}
+		}
+	}
+	tracker := newProgressTracker(b.payload.progress, CheckingFiles, len(paths), bytesTotal)
+
+	checked := make([]bool, len(paths))
+	runWorkers(ctx, b.payload.workers, len(paths), func(i int) {
+		result := results[i]
+		if result.Err == nil {
+			algorithms := make(map[string]func() hash.Hash)
+			for algorithm := range result.Expected {
+				algorithms[algorithm] = hashFuncs[algorithm]
+			}
+			actual, err := hashFile(ctx, b.fsys, absPaths[i], result.Path, algorithms, tracker)
+			if ctx.Err() != nil {
+				return
+			}
+			result.Actual, result.Err = actual, err
+			if err != nil {
+				result.Err = fileReadError(result.Path, b.listingManifest(result.Path, ""), err)
+			}
+		}
+		checked[i] = true
+	})
+
+	done := make([]*FixityResult, 0, len(results))
+	for i, result := range results {
+		if checked[i] {
+			done = append(done, result)
+		}
+	}
+	return done, ctx.Err()
+}
+
+/*
+RunChecksums checks the files listed in all of the bag's manifests, as
+Manifest.RunChecksums does for a single manifest, but reads each file
+only once. See CheckFixity. Returns a *ChecksumMismatchError for each
+checksum that does not match, a *MissingFileError for each file that
+does not exist, and the error for each file that could not be read, in
+order of the file paths.
+*/
+func (b *Bag) RunChecksums() []error {
+	return b.RunChecksumsContext(context.Background())
+}
+
+// Performs RunChecksums, stopping when ctx is done. ctx.Err() is
+// returned as the last error, and files that were not checked are not
+// reported as invalid.
+func (b *Bag) RunChecksumsContext(ctx context.Context) []error {
+	var errs []error
+	results, err := b.CheckFixityContext(ctx)
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+			continue
+		}
+		for _, algorithm := range result.Mismatches() {
+			errs = append(errs, &ChecksumMismatchError{Path: result.Path, Manifest: b.listingManifest(result.Path, algorithm),
+				Algorithm: algorithm, Expected: result.Expected[algorithm], Actual: result.Actual[algorithm]})
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Reads the file at name once, hashing it with each of the algorithms,
+// and returns the checksums keyed by algorithm. Bytes read are reported
+// to tracker as key.
+func hashFile(ctx context.Context, fsys FileSystem, name string, key string, algorithms map[string]func() hash.Hash, tracker *progressTracker) (map[string]string, error) {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for algorithm, newHash := range algorithms {
+		hashes[algorithm] = newHash()
+		writers = append(writers, hashes[algorithm])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), &trackingReader{ctx: ctx, reader: src, tracker: tracker, path: key}); err != nil {
+		return nil, err
+	}
+	tracker.fileDone(key)
+	checksums := make(map[string]string, len(hashes))
+	for algorithm, hsh := range hashes {
+		checksums[algorithm] = fmt.Sprintf("%x", hsh.Sum(nil))
+	}
+	return checksums, nil
+}
+
+// Returns the path, relative to the bag root, of the first manifest that
+// lists pathInBag with algorithm, or with any algorithm if it is empty.
+func (b *Bag) listingManifest(pathInBag string, algorithm string) string {
+	for _, manifest := range b.Manifests {
+		if _, ok := manifest.Data[pathInBag]; ok && (algorithm == "" || manifest.Algorithm() == algorithm) {
+			return b.manifestPath(manifest)
+		}
+	}
+	return ""
+}
+
+// A bag whose files have been hashed with CheckFixity, so validation
+// can use the checksums rather than read each file once per manifest.
+type checkedBag struct {
+	*Bag
+	results map[string]*FixityResult
+}
+
+// Returns the checksum of the file at pathInBag calculated by
+// CheckFixity, hashing the file if it was not checked.
+func (c *checkedBag) fileChecksum(pathInBag string, manifest *Manifest) (string, error) {
+	result, ok := c.results[pathInBag]
+	if !ok {
+		return c.Bag.fileChecksum(pathInBag, manifest)
+	}
+	if result.Err != nil {
+		return "", result.Err
+	}
+	if checksum, ok := result.Actual[manifest.Algorithm()]; ok {
+		return checksum, nil
+	}
+	return c.Bag.fileChecksum(pathInBag, manifest)
+}
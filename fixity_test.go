@@ -0,0 +1,80 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Counts how many times each file is opened.
+type countingFS struct {
+	bagins.FileSystem
+	mutex sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.mutex.Lock()
+	c.opens[filepath.ToSlash(name)]++
+	c.mutex.Unlock()
+	return c.FileSystem.Open(name)
+}
+
+func TestBagCheckFixity(t *testing.T) {
+	mem := bagins.NewMemFileSystem()
+	writeMemFile(t, mem, "src/one.txt", FIXSTRING)
+	writeMemFile(t, mem, "src/two.txt", strings.Repeat(FIXSTRING, 100))
+	bag, err := bagins.NewBagFS(mem, ".", "fixity-bag", []string{"md5", "sha256", "sha512"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddFile("src/one.txt", "one.txt")
+	bag.AddFile("src/two.txt", "two.txt")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	fsys := &countingFS{FileSystem: mem, opens: make(map[string]int)}
+	bag, err = bagins.ReadBagFS(fsys, "fixity-bag", []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	fsys.opens = make(map[string]int)
+	results := bag.CheckFixity()
+	for i, result := range results {
+		if i > 0 && results[i-1].Path >= result.Path {
+			t.Errorf("Expected the results in order of their paths, got %s before %s", results[i-1].Path, result.Path)
+		}
+		if !result.IsValid() || len(result.Actual) != 3 {
+			t.Errorf("Expected %s to be valid for 3 algorithms, got %v, %v", result.Path, result.Actual, result.Err)
+		}
+	}
+	for _, name := range []string{"fixity-bag/data/one.txt", "fixity-bag/data/two.txt"} {
+		if fsys.opens[name] != 1 {
+			t.Errorf("Expected %s to be read once, it was read %d times", name, fsys.opens[name])
+		}
+	}
+
+	// Validation reads each file once too.
+	fsys.opens = make(map[string]int)
+	if report := bag.Validate(); !report.IsValid() {
+		t.Errorf("Expected the bag to be valid: %v", report.Problems)
+	}
+	if fsys.opens["fixity-bag/data/two.txt"] != 1 {
+		t.Errorf("Expected Validate to read two.txt once, it was read %d times", fsys.opens["fixity-bag/data/two.txt"])
+	}
+
+	writeMemFile(t, mem, "fixity-bag/data/two.txt", "changed")
+	errs := bag.RunChecksums()
+	if len(errs) != 3 {
+		t.Fatalf("Expected an error for each algorithm, got %v", errs)
+	}
+	for i, algorithm := range []string{"md5", "sha256", "sha512"} {
+		if !strings.Contains(errs[i].Error(), algorithm) || !strings.Contains(errs[i].Error(), "two.txt") {
+			t.Errorf("Expected a %s error for two.txt, got %s", algorithm, errs[i])
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package bagins
+
+/*
+
+"Short cuts make long delays."
+
+- Peregrin Took
+
+*/
+
+import (
+	"os"
+)
+
+// IngestStrategy is how a file gets into the payload directory. Set the
+// one to try with Payload.SetIngestStrategy, and see which was used for
+// each file with Payload.IngestStrategies.
+type IngestStrategy string
+
+const (
+	// The file is copied into the payload. This is the default, and
+	// what the other strategies fall back to when they can't be used.
+	IngestCopy IngestStrategy = "copy"
+	// The file is hard linked into the payload, so it takes no more
+	// space. This only works when the source is on the same file
+	// system as the bag, and the file system implements LinkFS.
+	// Changing either copy of the file changes the other.
+	IngestHardLink IngestStrategy = "hardlink"
+	// The file is cloned into the payload, sharing its storage until
+	// either copy is changed. This needs a file system that
+	// implements ReflinkFS and supports reflinks, such as Btrfs or XFS.
+	IngestReflink IngestStrategy = "reflink"
+	// The source was already in place in the payload, so it was only
+	// hashed. This is only reported, not set.
+	IngestInPlace IngestStrategy = "in_place"
+	// The file is a symbolic link that was added as a link, because the
+	// payload's SymlinkPolicy is SymlinkPreserve. This is only reported,
+	// not set.
+	IngestSymlink IngestStrategy = "symlink"
+)
+
+// Tries to put the file at srcPath into the payload at dstFile without
+// copying it, using strategy. Returns the strategy that was used, which
+// is IngestCopy if the file still has to be copied.
+func (p *Payload) linkFile(strategy IngestStrategy, srcPath string, dstFile string) IngestStrategy {
+	var link func(string, string) error
+	switch strategy {
+	case IngestHardLink:
+		if lfs, ok := p.fsys.(LinkFS); ok {
+			link = lfs.Link
+		}
+	case IngestReflink:
+		if rfs, ok := p.fsys.(ReflinkFS); ok {
+			link = rfs.Reflink
+		}
+	}
+	if link == nil {
+		return IngestCopy
+	}
+
+	// Neither kind of link can replace a file. Copying over a hard link
+	// to the source would empty the source, so the old file goes first.
+	if err := p.fsys.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+		return IngestCopy
+	}
+	if err := link(srcPath, dstFile); err != nil {
+		return IngestCopy
+	}
+	return strategy
+}
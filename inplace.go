@@ -0,0 +1,213 @@
+package bagins
+
+/*
+
+"I will take the Ring, though I do not know the way."
+
+- Frodo Baggins
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// BagInPlaceOptions holds the settings for BagInPlace. The zero value,
+// or a nil pointer, makes a DefaultBagItVersion bag without tag manifests
+// on the OS file system.
+type BagInPlaceOptions struct {
+	Version            string        // BagIt version of the bag, DefaultBagItVersion if empty
+	CreateTagManifests bool          // Write a tag manifest for each algorithm
+	AutoBagInfo        bool          // Write bag-info.txt with its reserved fields, see Bag.SetAutoBagInfo
+	Workers            int           // Number of files hashed at once, see Bag.SetWorkers
+	Progress           ProgressFunc  // Receives progress while the files are hashed
+	SymlinkPolicy      SymlinkPolicy // What is done with symbolic links, see Bag.SetSymlinkPolicy
+	FileSystem         FileSystem    // File system dir is on, OSFileSystem if nil
+}
+
+/*
+BagInPlace turns the directory dir into a bag without copying its
+contents, as bagit-python's --in-place option does. Everything in dir is
+renamed into a new data directory, hashed where it is with each of the
+algorithms, and bagit.txt, the manifests and any tag manifests are
+written to dir. Renaming within a directory takes no extra space, so
+this works for collections too large to hold two copies of.
+
+dir must not already contain a bagit.txt file. If anything goes wrong,
+the files written to dir are removed and its contents are moved back
+out of the data directory, and the errors are returned with a nil bag.
+
+example:
+
+	bag, errs := bagins.BagInPlace("/archive/collection", []string{"sha256"}, nil)
+*/
+func BagInPlace(dir string, algorithms []string, opts *BagInPlaceOptions) (*Bag, []error) {
+	return BagInPlaceContext(context.Background(), dir, algorithms, opts)
+}
+
+// Performs BagInPlace, stopping when ctx is done. The directory is put
+// back as it was and ctx.Err() is the last error returned.
+func BagInPlaceContext(ctx context.Context, dir string, algorithms []string, opts *BagInPlaceOptions) (*Bag, []error) {
+	if opts == nil {
+		opts = &BagInPlaceOptions{}
+	}
+	version := opts.Version
+	if version == "" {
+		version = DefaultBagItVersion
+	}
+	if !isSupportedVersion(version) {
+		return nil, []error{fmt.Errorf("Unsupported BagIt version '%s'. Must be %s or %s",
+			version, BagItVersion097, BagItVersion10)}
+	}
+	fsys := defaultFileSystem(opts.FileSystem)
+	dir = filepath.Clean(dir)
+
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	if !info.IsDir() {
+		return nil, []error{fmt.Errorf("Unable to bag %s in place, it is not a directory", dir)}
+	}
+	if _, err := fsys.Stat(filepath.Join(dir, "bagit.txt")); err == nil {
+		return nil, []error{fmt.Errorf("Unable to bag %s in place, it already has a bagit.txt file", dir)}
+	}
+
+	bag := new(Bag)
+	bag.version = version
+	bag.fsys = fsys
+	bag.pathToFile = dir
+	bag.Manifests = make([]*Manifest, 0)
+	bag.tagfiles = make(map[string]*TagFile)
+	bag.excludeFromTagManifests = make(map[string]bool)
+	if err := bag.initManifests(algorithms, opts.CreateTagManifests); err != nil {
+		return nil, []error{err}
+	}
+
+	if err := moveIntoPayload(fsys, dir); err != nil {
+		return nil, []error{err}
+	}
+
+	errs := bag.finishInPlace(ctx, opts)
+	if err := ctx.Err(); err != nil && len(errs) == 0 {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		if err := moveOutOfPayload(fsys, dir); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to put %s back as it was: %w", dir, err))
+		}
+		return nil, errs
+	}
+	return bag, nil
+}
+
+// Hashes the payload of a bag made in place and writes its tag files.
+func (b *Bag) finishInPlace(ctx context.Context, opts *BagInPlaceOptions) []error {
+	payload, err := NewPayloadFS(b.fsys, filepath.Join(b.Path(), "data"))
+	if err != nil {
+		return []error{err}
+	}
+	b.payload = payload
+	b.SetWorkers(opts.Workers)
+	b.SetProgressFunc(opts.Progress)
+	if opts.SymlinkPolicy != "" {
+		if err := b.SetSymlinkPolicy(opts.SymlinkPolicy); err != nil {
+			return []error{err}
+		}
+	}
+
+	tf, err := b.createBagItFile()
+	if err != nil {
+		return []error{err}
+	}
+	b.tagfiles["bagit.txt"] = tf
+
+	// The source and destination are the same, so the
+	// files are only hashed, not copied.
+	if _, errs := b.payload.AddAllContext(ctx, b.payload.Name(), b.GetManifests(PayloadManifest)); len(errs) > 0 {
+		return errs
+	}
+	if opts.AutoBagInfo {
+		if err := b.SetAutoBagInfo(true); err != nil {
+			return []error{err}
+		}
+	}
+	return b.SaveContext(ctx)
+}
+
+// Moves everything in dir into a new data directory in dir. The
+// contents are moved into a temporary directory first, in case dir
+// already holds something called data. On failure, whatever was
+// moved is put back.
+func moveIntoPayload(fsys FileSystem, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := tempFileName(fsys, dir, ".bagins-data-")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Mkdir(tmpDir, 0755); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		err := fsys.Rename(filepath.Join(dir, entry.Name()), filepath.Join(tmpDir, entry.Name()))
+		if err != nil {
+			for _, moved := range entries[:i] {
+				fsys.Rename(filepath.Join(tmpDir, moved.Name()), filepath.Join(dir, moved.Name()))
+			}
+			fsys.Remove(tmpDir)
+			return err
+		}
+	}
+	if err := fsys.Rename(tmpDir, filepath.Join(dir, "data")); err != nil {
+		moveBack(fsys, tmpDir, dir)
+		return err
+	}
+	return nil
+}
+
+// Undoes moveIntoPayload, removing the tag files written to dir and
+// moving the contents of the data directory back into dir.
+func moveOutOfPayload(fsys FileSystem, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "data" {
+			continue
+		}
+		if err := removeAll(fsys, filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	// Move data aside first, in case it holds something called data.
+	tmpDir, err := tempFileName(fsys, dir, ".bagins-data-")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Rename(filepath.Join(dir, "data"), tmpDir); err != nil {
+		return err
+	}
+	return moveBack(fsys, tmpDir, dir)
+}
+
+// Moves everything in tmpDir into dir and removes tmpDir.
+func moveBack(fsys FileSystem, tmpDir string, dir string) error {
+	entries, err := fs.ReadDir(fsys, tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fsys.Rename(filepath.Join(tmpDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return fsys.Remove(tmpDir)
+}
@@ -0,0 +1,103 @@
+package bagins_test
+
+import (
+	"context"
+	"errors"
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestBagInPlace(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_BAGINPLACE_")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "data"), 0755)
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "one.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data", "two.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "three.txt"), []byte(FIXSTRING), 0644)
+
+	bag, errs := bagins.BagInPlace(dir, []string{"md5", "sha256"},
+		&bagins.BagInPlaceOptions{CreateTagManifests: true, AutoBagInfo: true, Workers: 2})
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors bagging in place: %v", errs)
+	}
+	if bag.Version() != bagins.DefaultBagItVersion {
+		t.Errorf("Expected a BagIt %s bag, got %s", bagins.DefaultBagItVersion, bag.Version())
+	}
+
+	// The existing data directory should end up inside the new one.
+	md5 := bag.GetManifest(bagins.PayloadManifest, "md5")
+	for _, name := range []string{"data/one.txt", "data/data/two.txt", "data/docs/three.txt"} {
+		if md5.Data[filepath.FromSlash(name)] != FIXVALUE {
+			t.Errorf("Wrong md5 for %s: %s", name, md5.Data[filepath.FromSlash(name)])
+		}
+	}
+	var names []string
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	expected := []string{"bag-info.txt", "bagit.txt", "data", "manifest-md5.txt", "manifest-sha256.txt",
+		"tagmanifest-md5.txt", "tagmanifest-sha256.txt"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v in the bag, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Expected %v in the bag, got %v", expected, names)
+			break
+		}
+	}
+
+	rBag, err := bagins.ReadBag(dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if report := rBag.Validate(); !report.IsValid() {
+		t.Errorf("Bag should be valid: %v", report.Errors())
+	}
+	if report := rBag.QuickValidate(); !report.IsValid() || len(report.Warnings) > 0 {
+		t.Errorf("Bag should pass QuickValidate: %v, %v", report.Errors(), report.Warnings)
+	}
+
+	// It should refuse to bag a bag.
+	if _, errs := bagins.BagInPlace(dir, []string{"md5"}, nil); len(errs) == 0 {
+		t.Errorf("BagInPlace should not bag a directory that has bagit.txt")
+	}
+}
+
+func TestBagInPlaceRollback(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "coll/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "coll/data/two.txt", FIXSTRING)
+	opts := &bagins.BagInPlaceOptions{FileSystem: fsys, CreateTagManifests: true}
+
+	checkUnchanged := func() {
+		entries, _ := fs.ReadDir(fsys, "coll")
+		if len(entries) != 2 || entries[0].Name() != "data" || entries[1].Name() != "one.txt" {
+			t.Errorf("Directory was not put back as it was: %v", entries)
+		}
+		if _, err := fsys.Stat("coll/data/two.txt"); err != nil {
+			t.Errorf("data/two.txt was not put back: %s", err)
+		}
+	}
+
+	if _, errs := bagins.BagInPlace("coll", []string{"md5", "nosuchhash"}, opts); len(errs) == 0 {
+		t.Errorf("Expected an error for an unknown algorithm")
+	}
+	checkUnchanged()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bag, errs := bagins.BagInPlaceContext(ctx, "coll", []string{"md5"}, opts)
+	if bag != nil || len(errs) == 0 || !errors.Is(errs[len(errs)-1], context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", errs)
+	}
+	checkUnchanged()
+}
@@ -10,14 +10,18 @@ package bagins
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/APTrust/bagins/bagutil"
 	"hash"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -35,8 +39,21 @@ type Manifest struct {
 	Data          map[string]string // Key is file path, value is checksum
 	hashName      string
 	hashFunc      func() hash.Hash
+	bagItVersion  string            // BagIt version of the bag the manifest belongs to
+	fsys          FileSystem        // File system the manifest is read from and written to
+	workers       int               // Number of files RunChecksums hashes at once, 0 for one per CPU
+	progress      ProgressFunc      // Called by RunChecksums to report progress, may be nil
+	lineEnding    LineEnding        // Ends each line written, "" for LineEndingLF
 }
 
+// LineEnding is the sequence that ends each line of a manifest.
+type LineEnding string
+
+const (
+	LineEndingLF   LineEnding = "\n"   // Unix line endings, the default
+	LineEndingCRLF LineEnding = "\r\n" // Windows line endings
+)
+
 const (
 	PayloadManifest = "payload_manifest"
 	TagManifest     = "tag_manifest"
@@ -44,17 +61,33 @@ const (
 
 // Returns a pointer to a new manifest or returns an error if improperly named.
 func NewManifest(pathToFile string, hashName string, manifestType string) (*Manifest, error) {
-	if manifestType != PayloadManifest && manifestType != TagManifest {
-		return nil, fmt.Errorf("Param manifestType must be either bagins.PayloadManifest " +
-			"or bagins.TagManifest")
-	}
-	if _, err := os.Stat(filepath.Dir(pathToFile)); err != nil {
+	return NewManifestFS(OSFileSystem{}, pathToFile, hashName, manifestType)
+}
+
+// Returns a pointer to a new manifest that will be written to fsys.
+func NewManifestFS(fsys FileSystem, pathToFile string, hashName string, manifestType string) (*Manifest, error) {
+	if _, err := fsys.Stat(filepath.Dir(pathToFile)); err != nil {
 		if os.IsNotExist(err) {
 			return nil, fmt.Errorf("Unable to create manifest. Path does not exist: %s", pathToFile)
 		} else {
 			return nil, fmt.Errorf("Unexpected error creating manifest: %s", err)
 		}
 	}
+	m, err := newManifest(pathToFile, hashName, manifestType)
+	if err != nil {
+		return nil, err
+	}
+	m.fsys = fsys
+	return m, nil
+}
+
+// Returns a pointer to a new manifest without checking that its
+// directory exists, for manifests that are never written to disk.
+func newManifest(pathToFile string, hashName string, manifestType string) (*Manifest, error) {
+	if manifestType != PayloadManifest && manifestType != TagManifest {
+		return nil, fmt.Errorf("Param manifestType must be either bagins.PayloadManifest " +
+			"or bagins.TagManifest")
+	}
 	m := new(Manifest)
 	m.hashName = strings.ToLower(hashName)
 	hashFunc, err := bagutil.LookupHash(hashName)
@@ -88,6 +121,27 @@ func NewManifest(pathToFile string, hashName string, manifestType string) (*Mani
   parsing errors when attempting to read data for fault tolerance.
 */
 func ReadManifest(name string) (*Manifest, []error) {
+	return readManifest(OSFileSystem{}, name, "", ParseLenient)
+}
+
+// Reads and parses the manifest at name in fsys, as ReadManifest does.
+func ReadManifestFS(fsys FileSystem, name string) (*Manifest, []error) {
+	return readManifest(fsys, name, "", ParseLenient)
+}
+
+// Reads and parses the manifest at name in fsys in mode. In ParseStrict
+// mode each bad line is returned as a *ParseError, and left out of the
+// manifest's Data.
+func ReadManifestWithMode(fsys FileSystem, name string, mode ParseMode) (*Manifest, []error) {
+	if err := validateParseMode(mode); err != nil {
+		return nil, []error{err}
+	}
+	return readManifest(defaultFileSystem(fsys), name, "", mode)
+}
+
+// Reads a manifest as ReadManifest does, decoding file paths as required
+// by the specified BagIt version.
+func readManifest(fsys FileSystem, name string, bagItVersion string, mode ParseMode) (*Manifest, []error) {
 	var errs []error
 
 	hashName, err := parseAlgoName(name)
@@ -95,25 +149,33 @@ func ReadManifest(name string) (*Manifest, []error) {
 		return nil, append(errs, err)
 	}
 
-	file, err := os.Open(name)
+	file, err := fsys.Open(name)
 	if err != nil {
 		return nil, append(errs, err)
 	}
+	defer file.Close()
 
-	data, e := parseManifestData(file)
+	parsed, e := parseManifest(file, name, hashName, bagItVersion, mode)
 	if e != nil {
 		errs = append(errs, e...)
 	}
+	// Paths are written with forward slashes, and kept with the
+	// OS separator, as the files are found in the bag.
+	data := make(map[string]string, len(parsed))
+	for pathInBag, checksum := range parsed {
+		data[filepath.FromSlash(pathInBag)] = checksum
+	}
 
 	manifestType := PayloadManifest
 	if strings.HasPrefix(path.Base(name), "tagmanifest-") {
 		manifestType = TagManifest
 	}
-	m, err := NewManifest(name, hashName, manifestType)
+	m, err := NewManifestFS(fsys, name, hashName, manifestType)
 	if err != nil {
 		return nil, append(errs, err)
 	}
 	m.Data = data
+	m.bagItVersion = bagItVersion
 
 	return m, errs
 
@@ -121,25 +183,115 @@ func ReadManifest(name string) (*Manifest, []error) {
 
 /*
   Calculates a checksum for files listed in the manifest and compares it to the value
-  stored in manifest file.  Returns an error for each file that fails the fixity check.
+  stored in manifest file.  Returns an error for each file that fails the fixity check:
+  a *ChecksumMismatchError if the checksum is wrong, a *MissingFileError if the file
+  does not exist, or the error from reading it.
+  Files whose paths lead outside the directory holding the manifest are not read,
+  and an *UnsafePathError is returned for each of them.
+
+  Files are hashed by a pool of workers, see SetWorkers. Errors are returned
+  in the order of the file paths, however many workers there are.
 */
 func (m *Manifest) RunChecksums() []error {
+	return m.RunChecksumsContext(context.Background())
+}
+
+/*
+  Performs RunChecksums, reporting progress to the function set with
+  SetProgressFunc. When ctx is done, no more files are checked and
+  ctx.Err() is returned as the last error. Files that were not checked
+  are not reported as invalid.
+*/
+func (m *Manifest) RunChecksumsContext(ctx context.Context) []error {
 	var invalidSums []error
 
-	for key, sum := range m.Data {
-		pathToFile := filepath.Join(filepath.Dir(m.name), key)
-		fileChecksum, err := bagutil.FileChecksum(pathToFile, m.hashFunc())
-		if sum != fileChecksum {
-			invalidSums = append(invalidSums, fmt.Errorf("File checksum %s is not valid for %s:%s", sum, key, fileChecksum))
+	keys := make([]string, 0, len(m.Data))
+	for key := range m.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fileErrs := make([][]error, len(keys))
+	paths := make([]string, len(keys))
+	guard := newPathGuard(m.fileSystem(), filepath.Dir(m.name))
+	for i, key := range keys {
+		if pathToFile, err := guard.join(key, m.name); err != nil {
+			fileErrs[i] = append(fileErrs[i], err)
+		} else {
+			paths[i] = pathToFile
+		}
+	}
+
+	// Only stat the files when someone is listening.
+	var bytesTotal int64
+	if m.progress != nil {
+		for _, pathToFile := range paths {
+			if pathToFile == "" {
+				continue
+			}
+			if info, err := m.fileSystem().Stat(pathToFile); err == nil {
+				bytesTotal += info.Size()
+			}
+		}
+	}
+	tracker := newProgressTracker(m.progress, CheckingFiles, len(keys), bytesTotal)
+
+	runWorkers(ctx, m.workers, len(keys), func(i int) {
+		key := keys[i]
+		sum := m.Data[key]
+		pathToFile := paths[i]
+		if pathToFile == "" {
+			return
+		}
+		fileChecksum, err := m.trackedChecksum(ctx, pathToFile, key, tracker)
+		if ctx.Err() != nil {
+			return
 		}
 		if err != nil {
-			invalidSums = append(invalidSums, err)
+			fileErrs[i] = append(fileErrs[i], fileReadError(key, m.name, err))
+		} else if !strings.EqualFold(sum, fileChecksum) {
+			fileErrs[i] = append(fileErrs[i], &ChecksumMismatchError{Path: key, Manifest: m.name,
+				Algorithm: m.Algorithm(), Expected: sum, Actual: fileChecksum})
 		}
+	})
+	for _, errs := range fileErrs {
+		invalidSums = append(invalidSums, errs...)
+	}
+	if err := ctx.Err(); err != nil {
+		invalidSums = append(invalidSums, err)
 	}
 
 	return invalidSums
 }
 
+// Returns the checksum of the file at pathToFile, reporting the bytes
+// read to tracker as key.
+func (m *Manifest) trackedChecksum(ctx context.Context, pathToFile string, key string, tracker *progressTracker) (string, error) {
+	src, err := m.fileSystem().Open(pathToFile)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	hsh := m.hashFunc()
+	if _, err := io.Copy(hsh, &trackingReader{ctx: ctx, reader: src, tracker: tracker, path: key}); err != nil {
+		return "", err
+	}
+	tracker.fileDone(key)
+	return fmt.Sprintf("%x", hsh.Sum(nil)), nil
+}
+
+// Sets the number of files RunChecksums hashes at the same time. Zero or
+// less means one per CPU, which is the default.
+func (m *Manifest) SetWorkers(workers int) {
+	m.workers = workers
+}
+
+// Sets a function that RunChecksums and RunChecksumsContext report their
+// progress to. Pass nil to stop reporting progress.
+func (m *Manifest) SetProgressFunc(fn ProgressFunc) {
+	m.progress = fn
+}
+
 // Writes key value pairs to a manifest file.
 func (m *Manifest) Create() error {
 	if m.Name() == "" {
@@ -148,35 +300,62 @@ func (m *Manifest) Create() error {
 	// Create directory if needed.
 	basepath := filepath.Dir(m.name)
 
-	if err := os.MkdirAll(basepath, 0777); err != nil {
+	if err := m.fileSystem().MkdirAll(basepath, 0777); err != nil {
 		return err
 	}
 
 	// Create the tagfile.
-	fileOut, err := os.Create(m.name)
+	fileOut, err := m.fileSystem().Create(m.name)
 	if err != nil {
 		return err
 	}
 	defer fileOut.Close()
 
 	// Write fields and data to the file.
-	for fName, ckSum := range m.Data {
-		_, err := fmt.Fprintln(fileOut, ckSum, fName)
-		if err != nil {
-			return errors.New("Error writing line to manifest: " + err.Error())
-		}
+	if _, err := io.WriteString(fileOut, m.ToString()); err != nil {
+		return errors.New("Error writing line to manifest: " + err.Error())
 	}
 	return nil
 }
 
 // Returns the contents of the manifest in the form of a string.
 // Useful if you don't want to write directly to disk.
+//
+// There is one line for each file, sorted by path, so the same data
+// always gives the same manifest. Each line is the checksum, a single
+// space and the path, with forward slashes whatever the OS, ended as
+// set with SetLineEnding.
 func (m *Manifest) ToString() string {
-	str := ""
-	for fName, ckSum := range m.Data {
-		str += fmt.Sprintf("%s %s\n", ckSum, fName)
+	names := make([]string, 0, len(m.Data))
+	for fName := range m.Data {
+		names = append(names, fName)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return filepath.ToSlash(names[i]) < filepath.ToSlash(names[j])
+	})
+	var str strings.Builder
+	for _, fName := range names {
+		str.WriteString(m.Data[fName] + " " + m.encodePath(filepath.ToSlash(fName)) + string(m.LineEnding()))
+	}
+	return str.String()
+}
+
+// Sets the line ending written by Create and ToString, either
+// LineEndingLF, the default, or LineEndingCRLF.
+func (m *Manifest) SetLineEnding(lineEnding LineEnding) error {
+	if lineEnding != LineEndingLF && lineEnding != LineEndingCRLF {
+		return fmt.Errorf("Unsupported line ending %q. Must be LineEndingLF or LineEndingCRLF", lineEnding)
+	}
+	m.lineEnding = lineEnding
+	return nil
+}
+
+// Returns the line ending written by Create and ToString.
+func (m *Manifest) LineEnding() LineEnding {
+	if m.lineEnding == "" {
+		return LineEndingLF
 	}
-	return str
+	return m.lineEnding
 }
 
 
@@ -196,11 +375,65 @@ func (m *Manifest) Type() string {
 	return m.manifestType
 }
 
-// Tries to parse the algorithm name from a manifest filename.  Returns
-// an error if unable to do so.
+// Returns the file system the manifest is written to.
+func (m *Manifest) fileSystem() FileSystem {
+	return defaultFileSystem(m.fsys)
+}
+
+// Returns the file path as it should be written in the manifest. BagIt 1.0
+// requires CR, LF and % in file paths to be percent-encoded, see
+// https://tools.ietf.org/html/rfc8493#section-2.1.3
+func (m *Manifest) encodePath(pathInBag string) string {
+	return encodeManifestPath(pathInBag, m.bagItVersion)
+}
+
+// Percent-encodes CR, LF and % in pathInBag if bagItVersion requires it.
+// This applies to paths in fetch.txt as well as in manifests.
+func encodeManifestPath(pathInBag string, bagItVersion string) string {
+	if bagItVersion != BagItVersion10 {
+		return pathInBag
+	}
+	pathInBag = strings.Replace(pathInBag, "%", "%25", -1)
+	pathInBag = strings.Replace(pathInBag, "\r", "%0D", -1)
+	return strings.Replace(pathInBag, "\n", "%0A", -1)
+}
+
+// Reverses encodeManifestPath for paths read from a BagIt 1.0 manifest
+// or fetch.txt. Percent signs that do not begin one of the three encoded
+// sequences are left as they are.
+func decodeManifestPath(pathInBag string) string {
+	if !strings.Contains(pathInBag, "%") {
+		return pathInBag
+	}
+	var decoded bytes.Buffer
+	for i := 0; i < len(pathInBag); i++ {
+		if pathInBag[i] == '%' && i+2 < len(pathInBag) {
+			switch strings.ToUpper(pathInBag[i+1 : i+3]) {
+			case "25":
+				decoded.WriteByte('%')
+				i += 2
+				continue
+			case "0D":
+				decoded.WriteByte('\r')
+				i += 2
+				continue
+			case "0A":
+				decoded.WriteByte('\n')
+				i += 2
+				continue
+			}
+		}
+		decoded.WriteByte(pathInBag[i])
+	}
+	return decoded.String()
+}
+
+// Tries to parse the algorithm name from a manifest filename, such as
+// manifest-sha3-256.txt.  Returns an error if unable to do so, or if the
+// algorithm has not been registered with bagutil.RegisterHash.
 func parseAlgoName(name string) (string, error) {
 	filename := filepath.Base(name)
-	re, err := regexp.Compile(`(^.*\-)(.*)(\.txt$)`)
+	re, err := regexp.Compile(`^(?:.*manifest-|.*-)(.+)\.txt$`)
 	if err != nil {
 		return "", err
 	}
@@ -208,13 +441,16 @@ func parseAlgoName(name string) (string, error) {
 	if len(matches) < 2 {
 		return "", errors.New("Unable to determine algorithm from filename!")
 	}
-	algo := matches[2]
+	algo := matches[1]
+	if _, err := bagutil.LookupHash(algo); err != nil {
+		return "", err
+	}
 	return algo, nil
 }
 
 // Reads the contents of file and parses checksum and file information in manifest format as
-// per the bagit specification.
-func parseManifestData(file *os.File) (map[string]string, []error) {
+// per the bagit specification. File paths in BagIt 1.0 manifests are percent-decoded.
+func parseManifestData(file io.Reader, bagItVersion string) (map[string]string, []error) {
 	var errs []error
 	// See regexp examples at http://play.golang.org/p/_msLJ-lBEu
 	// Regex matches these reqs from the bagit spec: "One or
@@ -227,9 +463,12 @@ func parseManifestData(file *os.File) (map[string]string, []error) {
 	values := make(map[string]string)
 
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSuffix(scanner.Text(), "\r")
 		if re.MatchString(line) {
 			data := re.FindStringSubmatch(line)
+			if bagItVersion == BagItVersion10 {
+				data[2] = decodeManifestPath(data[2])
+			}
 			values[data[2]] = data[1]
 		} else {
 			errs = append(errs, fmt.Errorf("Unable to parse data from line: %s", line))
@@ -2,12 +2,17 @@
 package bagins_test
 
 import (
+	"context"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"github.com/APTrust/bagins"
+	"github.com/APTrust/bagins/bagutil"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -150,6 +155,67 @@ func TestRunChecksums(t *testing.T) {
 	os.Remove(testFile.Name()) // Remove the test file.
 }
 
+func TestRunChecksumsWorkers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_RUNCHECKSUMSWORKERS_")
+	defer os.RemoveAll(dir)
+
+	mfst, _ := bagins.NewManifest(dir, "md5", bagins.PayloadManifest)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(test_string), 0644)
+		mfst.Data[name] = test_list["md5"]
+	}
+	mfst.Data["file05.txt"] = "bad checksum"
+	mfst.Data["file31.txt"] = "bad checksum"
+
+	// Errors should come out in the order of the file paths,
+	// however many workers there are.
+	for _, workers := range []int{1, 4, 0} {
+		mfst.SetWorkers(workers)
+		errList := mfst.RunChecksums()
+		if len(errList) != 2 {
+			t.Fatalf("Expected 2 errors with %d workers, got %d", workers, len(errList))
+		}
+		if !strings.Contains(errList[0].Error(), "file05.txt") ||
+			!strings.Contains(errList[1].Error(), "file31.txt") {
+			t.Errorf("Errors out of order with %d workers: %v", workers, errList)
+		}
+	}
+}
+
+func TestRunChecksumsContext(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_RUNCHECKSUMSCONTEXT_")
+	defer os.RemoveAll(dir)
+
+	mfst, _ := bagins.NewManifest(dir, "md5", bagins.PayloadManifest)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(test_string), 0644)
+		mfst.Data[name] = test_list["md5"]
+	}
+
+	var last bagins.Progress
+	mfst.SetProgressFunc(func(progress bagins.Progress) {
+		last = progress
+	})
+	if errList := mfst.RunChecksumsContext(context.Background()); len(errList) > 0 {
+		t.Fatalf("Unexpected errors: %v", errList)
+	}
+	total := int64(10 * len(test_string))
+	if last.Operation != bagins.CheckingFiles || last.FilesDone != 10 || last.FilesTotal != 10 ||
+		last.BytesDone != total || last.BytesTotal != total {
+		t.Errorf("Final progress report is wrong: %+v", last)
+	}
+
+	// A cancelled check should not report unchecked files as invalid.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errList := mfst.RunChecksumsContext(ctx)
+	if len(errList) != 1 || !errors.Is(errList[0], context.Canceled) {
+		t.Errorf("Expected only context.Canceled, got %v", errList)
+	}
+}
+
 func TestManifestCreate(t *testing.T) {
 	m, _ := bagins.NewManifest(os.TempDir(), "sha1", bagins.PayloadManifest)
 
@@ -180,7 +246,7 @@ func TestManifestName(t *testing.T) {
 	}
 	exp := filepath.Join(os.TempDir(), "manifest-sha1.txt")
 	if name := m.Name(); name != exp {
-		t.Error("Expected mainfest name %s but returned %s", exp, m.Name())
+		t.Errorf("Expected mainfest name %s but returned %s", exp, m.Name())
 	}
 }
 
@@ -207,4 +273,150 @@ func TestManifestToString(t *testing.T) {
 		t.Errorf("Manifest.ToString() returned %d characters, expected %d",
 			len(output), expectedLength)
 	}
+
+	// Lines are sorted by path.
+	expected := "CHECKSUM 0001 FileOne.txt\nCHECKSUM 0003 FileThree.txt\nCHECKSUM 0002 FileTwo.txt\n"
+	if output != expected {
+		t.Errorf("Expected sorted lines\n%s\ngot\n%s", expected, output)
+	}
+}
+
+func TestManifestDeterministicOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_MANIFEST_ORDER_")
+	defer os.RemoveAll(dir)
+	m, _ := bagins.NewManifest(dir, "md5", bagins.PayloadManifest)
+	for i := 0; i < 100; i++ {
+		m.Data[filepath.Join("data", fmt.Sprintf("dir%d", i%7), fmt.Sprintf("file%03d.txt", i))] = fmt.Sprintf("%032x", i)
+	}
+
+	var outputs []string
+	for i := 0; i < 3; i++ {
+		if err := m.Create(); err != nil {
+			t.Fatalf("Unexpected error writing manifest: %s", err)
+		}
+		data, _ := ioutil.ReadFile(m.Name())
+		outputs = append(outputs, string(data))
+	}
+	if outputs[0] != outputs[1] || outputs[1] != outputs[2] {
+		t.Error("Expected the manifest to be written the same way every time")
+	}
+	lines := strings.Split(strings.TrimSuffix(outputs[0], "\n"), "\n")
+	var paths []string
+	for _, line := range lines {
+		paths = append(paths, line[33:])
+	}
+	if len(lines) != 100 || !sort.StringsAreSorted(paths) || strings.Contains(outputs[0], "\\") {
+		t.Errorf("Expected 100 sorted lines with forward slashes, got\n%s", outputs[0])
+	}
+	if lines[0] != fmt.Sprintf("%032x data/dir0/file000.txt", 0) {
+		t.Errorf("Wrong first line %q", lines[0])
+	}
+
+	if err := m.SetLineEnding("\r"); err == nil {
+		t.Error("Expected an error setting an unsupported line ending")
+	}
+	if err := m.SetLineEnding(bagins.LineEndingCRLF); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.Create(); err != nil {
+		t.Fatalf("Unexpected error writing manifest: %s", err)
+	}
+	data, _ := ioutil.ReadFile(m.Name())
+	if strings.Count(string(data), "\r\n") != 100 || string(data) != strings.Replace(outputs[0], "\n", "\r\n", -1) {
+		t.Errorf("Expected CRLF line endings, got %q", data)
+	}
+	read, errs := bagins.ReadManifest(m.Name())
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors reading manifest: %v", errs)
+	}
+	if len(read.Data) != 100 || read.Data[filepath.Join("data", "dir0", "file000.txt")] != fmt.Sprintf("%032x", 0) {
+		t.Errorf("CRLF manifest was not read back correctly: %v", read.Data)
+	}
+}
+
+func TestReadManifestStrict(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "bag/manifest-md5.txt", strings.Join([]string{
+		FIXVALUE + "  data/good.txt",
+		"",
+		FIXVALUE,
+		"e4d909c290d0fb1ca068ffaddf22cbzz data/nothex.txt",
+		"e4d909c2 data/short.txt",
+		FIXVALUE + " ../outside.txt",
+		FIXVALUE + " /etc/passwd",
+		FIXVALUE + " data/good.txt",
+		FIXVALUE + "\tdata/tab.txt",
+	}, "\n")+"\n")
+
+	expected := []struct {
+		line    int
+		problem bagins.ParseProblem
+	}{
+		{2, bagins.BlankLine},
+		{3, bagins.MalformedLine},
+		{4, bagins.InvalidChecksum},
+		{5, bagins.InvalidChecksum},
+		{6, bagins.PathOutsideBag},
+		{7, bagins.PathOutsideBag},
+		{8, bagins.DuplicatePath},
+	}
+	m, errs := bagins.ReadManifestWithMode(fsys, "bag/manifest-md5.txt", bagins.ParseStrict)
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		var parseErr *bagins.ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError, got %v", err)
+			continue
+		}
+		if parseErr.File != "bag/manifest-md5.txt" || parseErr.Line != expected[i].line ||
+			parseErr.Problem != expected[i].problem {
+			t.Errorf("Expected %s on line %d, got %v", expected[i].problem, expected[i].line, parseErr)
+		}
+	}
+	if len(m.Data) != 2 || m.Data[filepath.Join("data", "good.txt")] != FIXVALUE ||
+		m.Data[filepath.Join("data", "tab.txt")] != FIXVALUE {
+		t.Errorf("Expected only the good lines in the manifest, got %v", m.Data)
+	}
+
+	// Lenient parsing accepts all of it, as it always has.
+	if _, errs := bagins.ReadManifestWithMode(fsys, "bag/manifest-md5.txt", bagins.ParseLenient); len(errs) > 0 {
+		t.Errorf("Unexpected errors parsing leniently: %v", errs)
+	}
+	if _, errs := bagins.ReadManifestWithMode(fsys, "bag/manifest-md5.txt", "picky"); len(errs) != 1 {
+		t.Errorf("Expected an error for an unknown parse mode, got %v", errs)
+	}
+}
+
+func TestManifestRegisteredAlgorithms(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	bagutil.RegisterHash("sha512-256", sha512.New512_256)
+	algorithms := []string{"sha3-256", "sha3-512", "sha512-256"}
+	bag, err := bagins.NewBagFS(fsys, ".", "sha3-bag", algorithms, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddFile("src/one.txt", "one.txt")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	strict := &bagins.ReadBagOptions{FileSystem: fsys, ParseMode: bagins.ParseStrict}
+	bag, err = bagins.ReadBagWithOptions("sha3-bag", []string{}, strict)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	for _, algo := range algorithms {
+		if bag.GetManifest(bagins.PayloadManifest, algo) == nil {
+			t.Errorf("Expected a %s payload manifest", algo)
+		}
+		if bag.GetManifest(bagins.TagManifest, algo) == nil {
+			t.Errorf("Expected a %s tag manifest", algo)
+		}
+	}
+	if report := bag.Validate(); !report.IsValid() {
+		t.Errorf("Expected the bag to be valid: %v", report.Problems)
+	}
 }
@@ -0,0 +1,184 @@
+package bagins
+
+/*
+
+"Old, old, older than the old trees in the Forest, he is."
+
+- Goldberry
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layout of the times in the tag file written by Bag.SetModTimeFile.
+const ModTimeLayout = time.RFC3339Nano
+
+// Sets whether Add and AddAll give each file they copy or reflink the
+// permission bits, access time and modification time of its source.
+// By default they don't, and copies get the current time and the
+// default mode. Hard linked files always share the metadata of their
+// source. Returns an error if preserve is true and the file system
+// does not implement MetadataFS.
+func (p *Payload) SetPreserveMetadata(preserve bool) error {
+	if _, ok := p.fsys.(MetadataFS); preserve && !ok {
+		return fmt.Errorf("Unable to preserve file metadata, the file system does not implement MetadataFS")
+	}
+	p.preserve = preserve
+	return nil
+}
+
+// Returns the modification times the files added to the payload had
+// when they were added, keyed by their path in the bag, as in the
+// manifests. Entries follow files moved or removed with Move and Remove.
+func (p *Payload) ModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(p.modTimes))
+	for pathInBag, modTime := range p.modTimes {
+		modTimes[pathInBag] = modTime
+	}
+	return modTimes
+}
+
+// Records the modification time of the file at srcPath, which was
+// added to the payload as dstPath.
+func (p *Payload) recordModTime(dstPath string, srcPath string) {
+	info, err := p.fsys.Stat(srcPath)
+	if err != nil {
+		return
+	}
+	if p.modTimes == nil {
+		p.modTimes = make(map[string]time.Time)
+	}
+	p.modTimes[filepath.Join("data", dstPath)] = info.ModTime()
+}
+
+// Drops the modification time recorded for dstPath, whose contents have
+// been replaced by something with no original time.
+func (p *Payload) forgetModTime(dstPath string) {
+	delete(p.modTimes, filepath.Join("data", dstPath))
+}
+
+// Gives dstFile the permission bits and times of the source file
+// described by srcInfo.
+func (p *Payload) copyMetadata(srcInfo fs.FileInfo, dstFile string) error {
+	mfs, ok := p.fsys.(MetadataFS)
+	if !ok {
+		return fmt.Errorf("Unable to preserve the metadata of %s, the file system "+
+			"does not implement MetadataFS", dstFile)
+	}
+	if err := mfs.Chmod(dstFile, srcInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return mfs.Chtimes(dstFile, accessTime(srcInfo), srcInfo.ModTime())
+}
+
+// Sets whether AddFile and AddDir keep the permission bits, access time
+// and modification time of the files they copy. See
+// Payload.SetPreserveMetadata.
+func (b *Bag) SetPreserveMetadata(preserve bool) error {
+	return b.payload.SetPreserveMetadata(preserve)
+}
+
+/*
+Makes Save write the original modification time of each payload file to
+the tag file name, relative to the bag root, so it can be restored after
+the bag is unpacked. Each line holds a time in ModTimeLayout, in UTC,
+then a space and the path of the file, with forward slashes. CR, LF and
+% in paths are percent-encoded as in BagIt 1.0 manifests. The lines are
+sorted by path.
+
+If the tag file already exists, the times in it are kept for files that
+are still in the payload manifests. Files added since then get the time
+they had when they were added. Files added with AddReader have no
+original time and are not listed. Pass an empty name to stop writing the
+file. Returns an error if the existing file can't be read.
+
+example:
+
+	err := b.SetModTimeFile("mtimes.txt")
+*/
+func (b *Bag) SetModTimeFile(name string) error {
+	if name != "" {
+		data, err := fs.ReadFile(b.fsys, filepath.Join(b.Path(), name))
+		if err == nil {
+			modTimes, err := parseModTimes(data)
+			if err != nil {
+				return err
+			}
+			if b.payload.modTimes == nil {
+				b.payload.modTimes = make(map[string]time.Time)
+			}
+			for pathInBag, modTime := range modTimes {
+				if _, ok := b.payload.modTimes[pathInBag]; !ok {
+					b.payload.modTimes[pathInBag] = modTime
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	b.modTimeFile = name
+	return nil
+}
+
+// Returns the original modification times of the payload files, keyed
+// by their path in the bag. Call SetModTimeFile first to read them from
+// a bag on disk. See Payload.ModTimes.
+func (b *Bag) ModTimes() map[string]time.Time {
+	return b.payload.ModTimes()
+}
+
+// Writes the tag file set with SetModTimeFile, listing the files in
+// the payload manifests.
+func (b *Bag) saveModTimes() error {
+	listed := make(map[string]bool)
+	for _, manifest := range b.GetManifests(PayloadManifest) {
+		for pathInBag := range manifest.Data {
+			listed[pathInBag] = true
+		}
+	}
+	paths := make([]string, 0, len(listed))
+	for pathInBag := range b.payload.modTimes {
+		if listed[pathInBag] {
+			paths = append(paths, pathInBag)
+		}
+	}
+	sort.Strings(paths)
+	var data bytes.Buffer
+	for _, pathInBag := range paths {
+		fmt.Fprintf(&data, "%s %s\n", b.payload.modTimes[pathInBag].UTC().Format(ModTimeLayout),
+			encodeManifestPath(filepath.ToSlash(pathInBag), BagItVersion10))
+	}
+	return writeFile(b.fsys, filepath.Join(b.Path(), b.modTimeFile), data.Bytes())
+}
+
+// Parses a tag file written by saveModTimes.
+func parseModTimes(data []byte) (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unable to parse modification time on line %d: %q", lineNum, line)
+		}
+		modTime, err := time.Parse(ModTimeLayout, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse modification time on line %d: %w", lineNum, err)
+		}
+		modTimes[filepath.FromSlash(decodeManifestPath(fields[1]))] = modTime
+	}
+	return modTimes, scanner.Err()
+}
@@ -0,0 +1,132 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadPreserveMetadata(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("", "_GOTEST_PRESERVE_SRC_")
+	defer os.RemoveAll(srcDir)
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, name := range []string{"one.txt", "sub/two.txt"} {
+		srcFile := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(srcFile), 0755)
+		ioutil.WriteFile(srcFile, []byte(FIXSTRING), 0644)
+		os.Chmod(srcFile, 0640)
+		os.Chtimes(srcFile, modTime, modTime)
+	}
+
+	for _, preserve := range []bool{true, false} {
+		pDir, _ := ioutil.TempDir("", "_GOTEST_PRESERVE_")
+		defer os.RemoveAll(pDir)
+		p, _ := bagins.NewPayload(pDir)
+		m, _ := bagins.NewManifest(pDir, "md5", bagins.PayloadManifest)
+		if err := p.SetPreserveMetadata(preserve); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, errs := p.AddAll(srcDir, []*bagins.Manifest{m}); len(errs) > 0 {
+			t.Fatalf("Unexpected errors adding files: %v", errs)
+		}
+		for _, name := range []string{"one.txt", "sub/two.txt"} {
+			info, err := os.Stat(filepath.Join(pDir, name))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if preserve != info.ModTime().Equal(modTime) {
+				t.Errorf("preserve %v: wrong modification time for %s: %s", preserve, name, info.ModTime())
+			}
+			if preserve && info.Mode().Perm() != 0640 {
+				t.Errorf("Expected %s to have mode 0640, got %o", name, info.Mode().Perm())
+			}
+			// The original times are recorded either way.
+			if recorded := p.ModTimes()[filepath.Join("data", name)]; !recorded.Equal(modTime) {
+				t.Errorf("preserve %v: wrong recorded time for %s: %s", preserve, name, recorded)
+			}
+		}
+	}
+
+	p, _ := bagins.NewPayloadFS(bagins.NewReadOnlyFileSystem(os.DirFS(srcDir)), ".")
+	if err := p.SetPreserveMetadata(true); err == nil {
+		t.Error("Expected an error preserving metadata on a file system without MetadataFS")
+	}
+}
+
+func TestBagModTimeFile(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	modTimes := map[string]time.Time{
+		"src/one.txt":      time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC),
+		"src/sub/two.txt":  time.Date(2002, 3, 4, 5, 6, 7, 500, time.UTC),
+		"src/100% new.txt": time.Date(2003, 4, 5, 6, 7, 8, 0, time.FixedZone("EST", -5*3600)),
+	}
+	for name, modTime := range modTimes {
+		writeMemFile(t, fsys, name, FIXSTRING)
+		fsys.Chtimes(name, modTime, modTime)
+	}
+
+	bag, err := bagins.NewBagFS(fsys, ".", "mtime-bag", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	if err := bag.SetModTimeFile("mtimes.txt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if errs := bag.AddDir("src"); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	if err := bag.MoveFile("sub/two.txt", "moved/two.txt"); err != nil {
+		t.Fatalf("Unexpected error moving file: %s", err)
+	}
+	if err := bag.AddReader(strings.NewReader(FIXSTRING), "streamed.txt"); err != nil {
+		t.Fatalf("Unexpected error adding from a reader: %s", err)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	data, _ := fs.ReadFile(fsys, "mtime-bag/mtimes.txt")
+	expected := strings.Join([]string{
+		"2003-04-05T11:07:08Z data/100%25 new.txt",
+		"2002-03-04T05:06:07.0000005Z data/moved/two.txt",
+		"2001-02-03T04:05:06Z data/one.txt",
+	}, "\n") + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected mtimes.txt to be\n%s\ngot\n%s", expected, data)
+	}
+	if _, ok := bag.GetManifest(bagins.TagManifest, "md5").Data["mtimes.txt"]; !ok {
+		t.Error("Expected mtimes.txt in the tag manifest")
+	}
+
+	bag, err = bagins.ReadBagFS(fsys, "mtime-bag", []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if err := bag.SetModTimeFile("mtimes.txt"); err != nil {
+		t.Fatalf("Unexpected error reading mtimes.txt: %s", err)
+	}
+	read := bag.ModTimes()
+	for name, pathInBag := range map[string]string{
+		"src/one.txt":      "data/one.txt",
+		"src/sub/two.txt":  "data/moved/two.txt",
+		"src/100% new.txt": "data/100% new.txt",
+	} {
+		if !read[filepath.FromSlash(pathInBag)].Equal(modTimes[name]) {
+			t.Errorf("Wrong time read for %s: %s", pathInBag, read[filepath.FromSlash(pathInBag)])
+		}
+	}
+
+	// Update should forget the times of files that have been removed.
+	fsys.Remove("mtime-bag/data/one.txt")
+	if _, errs := bag.Update(nil); len(errs) > 0 {
+		t.Fatalf("Unexpected errors updating bag: %v", errs)
+	}
+	if _, ok := bag.ModTimes()[filepath.Join("data", "one.txt")]; ok {
+		t.Error("Expected the time of the removed file to be forgotten")
+	}
+}
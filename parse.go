@@ -0,0 +1,141 @@
+package bagins
+
+/*
+
+"It's the job that's never started as takes longest to finish."
+
+- Samwise Gamgee
+
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/APTrust/bagins/bagutil"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ParseMode sets how strictly manifests are parsed when a bag is read.
+// See ReadBagOptions and ReadManifestWithMode.
+type ParseMode string
+
+const (
+	// Every line is accepted, as bagins always has. Blank and malformed
+	// lines are read as best they can be, and a path listed twice keeps
+	// its last checksum. This is the default.
+	ParseLenient ParseMode = "lenient"
+	// Each line must be a valid checksum for the manifest's algorithm,
+	// whitespace and a path inside the bag, and each path may only be
+	// listed once. Every line that is not is reported as a *ParseError.
+	ParseStrict ParseMode = "strict"
+)
+
+// ParseProblem says what is wrong with a line reported in a ParseError.
+type ParseProblem string
+
+const (
+	MalformedLine      ParseProblem = "malformed_line"       // Not a checksum, whitespace and a path
+	BlankLine          ParseProblem = "blank_line"           // Empty, or only whitespace
+	InvalidChecksum    ParseProblem = "invalid_checksum"     // Not hex, or the wrong length for the algorithm
+	DuplicatePath      ParseProblem = "duplicate_path"       // Listed on an earlier line too
+	PathOutsideBag     ParseProblem = "path_outside_bag"     // Absolute, or leads out of the bag with ..
+	InvalidLength      ParseProblem = "invalid_length"       // A fetch.txt length that is not a number or -
+	PathOutsidePayload ParseProblem = "path_outside_payload" // A fetch.txt path that is not under data/
+)
+
+// ParseError describes a line that could not be parsed in a manifest
+// read in ParseStrict mode, in fetch.txt or in a tag file. Use errors.As
+// to find them in the errors returned by ReadBagWithOptions and the
+// other functions that read those files.
+type ParseError struct {
+	File    string       // Path of the file being parsed
+	Line    int          // Line number, counting from 1
+	Problem ParseProblem // What is wrong with the line
+	Detail  string       // Description of the problem
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s line %d: %s", e.File, e.Line, e.Detail)
+}
+
+// Returns an error unless mode is empty or one of the ParseMode constants.
+func validateParseMode(mode ParseMode) error {
+	switch mode {
+	case "", ParseLenient, ParseStrict:
+		return nil
+	}
+	return fmt.Errorf("Unknown parse mode '%s'. Must be %s or %s", mode, ParseLenient, ParseStrict)
+}
+
+// Parses the manifest name, read from file, in mode. hashName is the
+// manifest's algorithm.
+func parseManifest(file io.Reader, name string, hashName string, bagItVersion string, mode ParseMode) (map[string]string, []error) {
+	if mode == ParseStrict {
+		return parseManifestStrict(file, name, hashName, bagItVersion)
+	}
+	return parseManifestData(file, bagItVersion)
+}
+
+var (
+	strictManifestLine = regexp.MustCompile(`^(\S+)[ \t]+(\S.*)$`)
+	hexDigest          = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// Parses a manifest as parseManifestData does, returning a ParseError
+// for each line that breaks the rules of ParseStrict. Lines with errors
+// are left out of the data.
+func parseManifestStrict(file io.Reader, name string, hashName string, bagItVersion string) (map[string]string, []error) {
+	var errs []error
+	digestLen := 0
+	if hashFunc, err := bagutil.LookupHash(hashName); err == nil {
+		digestLen = hashFunc().Size() * 2
+	}
+	problem := func(line int, kind ParseProblem, format string, args ...interface{}) {
+		errs = append(errs, &ParseError{File: name, Line: line, Problem: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	scanner := bufio.NewScanner(file)
+	values := make(map[string]string)
+	lines := make(map[string]int)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			problem(lineNum, BlankLine, "blank line")
+			continue
+		}
+		data := strictManifestLine.FindStringSubmatch(line)
+		if data == nil {
+			problem(lineNum, MalformedLine, "expected a checksum, whitespace and a path, got %q", line)
+			continue
+		}
+		checksum, pathInBag := data[1], data[2]
+		if bagItVersion == BagItVersion10 {
+			pathInBag = decodeManifestPath(pathInBag)
+		}
+		if !hexDigest.MatchString(checksum) {
+			problem(lineNum, InvalidChecksum, "checksum %q is not hexadecimal", checksum)
+			continue
+		}
+		if digestLen > 0 && len(checksum) != digestLen {
+			problem(lineNum, InvalidChecksum, "%s checksum %q has %d digits, expected %d",
+				hashName, checksum, len(checksum), digestLen)
+			continue
+		}
+		if isOutsideBag(pathInBag) {
+			problem(lineNum, PathOutsideBag, "path %q is outside the bag", pathInBag)
+			continue
+		}
+		if first, ok := lines[pathInBag]; ok {
+			problem(lineNum, DuplicatePath, "path %q is already listed on line %d", pathInBag, first)
+			continue
+		}
+		lines[pathInBag] = lineNum
+		values[pathInBag] = checksum
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("Unable to read %s: %w", name, err))
+	}
+	return values, errs
+}
@@ -9,27 +9,48 @@ package bagins
 */
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Payloads describes a filepath location to serve as the data directory of
 // a Bag and methods around managing content inside of it.
 type Payload struct {
-	dir string // Path of the payload directory to manage.
+	dir        string                    // Path of the payload directory to manage.
+	fsys       FileSystem                // File system the payload directory is on.
+	workers    int                       // Number of files AddAll adds at once, 0 for one per CPU.
+	progress   ProgressFunc              // Called by AddAll to report progress, may be nil.
+	ingest     IngestStrategy            // How Add and AddAll put files into the payload.
+	strategies map[string]IngestStrategy // Strategy used for each file added, by path in the bag.
+	filter     *Filter                   // Chooses the files AddAll adds, nil for all of them.
+	skipped    []SkippedFile             // Files the filter or symlink policy skipped.
+	symlinks   SymlinkPolicy             // What is done with symbolic links, "" for SymlinkFollow.
+	preserve   bool                      // Copy the mode and times of source files.
+	modTimes   map[string]time.Time      // Original modification times, by path in the bag.
 }
 
 // Returns a new Payload struct managing the path provied.
 func NewPayload(location string) (*Payload, error) {
-	if _, err := os.Stat(filepath.Clean(location)); os.IsNotExist(err) {
-		return nil, fmt.Errorf("Payload directory does not exist! Returned: %v", err)
+	return NewPayloadFS(OSFileSystem{}, location)
+}
+
+// Returns a new Payload struct managing the path provided in fsys.
+// Source files passed to Add and AddAll are read from fsys as well.
+func NewPayloadFS(fsys FileSystem, location string) (*Payload, error) {
+	if _, err := fsys.Stat(filepath.Clean(location)); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Payload directory does not exist! Returned: %w", err)
 	}
 	p := new(Payload)
 	p.dir = filepath.Clean(location)
+	p.fsys = fsys
 	return p, nil
 }
 
@@ -37,6 +58,88 @@ func (p *Payload) Name() string {
 	return p.dir
 }
 
+// Sets the number of files AddAll copies and hashes at the same time.
+// Zero or less means one per CPU, which is the default. Set it to 1 to
+// add files one at a time, which may be faster on spinning disks.
+func (p *Payload) SetWorkers(workers int) {
+	p.workers = workers
+}
+
+// Returns the number of files AddAll copies and hashes at the same time.
+func (p *Payload) Workers() int {
+	return workerCount(p.workers)
+}
+
+// Sets how Add and AddAll put files into the payload directory. The
+// default is IngestCopy. IngestHardLink and IngestReflink fall back to
+// copying any file they can't link, and files are hashed however they
+// are added. Use IngestStrategies to see what was done with each file.
+func (p *Payload) SetIngestStrategy(strategy IngestStrategy) {
+	p.ingest = strategy
+}
+
+// Returns the strategy used for each file added to the payload by Add
+// and AddAll, keyed by its path in the bag, as in the manifests.
+func (p *Payload) IngestStrategies() map[string]IngestStrategy {
+	strategies := make(map[string]IngestStrategy, len(p.strategies))
+	for pathInBag, strategy := range p.strategies {
+		strategies[pathInBag] = strategy
+	}
+	return strategies
+}
+
+// Records the strategy used to add the file at dstPath.
+func (p *Payload) recordStrategy(dstPath string, strategy IngestStrategy) {
+	if p.strategies == nil {
+		p.strategies = make(map[string]IngestStrategy)
+	}
+	p.strategies[filepath.Join("data", dstPath)] = strategy
+}
+
+// Sets the filter that chooses which files AddAll adds. Pass nil, the
+// default, to add every file. Returns an error, and leaves the filter
+// as it was, if any of its patterns are malformed.
+func (p *Payload) SetFilter(filter *Filter) error {
+	if filter != nil {
+		if err := filter.validate(); err != nil {
+			return err
+		}
+	}
+	p.filter = filter
+	return nil
+}
+
+// Sets what Add, AddAll and OctetStreamSum do with symbolic links. The
+// default is SymlinkFollow. Returns an error, and leaves the policy as
+// it was, if policy is not one of the SymlinkPolicy constants.
+func (p *Payload) SetSymlinkPolicy(policy SymlinkPolicy) error {
+	if err := validateSymlinkPolicy(policy); err != nil {
+		return err
+	}
+	p.symlinks = policy
+	return nil
+}
+
+// Returns what is done with symbolic links. See SetSymlinkPolicy.
+func (p *Payload) SymlinkPolicy() SymlinkPolicy {
+	if p.symlinks == "" {
+		return SymlinkFollow
+	}
+	return p.symlinks
+}
+
+// Returns the files and directories skipped by the filter or the
+// symlink policy in calls to Add and AddAll, in the order they were found.
+func (p *Payload) SkippedFiles() []SkippedFile {
+	return append([]SkippedFile{}, p.skipped...)
+}
+
+// Sets a function that AddAll and AddAllContext report their progress
+// to. Pass nil to stop reporting progress.
+func (p *Payload) SetProgressFunc(fn ProgressFunc) {
+	p.progress = fn
+}
+
 // Adds the file at srcPath to the payload directory as dstPath and returns
 // a checksum value as calulated by the provided hash. This function also
 // writes the checksums into the proper manifests, so you don't have to.
@@ -54,13 +157,129 @@ func (p *Payload) Name() string {
 //
 // checksums["md5"] = "0a0a0a0a"
 // checksums["sha256"] = "0b0b0b0b"
+//
+// If srcPath is a symbolic link, the symlink policy is applied with the
+// directory holding srcPath as the root, so a followed or preserved link
+// must point inside it. A skipped link returns nil checksums and no error.
 func (p *Payload) Add(srcPath string, dstPath string, manifests []*Manifest) (map[string]string, error) {
+	var checksums map[string]string
+	var strategy IngestStrategy
+	var err error
+	if isSymlink(p.fsys, srcPath) {
+		w := newLinkWalker(p.fsys, filepath.Dir(srcPath), p.symlinks)
+		switch w.policy {
+		case SymlinkSkip:
+			p.skipped = append(p.skipped, SkippedFile{Path: srcPath, Reason: SkippedSymlink})
+			return nil, nil
+		case SymlinkPreserve:
+			checksums, strategy, err = p.preserveLink(context.Background(), w, srcPath, dstPath, manifests, nil)
+		default:
+			if _, _, err = w.target(srcPath); err == nil || errors.Is(err, fs.ErrNotExist) {
+				checksums, strategy, err = p.copyAndHash(context.Background(), srcPath, dstPath, manifests, nil)
+			}
+		}
+	} else {
+		checksums, strategy, err = p.copyAndHash(context.Background(), srcPath, dstPath, manifests, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		manifest.Data[filepath.Join("data", dstPath)] = checksums[manifest.Algorithm()]
+	}
+	p.recordStrategy(dstPath, strategy)
+	p.recordModTime(dstPath, srcPath)
+	return checksums, nil
+}
 
-	src, err := os.Open(srcPath)
+// Writes the contents of r to the payload directory as dstPath, and
+// returns their checksums with the algorithm of each of manifests, as
+// Add does. Use it to bag content that doesn't come from a file, such
+// as an HTTP response body, without writing a temporary file first.
+//
+// The content is written to a temporary file next to dstPath, which is
+// renamed to dstPath once all of it has been read, so a failed read
+// leaves any existing file at dstPath as it was. dstPath must be inside
+// the payload directory. The content has no original modification time,
+// so it is left out of ModTimes and the tag file set with
+// Bag.SetModTimeFile.
+func (p *Payload) AddReader(r io.Reader, dstPath string, manifests []*Manifest) (map[string]string, error) {
+	return p.AddReaderContext(context.Background(), r, dstPath, -1, manifests)
+}
+
+// Performs AddReader, stopping when ctx is done. If size is zero or
+// more, it is the number of bytes r should hold. It is reported as the
+// total to the function set with SetProgressFunc, and an error is
+// returned if r holds a different number of bytes. Pass -1 if the size
+// is not known.
+func (p *Payload) AddReaderContext(ctx context.Context, r io.Reader, dstPath string, size int64, manifests []*Manifest) (map[string]string, error) {
+	dstPath, err := payloadRelPath(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	dstFile := filepath.Join(p.dir, dstPath)
+	if err := p.fsys.MkdirAll(filepath.Dir(dstFile), 0766); err != nil {
+		return nil, err
+	}
+	tmpFile, err := tempFileName(p.fsys, filepath.Dir(dstFile), ".bagins-reader-")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := p.fsys.Create(tmpFile)
 	if err != nil {
 		return nil, err
 	}
+
+	hashes := make(map[string]hash.Hash)
+	writers := []io.Writer{dst}
+	for _, m := range manifests {
+		hsh := m.hashFunc()
+		hashes[m.Algorithm()] = hsh
+		writers = append(writers, hsh)
+	}
+	tracker := newProgressTracker(p.progress, AddingFiles, 1, max(size, 0))
+	n, err := io.Copy(io.MultiWriter(writers...), &trackingReader{ctx: ctx, reader: r, tracker: tracker, path: dstPath})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("Read %d bytes for %s, but expected %d", n, dstPath, size)
+	}
+	if err == nil {
+		err = p.fsys.Rename(tmpFile, dstFile)
+	}
+	if err != nil {
+		p.fsys.Remove(tmpFile)
+		return nil, err
+	}
+	tracker.fileDone(dstPath)
+
+	checksums := make(map[string]string)
+	for name, hsh := range hashes {
+		checksums[name] = fmt.Sprintf("%x", hsh.Sum(nil))
+	}
+	for _, manifest := range manifests {
+		manifest.Data[filepath.Join("data", dstPath)] = checksums[manifest.Algorithm()]
+	}
+	p.recordStrategy(dstPath, IngestCopy)
+	p.forgetModTime(dstPath)
+	return checksums, nil
+}
+
+// Does the work of Add, without changing the manifests, so that
+// it is safe to call from more than one goroutine. Stops when ctx is
+// done, and removes the partly written copy or the link if the copy
+// or hashing fails. Returns the strategy used to add the file.
+func (p *Payload) copyAndHash(ctx context.Context, srcPath string, dstPath string, manifests []*Manifest, tracker *progressTracker) (map[string]string, IngestStrategy, error) {
+	src, err := p.fsys.Open(srcPath)
+	if err != nil {
+		return nil, "", err
+	}
 	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return nil, "", err
+	}
 
 	dstFile := filepath.Join(p.dir, dstPath)
 
@@ -68,11 +287,11 @@ func (p *Payload) Add(srcPath string, dstPath string, manifests []*Manifest) (ma
 
 	absSrcPath, err := filepath.Abs(srcPath)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	absDestPath, err := filepath.Abs(dstFile)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	hashWriters := make([]io.Writer, 0)
@@ -90,48 +309,81 @@ func (p *Payload) Add(srcPath string, dstPath string, manifests []*Manifest) (ma
 	}
 
 	// If src and dst are the same, copying with destroy the src.
-	// Just compute the hash.
-	if absSrcPath == absDestPath {
-		wrtr = io.MultiWriter(hashWriters...)
-	} else {
+	// Just compute the hash. The same goes for files that could be
+	// linked into the payload.
+	var dst io.WriteCloser
+	strategy := IngestInPlace
+	if absSrcPath != absDestPath {
 		// TODO simplify this! returns on windows paths are messing with me so I'm
 		// going through this step wise.
-		if err := os.MkdirAll(filepath.Dir(dstFile), 0766); err != nil {
-			return nil, err
+		if err := p.fsys.MkdirAll(filepath.Dir(dstFile), 0766); err != nil {
+			return nil, "", err
 		}
-		dst, err := os.Create(dstFile)
+		strategy = p.linkFile(p.ingest, srcPath, dstFile)
+	}
+	if strategy != IngestCopy {
+		wrtr = io.MultiWriter(hashWriters...)
+		if strategy != IngestInPlace {
+			defer func() {
+				if err != nil {
+					p.fsys.Remove(dstFile)
+				}
+			}()
+		}
+	} else {
+		// Create would empty the source if the old file is a hard link to it.
+		if srcInfo, err := p.fsys.Stat(srcPath); err == nil {
+			if dstInfo, err := p.fsys.Stat(dstFile); err == nil && os.SameFile(srcInfo, dstInfo) {
+				p.fsys.Remove(dstFile)
+			}
+		}
+		dst, err = p.fsys.Create(dstFile)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		// Append the destination file to our group of hashWriters,
 		// so the file actually gets copied.
 		hashWriters = append(hashWriters, dst)
 		wrtr = io.MultiWriter(hashWriters...)
-		defer dst.Close()
+		defer func() {
+			dst.Close()
+			if err != nil {
+				p.fsys.Remove(dstFile)
+			}
+		}()
 	}
 
 	// Copy the file and compute the hashes. Note that if src and dest
 	// are the same, we're only only computing the hash without actually
 	// copying the bits.
-	_, err = io.Copy(wrtr, src)
+	_, err = io.Copy(wrtr, &trackingReader{ctx: ctx, reader: src, tracker: tracker, path: dstPath})
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	tracker.fileDone(dstPath)
+
+	// A hard link already shares the metadata of the source.
+	if p.preserve && (strategy == IngestCopy || strategy == IngestReflink) {
+		if dst != nil {
+			// Writing changes the times, so the copy is finished first.
+			if err = dst.Close(); err != nil {
+				return nil, "", err
+			}
+		}
+		if err = p.copyMetadata(srcInfo, dstFile); err != nil {
+			return nil, "", err
+		}
 	}
 
 	// Calculate the checksums in hex format, so we can return them
 	// and write them into the manifests.
 	checksums := make(map[string]string)
 	for index := range hashFunctions {
-		manifest := manifests[index]
 		name := hashFunctionNames[index]
 		hashFunc := hashFunctions[index]
-		digest := fmt.Sprintf("%x", hashFunc.Sum(nil))
-		checksums[name] = digest
-
-		// Add the path and digest to the manifest
-		manifest.Data[filepath.Join("data", dstPath)] = digest
+		checksums[name] = fmt.Sprintf("%x", hashFunc.Sum(nil))
 	}
-	return checksums, err
+	return checksums, strategy, err
 }
 
 // Performs an add on every file under the directory supplied to the
@@ -149,51 +401,285 @@ func (p *Payload) Add(srcPath string, dstPath string, manifests []*Manifest) (ma
 // checksums["file1.txt"] = { "md5": "0a0a0a0a", "sha256": "0b0b0b0b" }
 // checksums["file2.xml"] = { "md5": "1a1a1a1a", "sha256": "1b1b1b1b" }
 // checksums["file3.jpg"] = { "md5": "2a2a2a2a", "sha256": "2b2b2b2b" }
+//
+// Files are copied and hashed by a pool of workers, see SetWorkers.
+// The results and errors are the same however many workers there are,
+// and errors are returned in the order the files were found.
+//
+// Symbolic links are handled by the symlink policy, see
+// SetSymlinkPolicy, with src as the root that followed and preserved
+// links must point inside. Each link the policy does not allow is
+// returned as an error, and the other files are still added.
 func (p *Payload) AddAll(src string, manifests []*Manifest) (checksums map[string]map[string]string, errs []error) {
+	return p.AddAllContext(context.Background(), src, manifests)
+}
+
+// Performs AddAll, reporting progress to the function set with
+// SetProgressFunc. When ctx is done, AddAllContext stops starting new
+// files, removes any file it was part way through copying, and returns
+// ctx.Err() as the last error. Files that were finished stay in the
+// payload and manifests, and are in the returned checksums.
+func (p *Payload) AddAllContext(ctx context.Context, src string, manifests []*Manifest) (checksums map[string]map[string]string, errs []error) {
 
 	checksums = make(map[string]map[string]string)
 
 	// Collect files to add in scr directory.
 	var files []string
-	visit := func(pth string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+	var links []bool
+	var bytesTotal int64
+	walker := newLinkWalker(p.fsys, src, p.symlinks)
+	visit := func(pth string, d fs.DirEntry, err error) error {
+		if err != nil && !isSymlinkError(err) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pth != src {
+			relPath := filepath.ToSlash(strings.TrimLeft(strings.TrimPrefix(pth, src), string(filepath.Separator)))
+			if reason := p.filter.skip(relPath, d); reason != "" {
+				p.skipped = append(p.skipped, SkippedFile{Path: pth, Reason: reason, IsDir: d.IsDir()})
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if err != nil {
+			// A link the symlink policy doesn't allow.
+			errs = append(errs, err)
+			return nil
+		}
+		if !d.IsDir() {
 			files = append(files, pth)
+			links = append(links, d.Type()&fs.ModeSymlink != 0)
+			if info, err := d.Info(); err == nil {
+				bytesTotal += info.Size()
+			}
 		}
-		return err
+		return nil
 	}
 
-	if err := filepath.Walk(src, visit); err != nil {
+	skipLink := func(pth string, d fs.DirEntry) {
+		p.skipped = append(p.skipped, SkippedFile{Path: pth, Reason: SkippedSymlink})
+	}
+	if err := walker.walk(visit, skipLink); err != nil {
 		errs = append(errs, err)
+		if ctx.Err() != nil {
+			return checksums, errs
+		}
 	}
 
-	for _, file := range files {
+	tracker := newProgressTracker(p.progress, AddingFiles, len(files), bytesTotal)
+	results := make([]map[string]string, len(files))
+	strategies := make([]IngestStrategy, len(files))
+	fileErrs := make([]error, len(files))
+	started := make([]bool, len(files))
+	runWorkers(ctx, p.workers, len(files), func(i int) {
+		started[i] = true
+		dstPath := strings.TrimPrefix(files[i], src)
+		if links[i] && walker.policy == SymlinkPreserve {
+			results[i], strategies[i], fileErrs[i] = p.preserveLink(ctx, walker, files[i], dstPath, manifests, tracker)
+		} else {
+			results[i], strategies[i], fileErrs[i] = p.copyAndHash(ctx, files[i], dstPath, manifests, tracker)
+		}
+	})
+
+	// Update the manifests here rather than in the workers,
+	// since their Data maps are not safe for concurrent use.
+	for i, file := range files {
 		dstPath := strings.TrimPrefix(file, src)
-		fixities, err := p.Add(file, dstPath, manifests)
-		if err != nil {
-			errs = append(errs, err)
+		if !started[i] || (fileErrs[i] != nil && ctx.Err() != nil) {
+			continue
+		}
+		if fileErrs[i] != nil {
+			errs = append(errs, fileErrs[i])
+			results[i] = nil
+		} else {
+			for _, manifest := range manifests {
+				manifest.Data[filepath.Join("data", dstPath)] = results[i][manifest.Algorithm()]
+			}
+			p.recordStrategy(dstPath, strategies[i])
+			p.recordModTime(dstPath, file)
 		}
-		checksums[dstPath] = fixities
+		checksums[dstPath] = results[i]
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
 	}
 
 	return
 }
 
+// Removes the file or directory at dstPath, relative to the payload
+// directory, and the manifest entries for everything it held. The
+// manifests are only changed once the files are gone. A directory is
+// first renamed out of the way, so if it cannot be removed completely
+// it is put back as it was and an error is returned.
+//
+// Param manifests should be a slice of payload manifests, as for Add.
+func (p *Payload) Remove(dstPath string, manifests []*Manifest) error {
+	dstPath, err := payloadRelPath(dstPath)
+	if err != nil {
+		return err
+	}
+	absPath := filepath.Join(p.dir, dstPath)
+	info, err := lstat(p.fsys, absPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := p.fsys.Remove(absPath); err != nil {
+			return err
+		}
+	} else {
+		tmpPath, err := tempFileName(p.fsys, p.dir, ".bagins-remove-")
+		if err != nil {
+			return err
+		}
+		if err := p.fsys.Rename(absPath, tmpPath); err != nil {
+			return err
+		}
+		if err := removeAll(p.fsys, tmpPath); err != nil {
+			if rbErr := p.fsys.Rename(tmpPath, absPath); rbErr != nil {
+				return fmt.Errorf("Unable to remove %s: %w. Unable to put it back from %s: %w",
+					dstPath, err, tmpPath, rbErr)
+			}
+			return err
+		}
+	}
+	pathInBag := filepath.Join("data", dstPath)
+	for _, manifest := range manifests {
+		for key := range manifest.Data {
+			if key == pathInBag || strings.HasPrefix(key, pathInBag+string(filepath.Separator)) {
+				delete(manifest.Data, key)
+			}
+		}
+	}
+	for key := range p.modTimes {
+		if key == pathInBag || strings.HasPrefix(key, pathInBag+string(filepath.Separator)) {
+			delete(p.modTimes, key)
+		}
+	}
+	return nil
+}
+
+// Moves the file or directory at srcPath to dstPath, both relative to
+// the payload directory, and renames the manifest entries for
+// everything it held. dstPath must not exist yet, and any directories
+// it needs are created. The manifests are only changed once the move
+// has succeeded, and directories created for a move that fails are
+// removed again.
+//
+// Param manifests should be a slice of payload manifests, as for Add.
+func (p *Payload) Move(srcPath string, dstPath string, manifests []*Manifest) error {
+	srcPath, err := payloadRelPath(srcPath)
+	if err != nil {
+		return err
+	}
+	dstPath, err = payloadRelPath(dstPath)
+	if err != nil {
+		return err
+	}
+	absSrc := filepath.Join(p.dir, srcPath)
+	absDst := filepath.Join(p.dir, dstPath)
+	if _, err := p.fsys.Stat(absSrc); err != nil {
+		return err
+	}
+	if _, err := p.fsys.Stat(absDst); err == nil {
+		return fmt.Errorf("Unable to move %s to %s, %s already exists", srcPath, dstPath, dstPath)
+	}
+
+	// Note which directories have to be made, so they can be
+	// removed again if the move fails.
+	var created []string
+	for dir := filepath.Dir(absDst); dir != p.dir; dir = filepath.Dir(dir) {
+		if _, err := p.fsys.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	if err := p.fsys.MkdirAll(filepath.Dir(absDst), 0766); err != nil {
+		return err
+	}
+	if err := p.fsys.Rename(absSrc, absDst); err != nil {
+		for _, dir := range created {
+			p.fsys.Remove(dir)
+		}
+		return err
+	}
+
+	srcInBag := filepath.Join("data", srcPath)
+	dstInBag := filepath.Join("data", dstPath)
+	for _, manifest := range manifests {
+		moved := make(map[string]string)
+		for key, sum := range manifest.Data {
+			if key == srcInBag {
+				moved[dstInBag] = sum
+			} else if strings.HasPrefix(key, srcInBag+string(filepath.Separator)) {
+				moved[dstInBag+key[len(srcInBag):]] = sum
+			} else {
+				continue
+			}
+			delete(manifest.Data, key)
+		}
+		for key, sum := range moved {
+			manifest.Data[key] = sum
+		}
+	}
+	moved := make(map[string]time.Time)
+	for key, modTime := range p.modTimes {
+		if key == srcInBag {
+			moved[dstInBag] = modTime
+		} else if strings.HasPrefix(key, srcInBag+string(filepath.Separator)) {
+			moved[dstInBag+key[len(srcInBag):]] = modTime
+		} else {
+			continue
+		}
+		delete(p.modTimes, key)
+	}
+	for key, modTime := range moved {
+		p.modTimes[key] = modTime
+	}
+	return nil
+}
+
+// Cleans a path relative to the payload directory, and returns an error
+// if it is empty or points outside the payload directory.
+func payloadRelPath(pathInPayload string) (string, error) {
+	cleaned := filepath.Clean(pathInPayload)
+	if cleaned == "." || filepath.IsAbs(cleaned) || cleaned == ".." ||
+		strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path '%s'. Must be relative to the payload directory "+
+			"and inside it", pathInPayload)
+	}
+	return cleaned, nil
+}
+
 // Returns the octetstream sum and number of files of all the files in the
 // payload directory.  See the BagIt specification "Oxsum" field of the
-// bag-info.txt file for more information.
+// bag-info.txt file for more information. Symbolic links are counted as
+// the symlink policy says, with the payload directory as the root.
 func (p *Payload) OctetStreamSum() (int64, int) {
 	var sum int64
 	var count int
 
-	visit := func(pth string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+	visit := func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
 			sum = sum + info.Size()
 			count = count + 1
 		}
-		return err
+		return nil
 	}
 
-	filepath.Walk(p.dir, visit)
+	newLinkWalker(p.fsys, p.dir, p.symlinks).walk(visit, nil)
 
 	return sum, count
 }
@@ -1,12 +1,18 @@
 package bagins_test
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
+	"fmt"
 	"github.com/APTrust/bagins"
 	"github.com/APTrust/bagins/bagutil"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -147,6 +153,125 @@ func TestPayloadAddAll(t *testing.T) {
 
 }
 
+func TestPayloadAddAllWorkers(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllWorkers_SRCDIR_")
+	defer os.RemoveAll(srcDir)
+	for i := 0; i < 50; i++ {
+		ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("file%02d.txt", i)),
+			[]byte(strings.Repeat("x", i)), 0644)
+	}
+	// An unreadable file should produce an error without
+	// stopping the other files from being added.
+	os.Symlink(filepath.Join(srcDir, "does-not-exist"), filepath.Join(srcDir, "file99.txt"))
+
+	var results []map[string]map[string]string
+	var manifests []*bagins.Manifest
+	for _, workers := range []int{1, 8} {
+		pDir, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllWorkers_")
+		defer os.RemoveAll(pDir)
+		m, _ := bagins.NewManifest(os.TempDir(), "sha256", bagins.PayloadManifest)
+		p, _ := bagins.NewPayload(pDir)
+		p.SetWorkers(workers)
+		if p.Workers() != workers {
+			t.Errorf("Expected %d workers, got %d", workers, p.Workers())
+		}
+		checksums, errs := p.AddAll(srcDir, []*bagins.Manifest{m})
+		if len(errs) != 1 {
+			t.Errorf("Expected 1 error with %d workers, got %d: %v", workers, len(errs), errs)
+		}
+		results = append(results, checksums)
+		manifests = append(manifests, m)
+	}
+
+	// The results should be the same however many workers there are.
+	if len(results[1]) != 51 || len(manifests[1].Data) != 50 {
+		t.Errorf("Expected 51 results and 50 manifest entries, got %d and %d",
+			len(results[1]), len(manifests[1].Data))
+	}
+	for key, sums := range results[0] {
+		if sums["sha256"] != results[1][key]["sha256"] {
+			t.Errorf("Different checksums for %s with 1 and 8 workers", key)
+		}
+	}
+	for key, sum := range manifests[0].Data {
+		if manifests[1].Data[key] != sum {
+			t.Errorf("Different manifest entries for %s with 1 and 8 workers", key)
+		}
+	}
+
+	// Zero means one worker per CPU.
+	p, _ := bagins.NewPayload(srcDir)
+	p.SetWorkers(0)
+	if p.Workers() != runtime.NumCPU() {
+		t.Errorf("Expected %d workers, got %d", runtime.NumCPU(), p.Workers())
+	}
+}
+
+func TestPayloadAddAllContext(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllContext_SRCDIR_")
+	defer os.RemoveAll(srcDir)
+	for i := 0; i < 10; i++ {
+		ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("file%02d.txt", i)),
+			[]byte(strings.Repeat("x", 100)), 0644)
+	}
+
+	// Progress should count every file and byte.
+	pDir, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllContext_")
+	defer os.RemoveAll(pDir)
+	m, _ := bagins.NewManifest(os.TempDir(), "md5", bagins.PayloadManifest)
+	p, _ := bagins.NewPayload(pDir)
+	var reports []bagins.Progress
+	p.SetProgressFunc(func(progress bagins.Progress) {
+		reports = append(reports, progress)
+	})
+	if _, errs := p.AddAllContext(context.Background(), srcDir, []*bagins.Manifest{m}); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	if len(reports) != 10 {
+		t.Fatalf("Expected 10 progress reports, got %d", len(reports))
+	}
+	last := reports[len(reports)-1]
+	if last.Operation != bagins.AddingFiles || last.FilesDone != 10 || last.FilesTotal != 10 ||
+		last.BytesDone != 1000 || last.BytesTotal != 1000 {
+		t.Errorf("Final progress report is wrong: %+v", last)
+	}
+
+	// Cancelling should stop after the file being added,
+	// and leave only the finished files behind.
+	pDir2, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllContext_")
+	defer os.RemoveAll(pDir2)
+	m2, _ := bagins.NewManifest(os.TempDir(), "md5", bagins.PayloadManifest)
+	p2, _ := bagins.NewPayload(pDir2)
+	p2.SetWorkers(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	p2.SetProgressFunc(func(progress bagins.Progress) {
+		if progress.FilesDone == 3 {
+			cancel()
+		}
+	})
+	checksums, errs := p2.AddAllContext(ctx, srcDir, []*bagins.Manifest{m2})
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", errs)
+	}
+	files, _ := ioutil.ReadDir(pDir2)
+	if len(checksums) != 3 || len(m2.Data) != 3 || len(files) != 3 {
+		t.Errorf("Expected 3 files added, got %d checksums, %d manifest entries and %d files",
+			len(checksums), len(m2.Data), len(files))
+	}
+
+	// Nothing should be added once the context is done.
+	pDir3, _ := ioutil.TempDir("", "_GOTEST_PayloadAddAllContext_")
+	defer os.RemoveAll(pDir3)
+	p3, _ := bagins.NewPayload(pDir3)
+	_, errs = p3.AddAllContext(ctx, srcDir, []*bagins.Manifest{m2})
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", errs)
+	}
+	if files, _ := ioutil.ReadDir(pDir3); len(files) != 0 {
+		t.Errorf("Expected no files added after cancelling, got %d", len(files))
+	}
+}
+
 func TestPayloadOctetStreamSum(t *testing.T) {
 	// Setup Test directory
 	pDir, _ := ioutil.TempDir("", "_GOTEST_PayloadOctetStreamSum_")
@@ -218,3 +343,251 @@ func BenchmarkPayload(b *testing.B) {
 
 // AFTER refactor to go routines
 // BenchmarkPayload	2000000000	         0.01 ns/op	       0 B/op	       0 allocs/op
+
+// A file system that fails to remove or rename one file, for
+// testing that payload changes are rolled back.
+type failingFileSystem struct {
+	*bagins.MemFileSystem
+	failOn string
+}
+
+func (f *failingFileSystem) Remove(name string) error {
+	if filepath.Base(name) == f.failOn {
+		return errors.New("remove failed")
+	}
+	return f.MemFileSystem.Remove(name)
+}
+
+func (f *failingFileSystem) Rename(oldName, newName string) error {
+	if filepath.Base(oldName) == f.failOn {
+		return errors.New("rename failed")
+	}
+	return f.MemFileSystem.Rename(oldName, newName)
+}
+
+// Sets up a payload with three files in fsys and returns it, with
+// an md5 manifest listing them.
+func setupMemPayload(t *testing.T, fsys bagins.FileSystem) (*bagins.Payload, *bagins.Manifest) {
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/dir/two.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/dir/sub/three.txt", FIXSTRING)
+	fsys.MkdirAll("bag/data", 0755)
+	p, _ := bagins.NewPayloadFS(fsys, "bag/data")
+	m, _ := bagins.NewManifestFS(fsys, "bag", "md5", bagins.PayloadManifest)
+	if _, errs := p.AddAll("src", []*bagins.Manifest{m}); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	return p, m
+}
+
+func TestPayloadRemove(t *testing.T) {
+	fsys := &failingFileSystem{MemFileSystem: bagins.NewMemFileSystem()}
+	p, m := setupMemPayload(t, fsys)
+	manifests := []*bagins.Manifest{m}
+
+	if err := p.Remove("../outside.txt", manifests); err == nil {
+		t.Errorf("Remove should reject paths outside the payload")
+	}
+	if err := p.Remove("one.txt", manifests); err != nil {
+		t.Fatalf("Unexpected error removing file: %s", err)
+	}
+	if _, err := fsys.Stat("bag/data/one.txt"); !os.IsNotExist(err) {
+		t.Errorf("Remove did not remove the file")
+	}
+	if _, ok := m.Data["data/one.txt"]; ok || len(m.Data) != 2 {
+		t.Errorf("Remove left manifest entries %v", m.Data)
+	}
+
+	// A directory that can't be removed completely should be put back.
+	fsys.failOn = "three.txt"
+	if err := p.Remove("dir", manifests); err == nil {
+		t.Errorf("Expected an error removing the directory")
+	}
+	if _, err := fsys.Stat("bag/data/dir/sub/three.txt"); err != nil {
+		t.Errorf("Directory was not put back after a failed remove: %s", err)
+	}
+	if entries, _ := fs.ReadDir(fsys, "bag/data"); len(entries) != 1 {
+		t.Errorf("Failed remove left %d entries in the payload", len(entries))
+	}
+	if len(m.Data) != 2 {
+		t.Errorf("Failed remove changed the manifest: %v", m.Data)
+	}
+
+	fsys.failOn = ""
+	if err := p.Remove("dir", manifests); err != nil {
+		t.Fatalf("Unexpected error removing directory: %s", err)
+	}
+	if len(m.Data) != 0 {
+		t.Errorf("Remove left manifest entries %v", m.Data)
+	}
+}
+
+func TestPayloadMove(t *testing.T) {
+	fsys := &failingFileSystem{MemFileSystem: bagins.NewMemFileSystem()}
+	p, m := setupMemPayload(t, fsys)
+	manifests := []*bagins.Manifest{m}
+
+	if err := p.Move("one.txt", "dir/two.txt", manifests); err == nil {
+		t.Errorf("Move should not replace an existing file")
+	}
+	if err := p.Move("one.txt", "../one.txt", manifests); err == nil {
+		t.Errorf("Move should reject paths outside the payload")
+	}
+	if err := p.Move("one.txt", "new/place/one.txt", manifests); err != nil {
+		t.Fatalf("Unexpected error moving file: %s", err)
+	}
+	if m.Data["data/new/place/one.txt"] != FIXVALUE {
+		t.Errorf("Move did not rename the manifest entry: %v", m.Data)
+	}
+	if err := p.Move("dir", "moved", manifests); err != nil {
+		t.Fatalf("Unexpected error moving directory: %s", err)
+	}
+	if _, err := fsys.Stat("bag/data/moved/sub/three.txt"); err != nil {
+		t.Errorf("Move did not move the directory: %s", err)
+	}
+	if m.Data["data/moved/two.txt"] != FIXVALUE || m.Data["data/moved/sub/three.txt"] != FIXVALUE ||
+		len(m.Data) != 3 {
+		t.Errorf("Move did not rename the directory's manifest entries: %v", m.Data)
+	}
+
+	// A failed move should leave everything as it was.
+	fsys.failOn = "moved"
+	if err := p.Move("moved", "a/b/c", manifests); err == nil {
+		t.Errorf("Expected an error moving the directory")
+	}
+	if _, err := fsys.Stat("bag/data/a"); !os.IsNotExist(err) {
+		t.Errorf("Failed move left the directories it created")
+	}
+	if m.Data["data/moved/two.txt"] != FIXVALUE || len(m.Data) != 3 {
+		t.Errorf("Failed move changed the manifest: %v", m.Data)
+	}
+}
+
+func TestPayloadIngestStrategy(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("", "_GOTEST_PayloadIngest_SRCDIR_")
+	defer os.RemoveAll(srcDir)
+	srcFile := filepath.Join(srcDir, "one.txt")
+	ioutil.WriteFile(srcFile, []byte(FIXSTRING), 0644)
+
+	pDir, _ := ioutil.TempDir("", "_GOTEST_PayloadIngest_")
+	defer os.RemoveAll(pDir)
+	m, _ := bagins.NewManifest(os.TempDir(), "md5", bagins.PayloadManifest)
+	p, _ := bagins.NewPayload(pDir)
+
+	// A hard link should be the same file as the source.
+	p.SetIngestStrategy(bagins.IngestHardLink)
+	checksums, err := p.Add(srcFile, "linked.txt", []*bagins.Manifest{m})
+	if err != nil || checksums["md5"] != FIXVALUE {
+		t.Fatalf("Add returned %v, %v", checksums, err)
+	}
+	srcInfo, _ := os.Stat(srcFile)
+	dstInfo, _ := os.Stat(filepath.Join(pDir, "linked.txt"))
+	if !os.SameFile(srcInfo, dstInfo) {
+		t.Errorf("Expected linked.txt to be a hard link to the source")
+	}
+
+	// Copying over the link should leave the source alone.
+	p.SetIngestStrategy(bagins.IngestCopy)
+	if _, err := p.Add(srcFile, "linked.txt", []*bagins.Manifest{m}); err != nil {
+		t.Fatalf("Unexpected error copying file: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(srcFile); string(data) != FIXSTRING {
+		t.Errorf("Copying over a hard link emptied the source: %q", data)
+	}
+
+	// Reflinks fall back to copying on file systems without them.
+	p.SetIngestStrategy(bagins.IngestReflink)
+	if _, errs := p.AddAll(srcDir, []*bagins.Manifest{m}); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(pDir, "one.txt")); string(data) != FIXSTRING {
+		t.Errorf("Reflinked file has the wrong contents: %q", data)
+	}
+
+	strategies := p.IngestStrategies()
+	if len(strategies) != 2 || strategies["data/linked.txt"] != bagins.IngestCopy {
+		t.Errorf("Wrong strategies recorded: %v", strategies)
+	}
+	if s := strategies["data/one.txt"]; s != bagins.IngestReflink && s != bagins.IngestCopy {
+		t.Errorf("Expected reflink or copy for data/one.txt, got %s", s)
+	}
+
+	// File systems that can't link get copies.
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	fsys.Mkdir("payload", 0755)
+	mp, _ := bagins.NewPayloadFS(fsys, "payload")
+	mp.SetIngestStrategy(bagins.IngestHardLink)
+	if _, err := mp.Add("src/one.txt", "one.txt", []*bagins.Manifest{m}); err != nil {
+		t.Fatalf("Unexpected error adding file: %s", err)
+	}
+	if s := mp.IngestStrategies()["data/one.txt"]; s != bagins.IngestCopy {
+		t.Errorf("Expected a copy on a file system without links, got %s", s)
+	}
+}
+
+// A reader that fails after returning its contents.
+type brokenReader struct {
+	r io.Reader
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestPayloadAddReader(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	p, m := setupMemPayload(t, fsys)
+	sha, _ := bagins.NewManifestFS(fsys, "bag", "sha256", bagins.PayloadManifest)
+	manifests := []*bagins.Manifest{m, sha}
+
+	checksums, err := p.AddReader(strings.NewReader(FIXSTRING), "streamed/four.txt", manifests)
+	if err != nil {
+		t.Fatalf("Unexpected error adding reader: %s", err)
+	}
+	if checksums["md5"] != FIXVALUE || m.Data[filepath.Join("data", "streamed", "four.txt")] != FIXVALUE {
+		t.Errorf("Wrong md5 for the streamed file: %v", checksums)
+	}
+	if sha.Data[filepath.Join("data", "streamed", "four.txt")] != checksums["sha256"] || checksums["sha256"] == "" {
+		t.Errorf("Expected the sha256 manifest to be updated, got %v", sha.Data)
+	}
+	if data, _ := fs.ReadFile(fsys, "bag/data/streamed/four.txt"); string(data) != FIXSTRING {
+		t.Errorf("Wrong contents for the streamed file: %q", data)
+	}
+
+	// A failed or short read leaves the old file in place.
+	ctx := context.Background()
+	size := int64(len(FIXSTRING))
+	if _, err := p.AddReaderContext(ctx, strings.NewReader("short"), "one.txt", size, manifests); err == nil {
+		t.Error("Expected an error for a reader of the wrong size")
+	}
+	if _, err := p.AddReader(&brokenReader{strings.NewReader("new contents")}, "one.txt", manifests); err == nil {
+		t.Error("Expected an error from the broken reader")
+	}
+	if data, _ := fs.ReadFile(fsys, "bag/data/one.txt"); string(data) != FIXSTRING {
+		t.Errorf("Expected one.txt to be left as it was, got %q", data)
+	}
+	if m.Data[filepath.Join("data", "one.txt")] != FIXVALUE {
+		t.Errorf("Expected the manifest entry for one.txt to be unchanged")
+	}
+	entries, _ := fs.ReadDir(fsys, "bag/data")
+	if len(entries) != 3 {
+		t.Errorf("Expected the temporary files to be removed, got %v", entries)
+	}
+
+	var progress []bagins.Progress
+	p.SetProgressFunc(func(pr bagins.Progress) { progress = append(progress, pr) })
+	if _, err := p.AddReaderContext(ctx, strings.NewReader(FIXSTRING), "five.txt", size, manifests); err != nil {
+		t.Fatalf("Unexpected error adding reader: %s", err)
+	}
+	if len(progress) == 0 || progress[len(progress)-1].BytesTotal != size || progress[len(progress)-1].FilesDone != 1 {
+		t.Errorf("Expected progress for %d bytes, got %v", size, progress)
+	}
+	if _, err := p.AddReader(strings.NewReader(FIXSTRING), "../escape.txt", manifests); err == nil {
+		t.Error("Expected an error adding a file outside the payload")
+	}
+}
@@ -0,0 +1,132 @@
+package bagins
+
+/*
+
+"Courage and hope we need, and endurance, and
+the knowledge that we are not alone."
+
+- Gandalf the Grey
+
+*/
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Operations reported in Progress.Operation.
+const (
+	// Files are being copied into the payload and hashed by AddDir.
+	AddingFiles = "adding_files"
+	// Files are being hashed and checked against a manifest by RunChecksums.
+	CheckingFiles = "checking_files"
+)
+
+/*
+Progress describes how far a long-running operation has got. The
+totals are counted before the operation starts. A file that fails part
+way through may leave BytesDone short of BytesTotal at the end.
+*/
+type Progress struct {
+	Operation  string // AddingFiles or CheckingFiles
+	Path       string // File being processed, or the one just finished
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+}
+
+/*
+ProgressFunc receives progress reports. It is called after each file is
+finished, and every ProgressInterval bytes while large files are being
+read. Calls are never concurrent, even when files are processed by
+several workers, but they come from the goroutine doing the work, so
+the function should return quickly. To feed a channel, send without
+blocking:
+
+	bag.SetProgressFunc(func(p bagins.Progress) {
+		select {
+		case progressChan <- p:
+		default:
+		}
+	})
+*/
+type ProgressFunc func(Progress)
+
+// Number of bytes read between progress reports for a single file.
+const ProgressInterval = 4 * 1024 * 1024
+
+// Collects progress from the workers of a single operation and passes
+// it on to a ProgressFunc. A nil progressTracker reports nothing.
+type progressTracker struct {
+	mutex        sync.Mutex
+	fn           ProgressFunc
+	progress     Progress
+	lastReported int64
+}
+
+// Returns a tracker for an operation, or nil if fn is nil.
+func newProgressTracker(fn ProgressFunc, operation string, filesTotal int, bytesTotal int64) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{
+		fn: fn,
+		progress: Progress{
+			Operation:  operation,
+			FilesTotal: filesTotal,
+			BytesTotal: bytesTotal,
+		},
+	}
+}
+
+// Records n more bytes read from the file at path.
+func (pt *progressTracker) addBytes(path string, n int) {
+	if pt == nil || n == 0 {
+		return
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.progress.BytesDone += int64(n)
+	if pt.progress.BytesDone-pt.lastReported >= ProgressInterval {
+		pt.progress.Path = path
+		pt.report()
+	}
+}
+
+// Records that the file at path is finished.
+func (pt *progressTracker) fileDone(path string) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.progress.FilesDone++
+	pt.progress.Path = path
+	pt.report()
+}
+
+// Calls the ProgressFunc. The caller holds the lock.
+func (pt *progressTracker) report() {
+	pt.lastReported = pt.progress.BytesDone
+	pt.fn(pt.progress)
+}
+
+// trackingReader reports the bytes read from a file to a progressTracker
+// and stops with the context's error once the context is done.
+type trackingReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	tracker *progressTracker
+	path    string
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	r.tracker.addBytes(r.path, n)
+	return n, err
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package bagins
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h.
+const ficlone = 0x40049409
+
+// Clones oldName to newName with the FICLONE ioctl.
+func reflink(oldName, newName string) error {
+	src, err := os.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(newName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	closeErr := dst.Close()
+	if errno != 0 {
+		os.Remove(newName)
+		return &os.LinkError{Op: "reflink", Old: oldName, New: newName, Err: errno}
+	}
+	if closeErr != nil {
+		os.Remove(newName)
+		return closeErr
+	}
+	return nil
+}
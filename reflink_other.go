@@ -0,0 +1,13 @@
+//go:build !linux
+
+package bagins
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflinks are only supported on Linux.
+func reflink(oldName, newName string) error {
+	return &os.LinkError{Op: "reflink", Old: oldName, New: newName, Err: errors.ErrUnsupported}
+}
@@ -0,0 +1,189 @@
+package bagins
+
+/*
+
+"I wonder what sort of a tale we've fallen into?"
+
+- Samwise Gamgee
+
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Version of the JSON form of a ValidationReport. It changes only when
+// fields are removed or change meaning. New fields may be added without
+// changing it.
+const ValidationReportSchemaVersion = 1
+
+// Codes returned by ErrorCode for errors that are not validation
+// problems. Validation problems use their ProblemType as their code.
+const (
+	CodeParseError           = "parse_error"
+	CodeUnsupportedAlgorithm = "unsupported_algorithm"
+	CodeError                = "error"
+)
+
+/*
+ErrorCode returns a stable code for err, for programs that need to tell
+kinds of error apart without matching their messages. A
+*ValidationProblem has the code of its ProblemType, as do the typed
+errors for the same problems, such as *ChecksumMismatchError and
+*UnsafePathError. *ParseError has CodeParseError, *UnsupportedAlgorithmError
+has CodeUnsupportedAlgorithm, and anything else has CodeError.
+*/
+func ErrorCode(err error) string {
+	var problem *ValidationProblem
+	var unsafePath *UnsafePathError
+	var parseErr *ParseError
+	switch {
+	case errors.As(err, &problem):
+		return string(problem.Type)
+	case errors.Is(err, ErrChecksumMismatch):
+		return string(ChecksumMismatch)
+	case errors.Is(err, ErrMissingFile):
+		return string(MissingFile)
+	case errors.Is(err, ErrUnmanifestedFile):
+		return string(UnmanifestedFile)
+	case errors.As(err, &unsafePath):
+		return string(UnsafePath)
+	case errors.As(err, &parseErr):
+		return CodeParseError
+	case errors.Is(err, ErrUnsupportedAlgorithm):
+		return CodeUnsupportedAlgorithm
+	}
+	return CodeError
+}
+
+// JSON form of a ValidationReport. Paths use forward slashes, whatever
+// the operating system, and lists are never null.
+type jsonReport struct {
+	SchemaVersion   int            `json:"schema_version"`
+	BagPath         string         `json:"bag_path"`
+	BagItVersion    string         `json:"bagit_version"`
+	Valid           bool           `json:"valid"`
+	Algorithms      []string       `json:"algorithms"`
+	Started         time.Time      `json:"started"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Counts          jsonCounts     `json:"counts"`
+	Files           []*jsonFile    `json:"files"`
+	Problems        []*jsonProblem `json:"problems"`
+	Warnings        []*jsonProblem `json:"warnings"`
+}
+
+type jsonCounts struct {
+	Files        int `json:"files"`
+	ValidFiles   int `json:"valid_files"`
+	InvalidFiles int `json:"invalid_files"`
+	Problems     int `json:"problems"`
+	Warnings     int `json:"warnings"`
+}
+
+type jsonFile struct {
+	Path      string            `json:"path"`
+	Status    string            `json:"status"` // valid or invalid
+	Checksums map[string]string `json:"checksums"`
+	Problems  []string          `json:"problems"` // Codes of the file's problems
+}
+
+type jsonProblem struct {
+	Code      string `json:"code"`
+	Path      string `json:"path,omitempty"`
+	Manifest  string `json:"manifest,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+	Message   string `json:"message"`
+}
+
+/*
+MarshalJSON encodes the report in a stable form, for programs that
+process validation results. The JSON object has these fields:
+
+schema_version is ValidationReportSchemaVersion.
+
+bag_path, bagit_version and algorithms describe the bag.
+
+valid is true if no problems were found.
+
+started is when validation started, in RFC 3339 format, and
+duration_seconds is how long it took.
+
+counts holds the number of files, valid_files, invalid_files, problems
+and warnings.
+
+files lists each file in order of its path, with its path, a status of
+valid or invalid, the checksums calculated keyed by algorithm, and the
+codes of its problems.
+
+problems and warnings list each problem with its code, which is its
+ProblemType, and its message. path, manifest, algorithm, expected and
+actual are included when they apply to the problem.
+*/
+func (r *ValidationReport) MarshalJSON() ([]byte, error) {
+	out := &jsonReport{
+		SchemaVersion:   ValidationReportSchemaVersion,
+		BagPath:         r.BagPath,
+		BagItVersion:    r.Version,
+		Valid:           r.IsValid(),
+		Algorithms:      r.Algorithms,
+		Started:         r.Started,
+		DurationSeconds: r.Duration.Seconds(),
+		Files:           make([]*jsonFile, 0, len(r.Files)),
+		Problems:        jsonProblems(r.Problems),
+		Warnings:        jsonProblems(r.Warnings),
+	}
+	if out.Algorithms == nil {
+		out.Algorithms = make([]string, 0)
+	}
+	for _, fv := range r.Files {
+		file := &jsonFile{
+			Path:      filepath.ToSlash(fv.Path),
+			Status:    "valid",
+			Checksums: fv.Checksums,
+			Problems:  make([]string, 0, len(fv.Problems)),
+		}
+		if file.Checksums == nil {
+			file.Checksums = make(map[string]string)
+		}
+		for _, p := range fv.Problems {
+			file.Problems = append(file.Problems, string(p.Type))
+		}
+		if fv.IsValid() {
+			out.Counts.ValidFiles++
+		} else {
+			file.Status = "invalid"
+			out.Counts.InvalidFiles++
+		}
+		out.Files = append(out.Files, file)
+	}
+	sort.Slice(out.Files, func(i, j int) bool {
+		return out.Files[i].Path < out.Files[j].Path
+	})
+	out.Counts.Files = len(out.Files)
+	out.Counts.Problems = len(out.Problems)
+	out.Counts.Warnings = len(out.Warnings)
+	return json.Marshal(out)
+}
+
+// Returns the JSON form of each problem.
+func jsonProblems(problems []*ValidationProblem) []*jsonProblem {
+	out := make([]*jsonProblem, 0, len(problems))
+	for _, p := range problems {
+		out = append(out, &jsonProblem{
+			Code:      string(p.Type),
+			Path:      filepath.ToSlash(p.Path),
+			Manifest:  filepath.ToSlash(p.Manifest),
+			Algorithm: p.Algorithm,
+			Expected:  p.Expected,
+			Actual:    p.Actual,
+			Message:   p.Message,
+		})
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package bagins_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/bagins"
+	"testing"
+)
+
+func TestValidationReportJSON(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "json-bag", []string{"sha256", "md5"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddDir("src")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	writeMemFile(t, fsys, "json-bag/data/two.txt", "changed")
+
+	report := bag.Validate()
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding report: %s", err)
+	}
+	var out struct {
+		SchemaVersion int      `json:"schema_version"`
+		BagPath       string   `json:"bag_path"`
+		BagItVersion  string   `json:"bagit_version"`
+		Valid         bool     `json:"valid"`
+		Algorithms    []string `json:"algorithms"`
+		Counts        map[string]int
+		Files         []struct {
+			Path      string
+			Status    string
+			Checksums map[string]string
+			Problems  []string
+		}
+		Problems []map[string]string
+		Warnings []map[string]string
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unexpected error decoding %s: %s", data, err)
+	}
+	if out.SchemaVersion != bagins.ValidationReportSchemaVersion || out.BagPath != bag.Path() ||
+		out.BagItVersion != bagins.BagItVersion10 || out.Valid {
+		t.Errorf("Wrong bag details in %s", data)
+	}
+	if fmt.Sprint(out.Algorithms) != "[md5 sha256]" {
+		t.Errorf("Expected algorithms [md5 sha256], got %v", out.Algorithms)
+	}
+	if out.Counts["files"] != 2 || out.Counts["valid_files"] != 1 || out.Counts["invalid_files"] != 1 ||
+		out.Counts["problems"] != 2 || out.Counts["warnings"] != 0 {
+		t.Errorf("Wrong counts %v", out.Counts)
+	}
+	if len(out.Files) != 2 || out.Files[0].Path != "data/one.txt" || out.Files[0].Status != "valid" ||
+		out.Files[0].Checksums["md5"] != FIXVALUE || out.Files[1].Path != "data/two.txt" ||
+		out.Files[1].Status != "invalid" || len(out.Files[1].Problems) != 2 {
+		t.Errorf("Wrong files %+v", out.Files)
+	}
+	for _, p := range out.Problems {
+		if p["code"] != string(bagins.ChecksumMismatch) || p["path"] != "data/two.txt" || p["expected"] == "" {
+			t.Errorf("Wrong problem %v", p)
+		}
+	}
+	if out.Warnings == nil {
+		t.Error("Expected warnings to be an empty list, not null")
+	}
+
+	for _, err := range report.Errors() {
+		if code := bagins.ErrorCode(err); code != string(bagins.ChecksumMismatch) {
+			t.Errorf("Expected code %s, got %s", bagins.ChecksumMismatch, code)
+		}
+	}
+	_, err = bagins.NewBagFS(fsys, ".", "bad-bag", []string{"sha404"}, false, bagins.BagItVersion10)
+	if code := bagins.ErrorCode(err); code != bagins.CodeUnsupportedAlgorithm {
+		t.Errorf("Expected code %s, got %s", bagins.CodeUnsupportedAlgorithm, code)
+	}
+}
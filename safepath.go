@@ -0,0 +1,116 @@
+package bagins
+
+/*
+
+"The world is indeed full of peril, and in it there are many dark places."
+
+- Haldir
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+UnsafePathError is returned for a path that would lead outside the bag.
+Paths read from manifests, tag manifests and fetch.txt, and the tag
+files passed to ReadBag, are all checked before any file is read or
+written, since bags may come from untrusted depositors. A path is unsafe
+if it is absolute, if it climbs out of the bag with "..", or if it
+passes through a symbolic link to somewhere outside the bag.
+*/
+type UnsafePathError struct {
+	Path   string // The path as it was given
+	Source string // Where the path came from, such as the manifest's name
+	Reason string // Why the path is unsafe
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("Unsafe path %q in %s: %s", e.Path, e.Source, e.Reason)
+}
+
+// Returns the reason the slash-separated pathInBag can't be in a bag, or
+// an empty string if it is relative and stays inside the bag. Symbolic
+// links are not checked.
+func unsafePathReason(pathInBag string) string {
+	osPath := filepath.FromSlash(pathInBag)
+	if path.IsAbs(pathInBag) || filepath.IsAbs(osPath) || filepath.VolumeName(osPath) != "" {
+		return "it is an absolute path"
+	}
+	clean := path.Clean(pathInBag)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "it leads out of the bag"
+	}
+	return ""
+}
+
+// Returns true if the slash-separated pathInBag is absolute or leads
+// out of the bag.
+func isOutsideBag(pathInBag string) bool {
+	return unsafePathReason(pathInBag) != ""
+}
+
+// Checks that paths stay inside a bag, resolving the symbolic links in
+// the bag. The root's own links are resolved once, when the guard is
+// made.
+type pathGuard struct {
+	fsys     FileSystem
+	root     string
+	realRoot string // root with its links resolved, or "" if it can't be
+}
+
+// Returns a guard for the bag at root in fsys.
+func newPathGuard(fsys FileSystem, root string) *pathGuard {
+	realRoot, err := evalSymlinks(fsys, root)
+	if err != nil {
+		realRoot = ""
+	}
+	return &pathGuard{fsys: fsys, root: root, realRoot: realRoot}
+}
+
+/*
+Returns the path to pathInBag, which is relative to the bag root, or an
+*UnsafePathError naming source if it leads outside the bag. If the file
+does not exist, the deepest directory above it that does is checked, so
+a file can't be written through a link either. Other errors resolving
+links are left for the caller to find when the file is opened.
+*/
+func (g *pathGuard) join(pathInBag string, source string) (string, error) {
+	if reason := unsafePathReason(filepath.ToSlash(pathInBag)); reason != "" {
+		return "", &UnsafePathError{Path: pathInBag, Source: source, Reason: reason}
+	}
+	joined := filepath.Join(g.root, pathInBag)
+	if g.realRoot == "" {
+		return joined, nil
+	}
+	for existing := joined; ; existing = filepath.Dir(existing) {
+		target, err := evalSymlinks(g.fsys, existing)
+		if isSymlinkError(err) || (err == nil && !isWithin(g.realRoot, target)) {
+			return "", &UnsafePathError{Path: pathInBag, Source: source,
+				Reason: "it leads out of the bag through a symbolic link"}
+		}
+		if !errors.Is(err, fs.ErrNotExist) || existing == g.root || filepath.Dir(existing) == existing {
+			return joined, nil
+		}
+	}
+}
+
+// Returns the guard for paths in the bag, making it the first time.
+func (b *Bag) pathGuard() *pathGuard {
+	if b.guard == nil || b.guard.root != b.Path() {
+		b.guard = newPathGuard(b.fsys, b.Path())
+	}
+	return b.guard
+}
+
+// Returns the path to pathInBag, or an *UnsafePathError naming source if
+// it leads outside the bag.
+func (b *Bag) safeJoin(pathInBag string, source string) (string, error) {
+	return b.pathGuard().join(pathInBag, source)
+}
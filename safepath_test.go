@@ -0,0 +1,95 @@
+package bagins_test
+
+import (
+	"errors"
+	"github.com/APTrust/bagins"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Checks that err is an UnsafePathError for pth.
+func checkUnsafePath(t *testing.T, err error, pth string) {
+	var unsafe *bagins.UnsafePathError
+	if !errors.As(err, &unsafe) {
+		t.Errorf("Expected an UnsafePathError for %s, got %v", pth, err)
+	} else if unsafe.Path != pth {
+		t.Errorf("Expected the error to be for %s, got %s", pth, unsafe.Path)
+	}
+}
+
+func TestManifestUnsafePaths(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_UNSAFE_PATHS_")
+	defer os.RemoveAll(dir)
+	bagDir := filepath.Join(dir, "bag")
+	os.MkdirAll(filepath.Join(bagDir, "data"), 0755)
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	ioutil.WriteFile(filepath.Join(bagDir, "data", "good.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte(FIXSTRING), 0644)
+
+	unsafePaths := []string{filepath.Join("..", "secret.txt"), "/etc/passwd"}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(bagDir, "data", "link")); err == nil {
+		unsafePaths = append(unsafePaths, filepath.Join("data", "link", "secret.txt"))
+	}
+	m, _ := bagins.NewManifest(bagDir, "md5", bagins.PayloadManifest)
+	m.Data[filepath.Join("data", "good.txt")] = FIXVALUE
+	for _, pth := range unsafePaths {
+		m.Data[pth] = FIXVALUE
+	}
+
+	errs := m.RunChecksums()
+	if len(errs) != len(unsafePaths) {
+		t.Fatalf("Expected %d errors, got %v", len(unsafePaths), errs)
+	}
+	for _, err := range errs {
+		var unsafe *bagins.UnsafePathError
+		if !errors.As(err, &unsafe) {
+			t.Errorf("Expected an UnsafePathError, got %v", err)
+		}
+	}
+}
+
+func TestBagUnsafePaths(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "unsafe-bag", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddFile("src/one.txt", "one.txt")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	writeMemFile(t, fsys, "unsafe-bag/manifest-md5.txt",
+		FIXVALUE+" data/one.txt\n"+FIXVALUE+" ../src/one.txt\n")
+	writeMemFile(t, fsys, "unsafe-bag/fetch.txt", "file:///etc/passwd - ../../passwd\n")
+
+	// fetch.txt may only list files in the data directory.
+	_, err = bagins.ReadBagFS(fsys, "unsafe-bag", []string{})
+	var parseErr *bagins.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Problem != bagins.PathOutsidePayload {
+		t.Errorf("Expected a %s ParseError for fetch.txt, got %v", bagins.PathOutsidePayload, err)
+	}
+	fsys.Remove("unsafe-bag/fetch.txt")
+
+	if _, err := bagins.ReadBagFS(fsys, "unsafe-bag", []string{"../src/one.txt"}); err == nil {
+		t.Error("Expected an error reading a tag file outside the bag")
+	} else {
+		checkUnsafePath(t, err, "../src/one.txt")
+	}
+	bag, err = bagins.ReadBagFS(fsys, "unsafe-bag", []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+
+	report := bag.Validate()
+	problems := report.ProblemsOfType(bagins.UnsafePath)
+	if len(problems) != 1 {
+		t.Fatalf("Expected 1 unsafe path, got %v", report.Problems)
+	}
+	if len(report.Files[problems[0].Path].Checksums) > 0 {
+		t.Errorf("Unsafe path %s should not have been read", problems[0].Path)
+	}
+}
@@ -0,0 +1,353 @@
+package bagins
+
+/*
+
+"Not all those who wander are lost."
+
+- Bilbo Baggins
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy says what is done with symbolic links found while adding
+// files to a payload, listing the files in a bag and validating it. Set
+// it with Payload.SetSymlinkPolicy or Bag.SetSymlinkPolicy.
+type SymlinkPolicy string
+
+const (
+	// Links are treated as the file or directory they point to, which
+	// must be inside the directory being walked. This is the default.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// Links are left out. AddAll lists them in SkippedFiles.
+	SymlinkSkip SymlinkPolicy = "skip"
+	// Any link is an error.
+	SymlinkError SymlinkPolicy = "error"
+	// Links to files are added to the payload as links, hashed with the
+	// contents of their targets. The target must be inside the directory
+	// being walked, and the link in the payload points to the same file
+	// in the payload. Links to directories are an error.
+	SymlinkPreserve SymlinkPolicy = "preserve"
+)
+
+// Errors for symbolic links a SymlinkPolicy does not allow. They are
+// wrapped in an fs.PathError with the Op "symlink", so test for them
+// with errors.Is.
+var (
+	ErrSymlinkNotAllowed  = errors.New("symbolic links are not allowed")
+	ErrSymlinkOutsideRoot = errors.New("symbolic link points outside the root directory")
+	ErrSymlinkLoop        = errors.New("symbolic link points to a directory that contains it")
+	ErrSymlinkToDir       = errors.New("only symbolic links to files can be preserved")
+)
+
+/*
+SymlinkFS is implemented by file systems that can create symbolic
+links, as os.Symlink does. Payloads use it to add links with
+SymlinkPreserve. File systems that hold links should implement
+ReadLinkFS as well, so they can be found and resolved.
+*/
+type SymlinkFS interface {
+	Symlink(oldName, newName string) error
+}
+
+// ReadLinkFS is implemented by file systems that hold symbolic links,
+// as OSFileSystem does. It has the methods of Go 1.25's fs.ReadLinkFS,
+// so file systems written for either work with both.
+type ReadLinkFS interface {
+	fs.FS
+	// Returns the destination of the named symbolic link.
+	ReadLink(name string) (string, error)
+	// Returns a FileInfo describing the named file, without
+	// following it if it is a symbolic link.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Returns a FileInfo for the named file in fsys without following a
+// symbolic link, or as fs.Stat does if fsys is not a ReadLinkFS.
+func lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if rl, ok := fsys.(ReadLinkFS); ok {
+		return rl.Lstat(name)
+	}
+	return fs.Stat(fsys, name)
+}
+
+// Returns the destination of the named symbolic link in fsys, or an
+// error if fsys is not a ReadLinkFS.
+func readLink(fsys fs.FS, name string) (string, error) {
+	if rl, ok := fsys.(ReadLinkFS); ok {
+		return rl.ReadLink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+// Returns an error unless policy is one of the SymlinkPolicy constants.
+func validateSymlinkPolicy(policy SymlinkPolicy) error {
+	switch policy {
+	case SymlinkFollow, SymlinkSkip, SymlinkError, SymlinkPreserve:
+		return nil
+	}
+	return fmt.Errorf("Unknown symlink policy '%s'. Must be %s, %s, %s or %s",
+		policy, SymlinkFollow, SymlinkSkip, SymlinkError, SymlinkPreserve)
+}
+
+// Returns the error for the link at pth.
+func symlinkError(pth string, err error) error {
+	return &fs.PathError{Op: "symlink", Path: pth, Err: err}
+}
+
+// Returns true if err is about a symbolic link the policy did not allow.
+func isSymlinkError(err error) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && pathErr.Op == "symlink"
+}
+
+// Walks a directory tree, applying a SymlinkPolicy to the links in it.
+type linkWalker struct {
+	fsys     FileSystem
+	root     string        // Directory being walked
+	realRoot string        // root with its links resolved
+	policy   SymlinkPolicy // An empty policy is SymlinkFollow
+	active   map[string]bool
+}
+
+// Returns a walker for the tree at root.
+func newLinkWalker(fsys FileSystem, root string, policy SymlinkPolicy) *linkWalker {
+	realRoot, err := evalSymlinks(fsys, root)
+	if err != nil {
+		realRoot = filepath.Clean(root)
+	}
+	if policy == "" {
+		policy = SymlinkFollow
+	}
+	return &linkWalker{
+		fsys:     fsys,
+		root:     root,
+		realRoot: realRoot,
+		policy:   policy,
+		active:   make(map[string]bool),
+	}
+}
+
+/*
+Walks the tree like fs.WalkDir, calling fn for each file and directory,
+with links handled by the policy:
+
+SymlinkFollow passes a link to a file to fn as an entry for the file,
+and walks a link to a directory, with paths under the link. SymlinkSkip
+passes links to skipped, which may be nil, instead of fn.
+SymlinkPreserve passes links to files to fn with their type, and Info
+describing their target. Broken links are passed to fn as they are, so
+that reading them fails as for any other unreadable file.
+
+Links the policy doesn't allow are passed to fn with an error, which
+isSymlinkError reports as true. fn can return nil to carry on.
+*/
+func (w *linkWalker) walk(fn fs.WalkDirFunc, skipped func(pth string, d fs.DirEntry)) error {
+	var visit fs.WalkDirFunc
+	visit = func(pth string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return fn(pth, d, err)
+		}
+		if w.policy == SymlinkSkip {
+			if skipped != nil {
+				skipped(pth, d)
+			}
+			return nil
+		}
+		target, info, err := w.target(pth)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fn(pth, d, nil)
+		}
+		if err != nil {
+			return fn(pth, d, err)
+		}
+		if !info.IsDir() {
+			if w.policy == SymlinkPreserve {
+				return fn(pth, &linkEntry{DirEntry: d, info: info}, nil)
+			}
+			return fn(pth, fs.FileInfoToDirEntry(info), nil)
+		}
+
+		// Walking a directory that holds the link, or one that is already
+		// being walked through another link, would never end.
+		realParent, err := evalSymlinks(w.fsys, filepath.Dir(pth))
+		if err != nil {
+			return fn(pth, d, err)
+		}
+		if w.active[target] || isWithin(target, realParent) {
+			return fn(pth, d, symlinkError(pth, ErrSymlinkLoop))
+		}
+		w.active[target] = true
+		defer delete(w.active, target)
+		return fs.WalkDir(w.fsys, pth, visit)
+	}
+	return fs.WalkDir(w.fsys, w.root, visit)
+}
+
+// Checks the link at pth against the policy, and returns the resolved
+// path of its target and a FileInfo describing it.
+func (w *linkWalker) target(pth string) (string, fs.FileInfo, error) {
+	if w.policy == SymlinkError {
+		return "", nil, symlinkError(pth, ErrSymlinkNotAllowed)
+	}
+	target, err := evalSymlinks(w.fsys, pth)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isWithin(w.realRoot, target) {
+		return "", nil, symlinkError(pth, ErrSymlinkOutsideRoot)
+	}
+	info, err := w.fsys.Stat(pth)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() && w.policy == SymlinkPreserve {
+		return "", nil, symlinkError(pth, ErrSymlinkToDir)
+	}
+	return target, info, nil
+}
+
+// A preserved link, whose Info describes its target.
+type linkEntry struct {
+	fs.DirEntry
+	info fs.FileInfo
+}
+
+func (e *linkEntry) Info() (fs.FileInfo, error) {
+	return e.info, nil
+}
+
+// Returns true if pth is dir or inside it. Both must be clean.
+func isWithin(dir string, pth string) bool {
+	rel, err := filepath.Rel(dir, pth)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns true if the named file in fsys is a symbolic link.
+func isSymlink(fsys FileSystem, name string) bool {
+	info, err := lstat(fsys, name)
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+/*
+Returns name with every symbolic link in it resolved, as
+filepath.EvalSymlinks does. Paths in OSFileSystem are made absolute.
+Other file systems are resolved with their ReadLinkFS methods, and
+their links must be relative and stay inside the file system.
+*/
+func evalSymlinks(fsys FileSystem, name string) (string, error) {
+	if _, ok := fsys.(OSFileSystem); ok {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Abs(resolved)
+	}
+
+	resolved := "."
+	rest := strings.Split(filepath.ToSlash(name), "/")
+	for links := 0; len(rest) > 0; {
+		elem := rest[0]
+		rest = rest[1:]
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			if resolved == "." {
+				return "", symlinkError(name, ErrSymlinkOutsideRoot)
+			}
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, elem)
+		info, err := lstat(fsys, next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", symlinkError(name, ErrSymlinkLoop)
+		}
+		target, err := readLink(fsys, next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", symlinkError(name, ErrSymlinkOutsideRoot)
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.FromSlash(resolved), nil
+}
+
+// Adds the link at srcPath to the payload as a link at dstPath, pointing
+// to the same file relative to the payload that srcPath's target is
+// relative to the root w walks. The target's contents are hashed.
+func (p *Payload) preserveLink(ctx context.Context, w *linkWalker, srcPath string, dstPath string, manifests []*Manifest, tracker *progressTracker) (map[string]string, IngestStrategy, error) {
+	sfs, ok := p.fsys.(SymlinkFS)
+	if !ok {
+		return nil, "", symlinkError(srcPath, errors.ErrUnsupported)
+	}
+	target, _, err := w.target(srcPath)
+	if err != nil {
+		return nil, "", err
+	}
+	targetRel, err := filepath.Rel(w.realRoot, target)
+	if err != nil {
+		return nil, "", err
+	}
+	linkDir := filepath.Dir(strings.TrimLeft(filepath.Clean(dstPath), string(filepath.Separator)))
+	linkText, err := filepath.Rel(linkDir, targetRel)
+	if err != nil {
+		return nil, "", err
+	}
+
+	src, err := p.fsys.Open(srcPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	hashes := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(manifests))
+	for _, m := range manifests {
+		hsh := m.hashFunc()
+		hashes[m.Algorithm()] = hsh
+		writers = append(writers, hsh)
+	}
+	reader := &trackingReader{ctx: ctx, reader: src, tracker: tracker, path: dstPath}
+	if _, err := io.Copy(io.MultiWriter(writers...), reader); err != nil {
+		return nil, "", err
+	}
+
+	dstFile := filepath.Join(p.dir, dstPath)
+	if err := p.fsys.MkdirAll(filepath.Dir(dstFile), 0766); err != nil {
+		return nil, "", err
+	}
+	if err := p.fsys.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if err := sfs.Symlink(linkText, dstFile); err != nil {
+		return nil, "", err
+	}
+	tracker.fileDone(dstPath)
+
+	checksums := make(map[string]string)
+	for name, hsh := range hashes {
+		checksums[name] = fmt.Sprintf("%x", hsh.Sum(nil))
+	}
+	return checksums, IngestSymlink, nil
+}
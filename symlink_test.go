@@ -0,0 +1,208 @@
+package bagins_test
+
+import (
+	"errors"
+	"github.com/APTrust/bagins"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sets up a source directory holding a file, a directory, a link to
+// each of them and a link to a file outside it. Returns the temporary
+// directory holding src and outside.
+func setupLinkedSource(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "_GOTEST_SYMLINKS_")
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "real.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "inner.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte("secret"), 0644)
+	for target, link := range map[string]string{
+		"real.txt": "link.txt",
+		"sub":      "linkdir",
+		filepath.Join(dir, "outside", "secret.txt"): "escape.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Skipf("Unable to create symbolic links: %s", err)
+		}
+	}
+	return dir
+}
+
+// Adds dir/src to a new payload with policy, and returns the payload
+// directory, manifest and errors.
+func addLinked(t *testing.T, dir string, policy bagins.SymlinkPolicy) (*bagins.Payload, *bagins.Manifest, []error) {
+	pDir := filepath.Join(dir, string(policy))
+	os.MkdirAll(pDir, 0755)
+	p, _ := bagins.NewPayload(pDir)
+	m, _ := bagins.NewManifest(dir, "md5", bagins.PayloadManifest)
+	if err := p.SetSymlinkPolicy(policy); err != nil {
+		t.Fatalf("Unexpected error setting policy %s: %s", policy, err)
+	}
+	_, errs := p.AddAll(filepath.Join(dir, "src"), []*bagins.Manifest{m})
+	return p, m, errs
+}
+
+// Checks that exactly the named files were added to m.
+func checkAdded(t *testing.T, policy bagins.SymlinkPolicy, m *bagins.Manifest, names ...string) {
+	if len(m.Data) != len(names) {
+		t.Errorf("%s: expected %v to be added, got %v", policy, names, m.Data)
+	}
+	for _, name := range names {
+		if m.Data[filepath.Join("data", name)] != FIXVALUE {
+			t.Errorf("%s: wrong md5 for %s: %q", policy, name, m.Data[filepath.Join("data", name)])
+		}
+	}
+}
+
+// Checks that errs are errors for the links, as target.
+func checkLinkErrors(t *testing.T, policy bagins.SymlinkPolicy, errs []error, targets ...error) {
+	if len(errs) != len(targets) {
+		t.Fatalf("%s: expected %d errors, got %v", policy, len(targets), errs)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, targets[i]) {
+			t.Errorf("%s: expected %v, got %v", policy, targets[i], err)
+		}
+	}
+}
+
+func TestPayloadSymlinkPolicy(t *testing.T) {
+	dir := setupLinkedSource(t)
+	defer os.RemoveAll(dir)
+
+	p, m, errs := addLinked(t, dir, bagins.SymlinkFollow)
+	checkLinkErrors(t, bagins.SymlinkFollow, errs, bagins.ErrSymlinkOutsideRoot)
+	checkAdded(t, bagins.SymlinkFollow, m, "link.txt", "linkdir/inner.txt", "real.txt", "sub/inner.txt")
+	if info, err := os.Lstat(filepath.Join(p.Name(), "linkdir", "inner.txt")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("Expected the followed directory to be copied, got %v, %v", info, err)
+	}
+	if _, err := os.Lstat(filepath.Join(p.Name(), "escape.txt")); !os.IsNotExist(err) {
+		t.Errorf("The link outside the source should not be added: %v", err)
+	}
+
+	p, m, errs = addLinked(t, dir, bagins.SymlinkSkip)
+	checkLinkErrors(t, bagins.SymlinkSkip, errs)
+	checkAdded(t, bagins.SymlinkSkip, m, "real.txt", "sub/inner.txt")
+	skipped := p.SkippedFiles()
+	if len(skipped) != 3 {
+		t.Errorf("Expected 3 skipped links, got %v", skipped)
+	}
+	for _, s := range skipped {
+		if s.Reason != bagins.SkippedSymlink {
+			t.Errorf("Expected %s to be skipped as a link, got %s", s.Path, s.Reason)
+		}
+	}
+
+	_, m, errs = addLinked(t, dir, bagins.SymlinkError)
+	checkLinkErrors(t, bagins.SymlinkError, errs,
+		bagins.ErrSymlinkNotAllowed, bagins.ErrSymlinkNotAllowed, bagins.ErrSymlinkNotAllowed)
+	checkAdded(t, bagins.SymlinkError, m, "real.txt", "sub/inner.txt")
+
+	p, m, errs = addLinked(t, dir, bagins.SymlinkPreserve)
+	checkLinkErrors(t, bagins.SymlinkPreserve, errs, bagins.ErrSymlinkOutsideRoot, bagins.ErrSymlinkToDir)
+	checkAdded(t, bagins.SymlinkPreserve, m, "link.txt", "real.txt", "sub/inner.txt")
+	if target, err := os.Readlink(filepath.Join(p.Name(), "link.txt")); err != nil || target != "real.txt" {
+		t.Errorf("Expected link.txt to be a link to real.txt, got %q, %v", target, err)
+	}
+	if strategy := p.IngestStrategies()[filepath.Join("data", "link.txt")]; strategy != bagins.IngestSymlink {
+		t.Errorf("Expected link.txt to be added as a link, got %s", strategy)
+	}
+
+	if err := p.SetSymlinkPolicy("sometimes"); err == nil {
+		t.Error("Expected an error setting an unknown policy")
+	}
+	if p.SymlinkPolicy() != bagins.SymlinkPreserve {
+		t.Errorf("An unknown policy should not be set, got %s", p.SymlinkPolicy())
+	}
+}
+
+func TestPayloadSymlinkLoop(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "_GOTEST_SYMLINK_LOOP_")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "a"), 0755)
+	os.MkdirAll(filepath.Join(src, "b"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a", "one.txt"), []byte(FIXSTRING), 0644)
+	if err := os.Symlink("..", filepath.Join(src, "a", "up")); err != nil {
+		t.Skipf("Unable to create symbolic links: %s", err)
+	}
+	os.Symlink(filepath.Join("..", "a"), filepath.Join(src, "b", "toa"))
+	os.Symlink(filepath.Join("..", "b"), filepath.Join(src, "a", "tob"))
+
+	_, m, errs := addLinked(t, dir, bagins.SymlinkFollow)
+	for _, err := range errs {
+		if !errors.Is(err, bagins.ErrSymlinkLoop) {
+			t.Errorf("Expected only loop errors, got %v", err)
+		}
+	}
+	if len(errs) == 0 {
+		t.Error("Expected errors for the links that loop")
+	}
+	if m.Data[filepath.Join("data", "a", "one.txt")] != FIXVALUE {
+		t.Errorf("Expected a/one.txt to be added, got %v", m.Data)
+	}
+}
+
+func TestPayloadAddSymlink(t *testing.T) {
+	dir := setupLinkedSource(t)
+	defer os.RemoveAll(dir)
+	p, _ := bagins.NewPayload(filepath.Join(dir, "outside"))
+	m, _ := bagins.NewManifest(dir, "md5", bagins.PayloadManifest)
+	manifests := []*bagins.Manifest{m}
+
+	if _, err := p.Add(filepath.Join(dir, "src", "link.txt"), "link.txt", manifests); err != nil {
+		t.Errorf("Unexpected error following a link: %s", err)
+	}
+	if _, err := p.Add(filepath.Join(dir, "src", "escape.txt"), "escape.txt", manifests); !errors.Is(err, bagins.ErrSymlinkOutsideRoot) {
+		t.Errorf("Expected the link outside the source directory to be refused, got %v", err)
+	}
+	p.SetSymlinkPolicy(bagins.SymlinkSkip)
+	if checksums, err := p.Add(filepath.Join(dir, "src", "link.txt"), "skipped.txt", manifests); checksums != nil || err != nil {
+		t.Errorf("Expected the link to be skipped, got %v, %v", checksums, err)
+	}
+	p.SetSymlinkPolicy(bagins.SymlinkError)
+	if _, err := p.Add(filepath.Join(dir, "src", "link.txt"), "error.txt", manifests); !errors.Is(err, bagins.ErrSymlinkNotAllowed) {
+		t.Errorf("Expected an error adding a link, got %v", err)
+	}
+	if len(m.Data) != 1 || m.Data[filepath.Join("data", "link.txt")] != FIXVALUE {
+		t.Errorf("Expected only link.txt to be added, got %v", m.Data)
+	}
+}
+
+func TestBagSymlinkValidation(t *testing.T) {
+	dir := setupLinkedSource(t)
+	defer os.RemoveAll(dir)
+	os.Remove(filepath.Join(dir, "src", "escape.txt"))
+	os.Remove(filepath.Join(dir, "src", "linkdir"))
+
+	bag, err := bagins.NewBag(dir, "test-bag", []string{"md5"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.SetSymlinkPolicy(bagins.SymlinkPreserve)
+	if errs := bag.AddDir(filepath.Join(dir, "src")); len(errs) > 0 {
+		t.Fatalf("Unexpected errors adding files: %v", errs)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	bag, err = bagins.ReadBag(bag.Path(), []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if report := bag.Validate(); !report.IsValid() {
+		t.Errorf("Expected the bag with a preserved link to be valid: %v", report.Problems)
+	}
+
+	bag.SetSymlinkPolicy(bagins.SymlinkError)
+	report := bag.Validate()
+	problems := report.ProblemsOfType(bagins.SymlinkNotAllowed)
+	if len(problems) != 1 || problems[0].Path != filepath.Join("data", "link.txt") {
+		t.Errorf("Expected the link to be reported, got %v", report.Problems)
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -104,12 +104,72 @@ func (fl *TagFieldList) RemoveField(i int) error {
 	return nil
 }
 
+/*
+ Returns the value of the first field with the given label, or an empty
+ string if there is none. Labels are compared without regard to case.
+*/
+func (fl *TagFieldList) Value(label string) string {
+	for _, f := range fl.fields {
+		if strings.EqualFold(f.Label(), label) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// Returns the values of all the fields with the given label, in order.
+func (fl *TagFieldList) Values(label string) []string {
+	var values []string
+	for _, f := range fl.fields {
+		if strings.EqualFold(f.Label(), label) {
+			values = append(values, f.Value())
+		}
+	}
+	return values
+}
+
+/*
+ Sets the value of the field with the given label, keeping its place
+ in the list. Any other fields with the same label are removed. If there
+ is no field with the label, one is added to the end of the list.
+*/
+func (fl *TagFieldList) SetValue(label string, value string) {
+	fields := make([]TagField, 0, len(fl.fields)+1)
+	found := false
+	for _, f := range fl.fields {
+		if strings.EqualFold(f.Label(), label) {
+			if found {
+				continue
+			}
+			f.SetValue(value)
+			found = true
+		}
+		fields = append(fields, f)
+	}
+	if !found {
+		fields = append(fields, *NewTagField(label, value))
+	}
+	fl.fields = fields
+}
+
+// Removes all the fields with the given label.
+func (fl *TagFieldList) RemoveFields(label string) {
+	fields := make([]TagField, 0, len(fl.fields))
+	for _, f := range fl.fields {
+		if !strings.EqualFold(f.Label(), label) {
+			fields = append(fields, f)
+		}
+	}
+	fl.fields = fields
+}
+
 // TAG FILES
 
 // Represents a tag file object in the bag with its related fields.
 type TagFile struct {
 	name string        // Filepath for tag file.
 	Data *TagFieldList // key value pairs of data for the tagfile.
+	fsys FileSystem    // File system the tag file is read from and written to.
 }
 
 /*
@@ -117,10 +177,16 @@ type TagFile struct {
  The name argument represents the filepath of the tagfile, which must end in txt
 */
 func NewTagFile(name string) (tf *TagFile, err error) {
-	err = validateTagFileName(name)
+	return NewTagFileFS(OSFileSystem{}, name)
+}
+
+// Creates a new tagfile object as NewTagFile does, to be written to fsys.
+func NewTagFileFS(fsys FileSystem, name string) (tf *TagFile, err error) {
+	err = validateTagFileName(fsys, name)
 	tf = new(TagFile)
 	tf.name = filepath.Clean(name)
 	tf.Data = new(TagFieldList)
+	tf.fsys = fsys
 	return tf, err
 }
 
@@ -129,20 +195,25 @@ func NewTagFile(name string) (tf *TagFile, err error) {
  name is the filepath to the tag file.  It throws an error if contents cannot be properly parsed.
 */
 func ReadTagFile(name string) (*TagFile, []error) {
+	return ReadTagFileFS(OSFileSystem{}, name)
+}
+
+// Reads and parses the tagfile at name in fsys, as ReadTagFile does.
+func ReadTagFileFS(fsys FileSystem, name string) (*TagFile, []error) {
 	var errs []error
 
-	file, err := os.Open(name)
+	file, err := fsys.Open(name)
 	if err != nil {
 		return nil, append(errs, err)
 	}
 	defer file.Close()
 
-	tf, err := NewTagFile(name)
+	tf, err := NewTagFileFS(fsys, name)
 	if err != nil {
 		return nil, append(errs, err)
 	}
 
-	data, errs := parseTagFields(file)
+	data, errs := parseTagFields(file, name)
 	tf.Data.SetFields(data)
 
 	return tf, errs
@@ -159,12 +230,13 @@ func (tf *TagFile) Name() string {
 */
 func (tf *TagFile) Create() error {
 	// Create directory if needed.
-	if err := os.MkdirAll(filepath.Dir(tf.name), 0777); err != nil {
+	fsys := defaultFileSystem(tf.fsys)
+	if err := fsys.MkdirAll(filepath.Dir(tf.name), 0777); err != nil {
 		return err
 	}
 
 	// Create the tagfile.
-	fileOut, err := os.Create(tf.Name())
+	fileOut, err := fsys.Create(tf.Name())
 	if err != nil {
 		return err
 	}
@@ -236,8 +308,8 @@ func formatField(key string, data string) (string, error) {
 }
 
 // Some private convenence methods for manipulating tag files.
-func validateTagFileName(name string) (err error) {
-	_, err = os.Stat(filepath.Dir(name))
+func validateTagFileName(fsys FileSystem, name string) (err error) {
+	_, err = fsys.Stat(filepath.Dir(name))
 	re, _ := regexp.Compile(`.*\.txt`)
 	if !re.MatchString(filepath.Base(name)) {
 		err = errors.New(fmt.Sprint("Tagfiles must end in .txt and contain at least 1 letter.  Provided: ", filepath.Base(name)))
@@ -245,11 +317,20 @@ func validateTagFileName(name string) (err error) {
 	return err
 }
 
+// The UTF-8 encoding of the byte order mark, which BagIt 1.0 forbids at
+// the start of bagit.txt. See https://tools.ietf.org/html/rfc8493#section-2.1.1
+var utf8ByteOrderMark = []byte{0xEF, 0xBB, 0xBF}
+
+// Returns true if data starts with a UTF-8 byte order mark.
+func hasByteOrderMark(data []byte) bool {
+	return bytes.HasPrefix(data, utf8ByteOrderMark)
+}
+
 /*
  Reads the contents of file and parses tagfile fields from the contents or returns an error if
- it contains unparsable data.
+ it contains unparsable data. A byte order mark at the start of the file is ignored.
 */
-func parseTagFields(file *os.File) ([]TagField, []error) {
+func parseTagFields(file io.Reader, name string) ([]TagField, []error) {
 	var errors []error
 	re, err := regexp.Compile(`^(\S*\:)?(\s.*)?$`)
 	if err != nil {
@@ -262,8 +343,13 @@ func parseTagFields(file *os.File) ([]TagField, []error) {
 	var field TagField
 
 	// Parse the remaining lines.
-	for scanner.Scan() {
+	firstLine := true
+	for lineNum := 1; scanner.Scan(); lineNum++ {
 		line := scanner.Text()
+		if firstLine {
+			line = strings.TrimPrefix(line, string(utf8ByteOrderMark))
+			firstLine = false
+		}
 		// See http://play.golang.org/p/zLqvg2qo1D for some testing on the field match.
 		if re.MatchString(line) {
 			data := re.FindStringSubmatch(line)
@@ -279,8 +365,8 @@ func parseTagFields(file *os.File) ([]TagField, []error) {
 			field.SetValue(strings.Join([]string{field.Value(), value}, " "))
 
 		} else {
-			err := fmt.Errorf("Unable to parse tag data from line: %s", line)
-			errors = append(errors, err)
+			errors = append(errors, &ParseError{File: name, Line: lineNum, Problem: MalformedLine,
+				Detail: fmt.Sprintf("unable to parse tag data from %q", line)})
 		}
 	}
 	if field.Label() != "" {
@@ -4,6 +4,7 @@ package bagins_test
 import (
 	"fmt"
 	"github.com/APTrust/bagins"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -155,6 +156,36 @@ func TestRemoveField(t *testing.T) {
 
 // TagFile TESTS
 
+func TestTagFieldListValues(t *testing.T) {
+	fl := bagins.NewTagFieldList()
+	fl.AddField(*bagins.NewTagField("Contact-Name", "Bilbo"))
+	fl.AddField(*bagins.NewTagField("Source-Organization", "The Shire"))
+	fl.AddField(*bagins.NewTagField("contact-name", "Frodo"))
+
+	if fl.Value("CONTACT-NAME") != "Bilbo" {
+		t.Errorf("Value should return the first field, ignoring case, got %s", fl.Value("CONTACT-NAME"))
+	}
+	if values := fl.Values("Contact-Name"); len(values) != 2 || values[1] != "Frodo" {
+		t.Errorf("Values returned %v", values)
+	}
+
+	// SetValue should keep the place of the first field and drop the rest.
+	fl.SetValue("Contact-Name", "Sam")
+	fields := fl.Fields()
+	if len(fields) != 2 || fields[0].Value() != "Sam" || fields[1].Label() != "Source-Organization" {
+		t.Errorf("SetValue left fields %v", fields)
+	}
+	fl.SetValue("Bag-Count", "1 of 2")
+	if len(fl.Fields()) != 3 || fl.Value("Bag-Count") != "1 of 2" {
+		t.Errorf("SetValue did not add a new field")
+	}
+
+	fl.RemoveFields("contact-name")
+	if len(fl.Fields()) != 2 || fl.Value("Contact-Name") != "" {
+		t.Errorf("RemoveFields left fields %v", fl.Fields())
+	}
+}
+
 func TestNewTagFile(t *testing.T) {
 	_, err := bagins.NewTagFile("tagfile.txt")
 	if err != nil {
@@ -248,3 +279,21 @@ Long-Line:  A metadata element MUST consist of a label, a colon, and a value,
 		t.Errorf("ToString() returned\n\n%s  \nExpected\n\n%s", str, expected)
 	}
 }
+
+func TestReadTagFileByteOrderMark(t *testing.T) {
+	testPath := filepath.Join(os.TempDir(), "_GOTEST_READTAGFILE_BOM_bagit.txt")
+	content := "\xEF\xBB\xBFBagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n"
+	if err := ioutil.WriteFile(testPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testPath)
+
+	// It should ignore the byte order mark when parsing the first label.
+	tf, errs := bagins.ReadTagFile(testPath)
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if label := tf.Data.Fields()[0].Label(); label != "BagIt-Version" {
+		t.Errorf("Expected label BagIt-Version, got %q", label)
+	}
+}
@@ -0,0 +1,298 @@
+package bagins
+
+/*
+
+"All we have to decide is what to do with the time that is given us."
+
+- Gandalf the Grey
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// PayloadChanges lists the payload files Bag.Update found had changed.
+// Paths are relative to the bag root, as in the manifests.
+type PayloadChanges struct {
+	Added    []string // Files in the payload that were not in the manifests
+	Removed  []string // Files in the manifests that are no longer in the payload
+	Modified []string // Files that were rehashed because they may have changed
+}
+
+// UpdateOptions changes how Bag.Update finds changed files. A nil
+// *UpdateOptions gives the defaults.
+type UpdateOptions struct {
+	// Hash every file in the payload manifests again, rather than only
+	// the files that look changed. Use this when files may have been
+	// changed without their modification times moving forward.
+	Rehash bool
+}
+
+// Returns true if Update found no changes to the payload.
+func (c *PayloadChanges) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+/*
+Removes the file or directory at dst, relative to the payload directory,
+from the bag and from every payload manifest. See Payload.Remove. The
+manifests and tag manifests are rewritten the next time the bag is saved.
+example:
+
+	err := b.RemoveFile("myfile.txt")
+*/
+func (b *Bag) RemoveFile(dst string) error {
+	return b.payload.Remove(dst, b.GetManifests(PayloadManifest))
+}
+
+/*
+Moves the file or directory at src to dst, both relative to the payload
+directory, and renames its entries in every payload manifest. See
+Payload.Move. The manifests and tag manifests are rewritten the next time
+the bag is saved.
+example:
+
+	err := b.MoveFile("myfile.txt", "archive/myfile.txt")
+*/
+func (b *Bag) MoveFile(src string, dst string) error {
+	return b.payload.Move(src, dst, b.GetManifests(PayloadManifest))
+}
+
+/*
+Replaces the payload file at dst, relative to the payload directory,
+with the file at src, and updates its checksums in the payload
+manifests. The new file is copied next to the old one first, so the
+old file is left as it was if the copy fails. Returns an error if
+there is no payload file at dst, see AddFile for adding new files, or
+if dst is not inside the payload directory.
+example:
+
+	err := b.ReplaceFile("/tmp/fixed.txt", "myfile.txt")
+*/
+func (b *Bag) ReplaceFile(src string, dst string) error {
+	dst, err := payloadRelPath(dst)
+	if err != nil {
+		return err
+	}
+	dstFile := filepath.Join(b.payload.Name(), dst)
+	info, err := b.fsys.Stat(dstFile)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Unable to replace %s, it is a directory", dst)
+	}
+	tmpFile, err := tempFileName(b.fsys, filepath.Dir(dstFile), ".bagins-replace-")
+	if err != nil {
+		return err
+	}
+	tmpRel, err := filepath.Rel(b.payload.Name(), tmpFile)
+	if err != nil {
+		return err
+	}
+	payloadManifests := b.GetManifests(PayloadManifest)
+	checksums, _, err := b.payload.copyAndHash(context.Background(), src, tmpRel, payloadManifests, nil)
+	if err != nil {
+		return err
+	}
+	if err := b.fsys.Rename(tmpFile, dstFile); err != nil {
+		b.fsys.Remove(tmpFile)
+		return err
+	}
+	for _, manifest := range payloadManifests {
+		manifest.Data[filepath.Join("data", dst)] = checksums[manifest.Algorithm()]
+	}
+	b.payload.recordModTime(dst, src)
+	return nil
+}
+
+/*
+Brings the manifests of a bag up to date after files in its payload
+directory have been added, removed or changed, then saves the bag.
+
+Files in the payload that are not in the payload manifests are hashed
+and added to all of them. Entries for files that no longer exist are
+dropped, except for files listed in fetch.txt. Files modified since
+the payload manifests were last written are hashed again. Other files
+are not read, so Update is much faster than building the bag again.
+Files whose modification times were changed by copying the bag may be
+hashed again needlessly.
+
+A file whose contents changed but whose modification time was set back
+before the manifests were written, as cp -p, rsync -t and tar do, is
+not detected by its time. If no file was removed or found modified, and
+bag-info.txt has a Payload-Oxum, the size and number of the listed
+files are compared with it, and every file is hashed again if they
+differ. A changed file of the same size is only found with
+UpdateOptions.Rehash, which hashes every file again.
+
+If bag-info.txt has a Payload-Oxum, it and Bag-Size are updated as
+SetAutoBagInfo does. Tag manifests are written last, and entries for
+tag files that no longer exist are dropped from them.
+
+Returns the changes that were found, and any errors. The bag is only
+saved if every changed file could be hashed.
+*/
+func (b *Bag) Update(opts *UpdateOptions) (*PayloadChanges, []error) {
+	return b.UpdateContext(context.Background(), opts)
+}
+
+// Performs an Update that stops when ctx is done, returning ctx.Err()
+// as the last error. The bag is not saved if ctx is done.
+func (b *Bag) UpdateContext(ctx context.Context, opts *UpdateOptions) (changes *PayloadChanges, errs []error) {
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+	changes = &PayloadChanges{}
+	payloadManifests := b.GetManifests(PayloadManifest)
+
+	payloadFiles, err := b.listPayloadFiles()
+	if err != nil {
+		return changes, append(errs, err)
+	}
+	onDisk := make(map[string]bool, len(payloadFiles))
+	for _, pathInBag := range payloadFiles {
+		onDisk[pathInBag] = true
+	}
+
+	// Find entries for files that are gone.
+	listed := make(map[string]bool)
+	for _, manifest := range payloadManifests {
+		for pathInBag := range manifest.Data {
+			listed[pathInBag] = true
+		}
+	}
+	for pathInBag := range listed {
+		if !onDisk[pathInBag] && !b.isFetchEntry(pathInBag) {
+			changes.Removed = append(changes.Removed, pathInBag)
+		}
+	}
+	sort.Strings(changes.Removed)
+
+	// Find new files, and files changed since the manifests were written.
+	manifestTime := b.payloadManifestTime()
+	unchanged := make([]string, 0)
+	var listedOctets int64
+	for _, pathInBag := range payloadFiles {
+		if !listed[pathInBag] {
+			changes.Added = append(changes.Added, pathInBag)
+			continue
+		}
+		info, err := b.fsys.Stat(filepath.Join(b.Path(), pathInBag))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		listedOctets += info.Size()
+		if opts.Rehash || !info.ModTime().Before(manifestTime) {
+			changes.Modified = append(changes.Modified, pathInBag)
+		} else {
+			unchanged = append(unchanged, pathInBag)
+		}
+	}
+	if len(errs) > 0 {
+		return changes, errs
+	}
+
+	// With nothing removed or modified, the listed files should still
+	// add up to the Payload-Oxum. If they don't, a file changed without
+	// its modification time moving forward.
+	if len(changes.Removed) == 0 && len(changes.Modified) == 0 && len(unchanged) > 0 &&
+		b.payloadOxumDiffers(listedOctets, len(unchanged)) {
+		changes.Modified = unchanged
+	}
+
+	// Hash the new and changed files in place.
+	toHash := append(append([]string{}, changes.Added...), changes.Modified...)
+	results := make([]map[string]string, len(toHash))
+	hashErrs := make([]error, len(toHash))
+	tracker := newProgressTracker(b.payload.progress, CheckingFiles, len(toHash), 0)
+	runWorkers(ctx, b.payload.workers, len(toHash), func(i int) {
+		absPath := filepath.Join(b.Path(), toHash[i])
+		dstPath, _ := filepath.Rel(b.payload.Name(), absPath)
+		results[i], _, hashErrs[i] = b.payload.copyAndHash(ctx, absPath, dstPath, payloadManifests, tracker)
+	})
+	if err := ctx.Err(); err != nil {
+		return changes, append(errs, err)
+	}
+	for _, err := range hashErrs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return changes, errs
+	}
+
+	for _, manifest := range payloadManifests {
+		for _, pathInBag := range changes.Removed {
+			delete(manifest.Data, pathInBag)
+		}
+		for i, pathInBag := range toHash {
+			manifest.Data[pathInBag] = results[i][manifest.Algorithm()]
+		}
+	}
+	for _, pathInBag := range changes.Removed {
+		delete(b.payload.modTimes, pathInBag)
+	}
+	for _, pathInBag := range toHash {
+		absPath := filepath.Join(b.Path(), pathInBag)
+		dstPath, _ := filepath.Rel(b.payload.Name(), absPath)
+		b.payload.recordModTime(dstPath, absPath)
+	}
+
+	if !b.autoBagInfo {
+		if oxum, err := b.readPayloadOxum(); err != nil {
+			errs = append(errs, err)
+		} else if oxum != "" {
+			if err := b.loadBagInfo(); err != nil {
+				errs = append(errs, err)
+			} else if err := b.updateBagInfo(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, manifest := range b.GetManifests(TagManifest) {
+		for pathInBag := range manifest.Data {
+			if !b.fileExists(pathInBag) {
+				delete(manifest.Data, pathInBag)
+			}
+		}
+	}
+
+	return changes, append(errs, b.SaveContext(ctx)...)
+}
+
+// Returns true if bag-info.txt has a Payload-Oxum that does not match
+// octets and count. Returns false if it has none, or it can't be read.
+func (b *Bag) payloadOxumDiffers(octets int64, count int) bool {
+	value, err := b.readPayloadOxum()
+	if err != nil || value == "" {
+		return false
+	}
+	expectedOctets, expectedCount, err := parsePayloadOxum(value)
+	return err == nil && (octets != expectedOctets || count != expectedCount)
+}
+
+// Returns the time the payload manifests were last written, or the zero
+// time if one of them has not been written, so that every file counts
+// as modified.
+func (b *Bag) payloadManifestTime() time.Time {
+	var oldest time.Time
+	for _, manifest := range b.GetManifests(PayloadManifest) {
+		info, err := b.fsys.Stat(manifest.Name())
+		if err != nil {
+			return time.Time{}
+		}
+		if oldest.IsZero() || info.ModTime().Before(oldest) {
+			oldest = info.ModTime()
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,141 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBagUpdate(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/three.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "update-bag", []string{"md5", "sha256"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.SetAutoBagInfo(true)
+	bag.AddDir("src")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+
+	rBag, err := bagins.ReadBagFS(fsys, "update-bag", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	changes, errs := rBag.Update(nil)
+	if len(errs) > 0 || !changes.IsEmpty() {
+		t.Errorf("Expected no changes, got %+v, %v", changes, errs)
+	}
+
+	// Change the payload behind the bag's back.
+	writeMemFile(t, fsys, "update-bag/data/one.txt", "changed")
+	fsys.Remove("update-bag/data/two.txt")
+	writeMemFile(t, fsys, "update-bag/data/new/four.txt", "four")
+
+	changes, errs = rBag.Update(nil)
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors updating bag: %v", errs)
+	}
+	if len(changes.Added) != 1 || changes.Added[0] != "data/new/four.txt" ||
+		len(changes.Removed) != 1 || changes.Removed[0] != "data/two.txt" ||
+		len(changes.Modified) != 1 || changes.Modified[0] != "data/one.txt" {
+		t.Errorf("Wrong changes found: %+v", changes)
+	}
+	report := rBag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Bag should be valid after Update: %v", report.Errors())
+	}
+	if report = rBag.QuickValidate(); !report.IsValid() {
+		t.Errorf("Update did not update Payload-Oxum: %v", report.Errors())
+	}
+	data, _ := fs.ReadFile(fsys, "update-bag/bag-info.txt")
+	if !strings.Contains(string(data), "Payload-Oxum:  55.3") {
+		t.Errorf("Expected Payload-Oxum 55.3 in bag-info.txt:\n%s", data)
+	}
+
+	// Change files without moving their modification times forward, as
+	// cp -p does.
+	backdate := func(name string, contents string) {
+		writeMemFile(t, fsys, name, contents)
+		past := time.Now().Add(-48 * time.Hour)
+		fsys.Chtimes(name, past, past)
+	}
+	backdate("update-bag/data/one.txt", "changed again")
+	changes, errs = rBag.Update(nil)
+	if len(errs) > 0 || len(changes.Modified) != 3 {
+		t.Errorf("Expected the size change to rehash every file, got %+v, %v", changes, errs)
+	}
+	backdate("update-bag/data/one.txt", "CHANGED AGAIN")
+	if changes, _ = rBag.Update(nil); !changes.IsEmpty() {
+		t.Errorf("Expected a change of the same size to go unnoticed, got %+v", changes)
+	}
+	changes, errs = rBag.Update(&bagins.UpdateOptions{Rehash: true})
+	if len(errs) > 0 || len(changes.Modified) != 3 {
+		t.Errorf("Expected Rehash to rehash every file, got %+v, %v", changes, errs)
+	}
+	if report := rBag.Validate(); !report.IsValid() {
+		t.Errorf("Bag should be valid after a Rehash: %v", report.Errors())
+	}
+}
+
+func TestBagReplaceAndRemoveFile(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", FIXSTRING)
+	writeMemFile(t, fsys, "fixed.txt", "fixed")
+	bag, err := bagins.NewBagFS(fsys, ".", "replace-bag", []string{"md5"}, true, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddDir("src")
+	md5 := bag.GetManifest(bagins.PayloadManifest, "md5")
+
+	if err := bag.ReplaceFile("fixed.txt", "missing.txt"); err == nil {
+		t.Errorf("ReplaceFile should fail when there is no file to replace")
+	}
+	if err := bag.ReplaceFile("does-not-exist.txt", "one.txt"); err == nil {
+		t.Errorf("ReplaceFile should fail when the source does not exist")
+	}
+	if err := bag.ReplaceFile("fixed.txt", "../bagit.txt"); err == nil {
+		t.Errorf("ReplaceFile should fail for a path outside the payload")
+	}
+	if _, ok := md5.Data["bagit.txt"]; ok {
+		t.Errorf("ReplaceFile added a tag file to the payload manifest")
+	}
+	if data, _ := fs.ReadFile(fsys, "replace-bag/data/one.txt"); string(data) != FIXSTRING {
+		t.Errorf("A failed ReplaceFile changed the payload file")
+	}
+	if entries, _ := fs.ReadDir(fsys, "replace-bag/data"); len(entries) != 2 {
+		t.Errorf("A failed ReplaceFile left %d files in the payload", len(entries))
+	}
+
+	if err := bag.ReplaceFile("fixed.txt", "one.txt"); err != nil {
+		t.Fatalf("Unexpected error replacing file: %s", err)
+	}
+	if md5.Data["data/one.txt"] == FIXVALUE {
+		t.Errorf("ReplaceFile did not update the manifest")
+	}
+	if err := bag.RemoveFile("two.txt"); err != nil {
+		t.Fatalf("Unexpected error removing file: %s", err)
+	}
+	if _, ok := md5.Data["data/two.txt"]; ok {
+		t.Errorf("RemoveFile left the file in the manifest")
+	}
+	if err := bag.MoveFile("one.txt", "fixed/one.txt"); err != nil {
+		t.Fatalf("Unexpected error moving file: %s", err)
+	}
+	if _, ok := md5.Data["data/fixed/one.txt"]; !ok || len(md5.Data) != 1 {
+		t.Errorf("MoveFile did not rename the manifest entry: %v", md5.Data)
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	if report := bag.Validate(); !report.IsValid() {
+		t.Errorf("Bag should be valid: %v", report.Errors())
+	}
+}
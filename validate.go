@@ -0,0 +1,812 @@
+package bagins
+
+/*
+
+"It is not our part to master all the tides of the world, but to do what
+is in us for the succour of those years wherein we are set."
+
+- Gandalf the White
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProblemType describes the category of a problem found while
+// validating a bag.
+type ProblemType string
+
+const (
+	// bagit.txt does not exist in the bag root.
+	MissingBagItFile ProblemType = "missing_bagit_file"
+	// bagit.txt exists but is unreadable or does not contain the
+	// required fields.
+	InvalidBagItFile ProblemType = "invalid_bagit_file"
+	// The bag has no payload manifest.
+	NoPayloadManifest ProblemType = "no_payload_manifest"
+	// A file listed in a manifest does not exist in the bag.
+	MissingFile ProblemType = "missing_file"
+	// A file in the payload directory is not listed in a payload manifest.
+	UnmanifestedFile ProblemType = "unmanifested_file"
+	// The checksum of a file does not match its manifest entry.
+	ChecksumMismatch ProblemType = "checksum_mismatch"
+	// A file exists but could not be read to calculate its checksum.
+	UnreadableFile ProblemType = "unreadable_file"
+	// A file listed in a manifest does not exist in the bag, but is
+	// listed in fetch.txt. Bag.ResolveFetch() will download it.
+	UnfetchedFile ProblemType = "unfetched_file"
+	// A BagIt 1.0 bag uses only md5 or sha1 manifests. This is
+	// reported as a warning.
+	DeprecatedAlgorithm ProblemType = "deprecated_algorithm"
+	// bag-info.txt has no Payload-Oxum, so QuickValidate could not
+	// check the size of the payload. This is reported as a warning.
+	NoPayloadOxum ProblemType = "no_payload_oxum"
+	// The Payload-Oxum in bag-info.txt is not of the form octets.count.
+	InvalidPayloadOxum ProblemType = "invalid_payload_oxum"
+	// The number of bytes or files in the payload does not match
+	// the Payload-Oxum in bag-info.txt.
+	PayloadOxumMismatch ProblemType = "payload_oxum_mismatch"
+	// The number of entries in a payload manifest does not match the
+	// number of files in the payload.
+	ManifestCountMismatch ProblemType = "manifest_count_mismatch"
+	// The payload holds a symbolic link that the symlink policy does
+	// not allow, or that points outside the payload directory.
+	SymlinkNotAllowed ProblemType = "symlink_not_allowed"
+	// A manifest, tag manifest or fetch.txt lists a path that leads
+	// outside the bag. See UnsafePathError.
+	UnsafePath ProblemType = "unsafe_path"
+	// fetch.txt lists a file that is not in the payload directory.
+	// RFC 8493 only allows payload files to be fetched.
+	FetchOutsidePayload ProblemType = "fetch_outside_payload"
+)
+
+// ValidationProblem describes a single problem found while validating
+// a bag. Path and Manifest are relative to the bag root. Fields that do
+// not apply to the type of problem are left empty.
+type ValidationProblem struct {
+	Type      ProblemType
+	Path      string // File the problem concerns
+	Manifest  string // Manifest the problem was found through
+	Algorithm string // Checksum algorithm, for checksum problems
+	Expected  string // Checksum listed in the manifest
+	Actual    string // Checksum calculated from the file
+	Message   string // Human readable description
+}
+
+// Returns the human readable description of the problem, so that a
+// ValidationProblem can be used wherever an error is expected.
+func (p *ValidationProblem) Error() string {
+	return p.Message
+}
+
+// Returns the typed error for MissingFile, UnmanifestedFile and
+// ChecksumMismatch problems, so they can be found with errors.Is and
+// errors.As. Returns nil for other types of problem.
+func (p *ValidationProblem) Unwrap() error {
+	switch p.Type {
+	case MissingFile:
+		return &MissingFileError{Path: p.Path, Manifest: p.Manifest, Err: fs.ErrNotExist}
+	case UnmanifestedFile:
+		return &UnmanifestedFileError{Path: p.Path, Manifest: p.Manifest}
+	case ChecksumMismatch:
+		return &ChecksumMismatchError{Path: p.Path, Manifest: p.Manifest, Algorithm: p.Algorithm,
+			Expected: p.Expected, Actual: p.Actual}
+	}
+	return nil
+}
+
+// FileValidation holds the validation results for a single file in the
+// bag, keyed in ValidationReport.Files by its path relative to the bag
+// root.
+type FileValidation struct {
+	Path      string
+	Checksums map[string]string // Key is algorithm, value is the calculated digest
+	Problems  []*ValidationProblem
+}
+
+// Returns true if no problems were found with the file.
+func (f *FileValidation) IsValid() bool {
+	return len(f.Problems) == 0
+}
+
+// ValidationReport is returned by Bag.Validate() and describes every
+// problem found in the bag, as well as the results for each file.
+// Warnings describe things the BagIt spec discourages but which do not
+// make the bag invalid. See MarshalJSON for the report's JSON form.
+type ValidationReport struct {
+	BagPath    string
+	Version    string                     // BagIt version the bag was validated against
+	Algorithms []string                   // Algorithms of the bag's manifests, sorted
+	Files      map[string]*FileValidation // Key is path relative to the bag root
+	Problems   []*ValidationProblem
+	Warnings   []*ValidationProblem
+	Started    time.Time     // When validation started
+	Duration   time.Duration // How long validation took
+}
+
+// Returns a new, empty report for bag, started at started.
+func newValidationReport(bag bagContents, started time.Time) *ValidationReport {
+	algorithms := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, manifestType := range []string{PayloadManifest, TagManifest} {
+		for _, manifest := range bag.GetManifests(manifestType) {
+			if !seen[manifest.Algorithm()] {
+				seen[manifest.Algorithm()] = true
+				algorithms = append(algorithms, manifest.Algorithm())
+			}
+		}
+	}
+	sort.Strings(algorithms)
+	return &ValidationReport{
+		BagPath:    bag.Path(),
+		Version:    bag.Version(),
+		Algorithms: algorithms,
+		Files:      make(map[string]*FileValidation),
+		Problems:   make([]*ValidationProblem, 0),
+		Warnings:   make([]*ValidationProblem, 0),
+		Started:    started,
+	}
+}
+
+// Returns true if the report contains no problems. Warnings do not
+// make a bag invalid.
+func (r *ValidationReport) IsValid() bool {
+	return len(r.Problems) == 0
+}
+
+// Returns all problems of the specified type, or an empty slice.
+func (r *ValidationReport) ProblemsOfType(problemType ProblemType) []*ValidationProblem {
+	problems := make([]*ValidationProblem, 0)
+	for _, p := range r.Problems {
+		if p.Type == problemType {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// Returns the problems in the report as a slice of errors, for callers
+// that work with the []error values returned elsewhere in this library.
+func (r *ValidationReport) Errors() []error {
+	var errs []error
+	for _, p := range r.Problems {
+		errs = append(errs, p)
+	}
+	return errs
+}
+
+// Returns the results for the file at relativePath, creating
+// them if they do not exist yet.
+func (r *ValidationReport) file(relativePath string) *FileValidation {
+	fv, ok := r.Files[relativePath]
+	if !ok {
+		fv = &FileValidation{
+			Path:      relativePath,
+			Checksums: make(map[string]string),
+			Problems:  make([]*ValidationProblem, 0),
+		}
+		r.Files[relativePath] = fv
+	}
+	return fv
+}
+
+// Records a problem in the report, and in the results for the
+// problem's file if it concerns one.
+func (r *ValidationReport) addProblem(p *ValidationProblem) {
+	r.Problems = append(r.Problems, p)
+	if p.Path != "" {
+		fv := r.file(p.Path)
+		fv.Problems = append(fv.Problems, p)
+	}
+}
+
+// bagContents gives validation access to the contents of a bag, so the
+// same checks can run against a bag directory and a serialized bag.
+type bagContents interface {
+	Path() string
+	Version() string
+	GetManifests(manifestType string) []*Manifest
+	// Returns the raw bytes of bagit.txt, or an error for which
+	// os.IsNotExist is true if the bag has none.
+	readBagItFile() ([]byte, error)
+	// Returns the sorted paths of all payload files, relative to the bag root.
+	listPayloadFiles() ([]string, error)
+	// Returns the paths in fetch.txt in the form used as manifest keys.
+	fetchEntryPaths() []string
+	isFetchEntry(pathInBag string) bool
+	// Returns an *UnsafePathError if pathInBag, read from source,
+	// leads outside the bag.
+	checkPath(pathInBag string, source string) error
+	fileExists(pathInBag string) bool
+	fileChecksum(pathInBag string, manifest *Manifest) (string, error)
+	// Returns the path of the manifest relative to the bag root.
+	manifestPath(manifest *Manifest) string
+}
+
+/*
+Validate checks the bag on disk against the manifests the bag is tracking
+and returns a report of everything that is wrong with it. Bags created
+with NewBag should be saved before they are validated.
+
+Validate checks that:
+
+bagit.txt exists and contains the BagIt-Version and
+Tag-File-Character-Encoding fields, and that the version is supported.
+
+The bag has at least one payload manifest.
+
+Every file in the payload directory is listed in every payload manifest
+for BagIt 1.0 bags, or in at least one payload manifest for 0.97 bags.
+
+Every file listed in a payload or tag manifest exists in the bag. Files
+that are missing but listed in fetch.txt are reported as UnfetchedFile
+rather than MissingFile. Files in fetch.txt must also be listed in the
+payload manifests, and must be in the data directory. Those that are not
+are reported as FetchOutsidePayload.
+
+The checksum of every file listed in a payload or tag manifest matches
+the manifest entry.
+
+No path in a manifest, tag manifest or fetch.txt leads outside the bag.
+Unsafe paths are reported as UnsafePath, and the files are not read.
+
+For BagIt 1.0 bags, a DeprecatedAlgorithm warning is added if all of the
+payload manifests use md5 or sha1.
+
+Each file is read only once, however many manifests list it, by the
+workers set with SetWorkers. See CheckFixity.
+
+Problems are reported by type, see ProblemType, rather than returned as
+errors. Call ValidationReport.IsValid() to see whether any were found.
+*/
+func (b *Bag) Validate() *ValidationReport {
+	started := time.Now()
+	results := make(map[string]*FixityResult)
+	for _, result := range b.CheckFixity() {
+		results[result.Path] = result
+	}
+	return validateBag(&checkedBag{Bag: b, results: results}, started)
+}
+
+/*
+QuickValidate checks that the bag looks complete without calculating any
+checksums, so it is fast enough to run when a bag is received. A full
+Validate can be run later. QuickValidate checks that:
+
+bagit.txt is valid and the bag has at least one payload manifest, as
+Validate does.
+
+The number of bytes and files in the payload directory matches the
+Payload-Oxum in bag-info.txt. Files listed in fetch.txt that have not
+been fetched are counted using the lengths in fetch.txt. If a length is
+unknown, only the number of files is checked. Entries in fetch.txt that
+lead outside the bag are reported as UnsafePath, and those outside the
+data directory as FetchOutsidePayload, and neither is counted.
+
+Each payload manifest lists as many files as there are in the payload
+for BagIt 1.0 bags. For 0.97 bags, the payload manifests together must
+list that many files.
+
+A bag without a Payload-Oxum gets a NoPayloadOxum warning and only its
+manifest counts are checked. The report has no per-file results.
+*/
+func (b *Bag) QuickValidate() *ValidationReport {
+	report := newValidationReport(b, time.Now())
+
+	validateBagItFile(b, report)
+
+	payloadManifests := b.GetManifests(PayloadManifest)
+	if len(payloadManifests) == 0 {
+		report.addProblem(&ValidationProblem{
+			Type:    NoPayloadManifest,
+			Message: fmt.Sprintf("Bag %s has no payload manifest", b.Path()),
+		})
+	}
+
+	// Count what is in the payload, and what will be once the
+	// files in fetch.txt have been fetched.
+	octets, count := b.payload.OctetStreamSum()
+	octetsKnown := true
+	for _, entry := range b.FetchEntries() {
+		if err := b.checkPath(filepath.FromSlash(entry.Path), "fetch.txt"); err != nil {
+			addUnsafePathProblem(err, filepath.FromSlash(entry.Path), "", report)
+			continue
+		}
+		if !isPayloadPath(entry.Path) {
+			addFetchOutsidePayloadProblem(filepath.FromSlash(entry.Path), report)
+			continue
+		}
+		if b.fileExists(filepath.FromSlash(entry.Path)) {
+			continue
+		}
+		count++
+		if entry.Length == FetchLengthUnknown {
+			octetsKnown = false
+		} else {
+			octets += entry.Length
+		}
+	}
+
+	checkPayloadOxum(b, octets, octetsKnown, count, report)
+
+	if b.Version() == BagItVersion10 {
+		for _, manifest := range payloadManifests {
+			checkManifestCount(b.manifestPath(manifest), len(manifest.Data), count, report)
+		}
+	} else if len(payloadManifests) > 0 {
+		listed := make(map[string]bool)
+		for _, manifest := range payloadManifests {
+			for pathInBag := range manifest.Data {
+				listed[pathInBag] = true
+			}
+		}
+		checkManifestCount("the payload manifests", len(listed), count, report)
+	}
+
+	report.Duration = time.Since(report.Started)
+	return report
+}
+
+// Compares the size of the payload with the Payload-Oxum in bag-info.txt.
+func checkPayloadOxum(b *Bag, octets int64, octetsKnown bool, count int, report *ValidationReport) {
+	value, err := b.readPayloadOxum()
+	if err != nil {
+		report.addProblem(&ValidationProblem{
+			Type:    InvalidPayloadOxum,
+			Path:    "bag-info.txt",
+			Message: fmt.Sprintf("Unable to read bag-info.txt: %v", err),
+		})
+		return
+	}
+	if value == "" {
+		report.Warnings = append(report.Warnings, &ValidationProblem{
+			Type:    NoPayloadOxum,
+			Path:    "bag-info.txt",
+			Message: "bag-info.txt has no Payload-Oxum, so the payload size was not checked",
+		})
+		return
+	}
+	expectedOctets, expectedCount, err := parsePayloadOxum(value)
+	if err != nil {
+		report.addProblem(&ValidationProblem{
+			Type:    InvalidPayloadOxum,
+			Path:    "bag-info.txt",
+			Message: err.Error(),
+		})
+		return
+	}
+	if octetsKnown && octets != expectedOctets {
+		report.addProblem(&ValidationProblem{
+			Type:     PayloadOxumMismatch,
+			Expected: fmt.Sprintf("%d", expectedOctets),
+			Actual:   fmt.Sprintf("%d", octets),
+			Message: fmt.Sprintf("Payload-Oxum says the payload has %d bytes, but it has %d",
+				expectedOctets, octets),
+		})
+	}
+	if count != expectedCount {
+		report.addProblem(&ValidationProblem{
+			Type:     PayloadOxumMismatch,
+			Expected: fmt.Sprintf("%d", expectedCount),
+			Actual:   fmt.Sprintf("%d", count),
+			Message: fmt.Sprintf("Payload-Oxum says the payload has %d files, but it has %d",
+				expectedCount, count),
+		})
+	}
+}
+
+// Compares the number of files listed in a manifest with the
+// number of files in the payload.
+func checkManifestCount(manifestName string, listed int, count int, report *ValidationReport) {
+	if listed == count {
+		return
+	}
+	report.addProblem(&ValidationProblem{
+		Type:     ManifestCountMismatch,
+		Manifest: manifestName,
+		Expected: fmt.Sprintf("%d", count),
+		Actual:   fmt.Sprintf("%d", listed),
+		Message: fmt.Sprintf("%s lists %d files, but the payload has %d",
+			manifestName, listed, count),
+	})
+}
+
+// Returns the Payload-Oxum from bag-info.txt, reading the file if
+// ReadBag did not parse it. Returns an empty string if the bag has
+// no bag-info.txt or it has no Payload-Oxum.
+func (b *Bag) readPayloadOxum() (string, error) {
+	if tf, err := b.BagInfo(); err == nil {
+		return tf.Data.Value(PayloadOxum), nil
+	}
+	bagInfoPath := filepath.Join(b.Path(), "bag-info.txt")
+	if _, err := b.fsys.Stat(bagInfoPath); os.IsNotExist(err) {
+		return "", nil
+	}
+	tf, errs := ReadTagFileFS(b.fsys, bagInfoPath)
+	if len(errs) > 0 {
+		return "", errs[0]
+	}
+	return tf.Data.Value(PayloadOxum), nil
+}
+
+// Runs the checks described for Bag.Validate() against any kind of bag,
+// timing the report from started.
+func validateBag(bag bagContents, started time.Time) *ValidationReport {
+	report := newValidationReport(bag, started)
+
+	validateBagItFile(bag, report)
+
+	payloadManifests := bag.GetManifests(PayloadManifest)
+	if len(payloadManifests) == 0 {
+		report.addProblem(&ValidationProblem{
+			Type:    NoPayloadManifest,
+			Message: fmt.Sprintf("Bag %s has no payload manifest", bag.Path()),
+		})
+	}
+
+	payloadFiles, err := bag.listPayloadFiles()
+	if err != nil {
+		addListingProblems(err, report)
+	}
+	for _, pathInBag := range payloadFiles {
+		report.file(pathInBag)
+		checkManifestCoverage(bag, pathInBag, payloadManifests, report)
+	}
+	for _, pathInBag := range bag.fetchEntryPaths() {
+		if err := bag.checkPath(pathInBag, "fetch.txt"); err != nil {
+			addUnsafePathProblem(err, pathInBag, "", report)
+			continue
+		}
+		if !isPayloadPath(filepath.ToSlash(pathInBag)) {
+			addFetchOutsidePayloadProblem(pathInBag, report)
+			continue
+		}
+		checkManifestCoverage(bag, pathInBag, payloadManifests, report)
+	}
+	if bag.Version() == BagItVersion10 && len(payloadManifests) > 0 {
+		checkForDeprecatedAlgorithms(payloadManifests, report)
+	}
+
+	for _, manifest := range payloadManifests {
+		validateManifestEntries(bag, manifest, report)
+	}
+	for _, manifest := range bag.GetManifests(TagManifest) {
+		validateManifestEntries(bag, manifest, report)
+	}
+
+	report.Duration = time.Since(report.Started)
+	return report
+}
+
+// Checks that a payload file is listed in every payload manifest for
+// BagIt 1.0 bags, or in at least one payload manifest for 0.97 bags.
+func checkManifestCoverage(bag bagContents, pathInBag string, manifests []*Manifest, report *ValidationReport) {
+	if bag.Version() == BagItVersion10 {
+		checkListedInEveryManifest(bag, pathInBag, manifests, report)
+	} else {
+		checkListedInAnyManifest(pathInBag, manifests, report)
+	}
+}
+
+// Checks that a payload file is listed in every payload manifest,
+// as BagIt 1.0 requires.
+func checkListedInEveryManifest(bag bagContents, pathInBag string, manifests []*Manifest, report *ValidationReport) {
+	for _, manifest := range manifests {
+		if _, ok := manifest.Data[pathInBag]; !ok {
+			report.addProblem(&ValidationProblem{
+				Type:     UnmanifestedFile,
+				Path:     pathInBag,
+				Manifest: bag.manifestPath(manifest),
+				Message: fmt.Sprintf("File %s is not listed in %s",
+					pathInBag, bag.manifestPath(manifest)),
+			})
+		}
+	}
+}
+
+// Checks that a payload file is listed in at least one payload
+// manifest, which is all BagIt 0.97 requires.
+func checkListedInAnyManifest(pathInBag string, manifests []*Manifest, report *ValidationReport) {
+	for _, manifest := range manifests {
+		if _, ok := manifest.Data[pathInBag]; ok {
+			return
+		}
+	}
+	if len(manifests) > 0 {
+		report.addProblem(&ValidationProblem{
+			Type:    UnmanifestedFile,
+			Path:    pathInBag,
+			Message: fmt.Sprintf("File %s is not listed in any payload manifest", pathInBag),
+		})
+	}
+}
+
+// Adds a warning if all of the payload manifests use algorithms that
+// RFC 8493 says should no longer be used on their own.
+func checkForDeprecatedAlgorithms(manifests []*Manifest, report *ValidationReport) {
+	for _, manifest := range manifests {
+		if manifest.Algorithm() != "md5" && manifest.Algorithm() != "sha1" {
+			return
+		}
+	}
+	report.Warnings = append(report.Warnings, &ValidationProblem{
+		Type: DeprecatedAlgorithm,
+		Message: "BagIt 1.0 bags should have a sha256 or sha512 payload manifest. " +
+			"md5 and sha1 should not be used on their own.",
+	})
+}
+
+// Checks that bagit.txt exists and contains the required fields, as
+// described in http://tools.ietf.org/html/draft-kunze-bagit-13#section-2.1.1
+// and https://tools.ietf.org/html/rfc8493#section-2.1.1
+func validateBagItFile(bag bagContents, report *ValidationReport) {
+	data, err := bag.readBagItFile()
+	if os.IsNotExist(err) {
+		report.addProblem(&ValidationProblem{
+			Type:    MissingBagItFile,
+			Path:    "bagit.txt",
+			Message: fmt.Sprintf("Bag %s has no bagit.txt file", bag.Path()),
+		})
+		return
+	} else if err != nil {
+		report.addProblem(&ValidationProblem{
+			Type:    InvalidBagItFile,
+			Path:    "bagit.txt",
+			Message: fmt.Sprintf("Unable to read bagit.txt: %v", err),
+		})
+		return
+	}
+	fields, errs := parseTagFields(bytes.NewReader(data), "bagit.txt")
+	if len(errs) > 0 {
+		for _, err := range errs {
+			report.addProblem(&ValidationProblem{
+				Type:    InvalidBagItFile,
+				Path:    "bagit.txt",
+				Message: fmt.Sprintf("Unable to parse bagit.txt: %v", err),
+			})
+		}
+		return
+	}
+	expectedLabels := []string{"BagIt-Version", "Tag-File-Character-Encoding"}
+	if len(fields) != len(expectedLabels) {
+		report.addProblem(&ValidationProblem{
+			Type: InvalidBagItFile,
+			Path: "bagit.txt",
+			Message: fmt.Sprintf("bagit.txt should contain exactly %d fields "+
+				"but contains %d", len(expectedLabels), len(fields)),
+		})
+	}
+	for i, label := range expectedLabels {
+		if i >= len(fields) || fields[i].Label() != label {
+			report.addProblem(&ValidationProblem{
+				Type:    InvalidBagItFile,
+				Path:    "bagit.txt",
+				Message: fmt.Sprintf("Field %d of bagit.txt should be %s", i+1, label),
+			})
+		} else if fields[i].Value() == "" {
+			report.addProblem(&ValidationProblem{
+				Type:    InvalidBagItFile,
+				Path:    "bagit.txt",
+				Message: fmt.Sprintf("Field %s in bagit.txt has no value", label),
+			})
+		}
+	}
+	if len(fields) > 0 && fields[0].Label() == "BagIt-Version" {
+		version := fields[0].Value()
+		if version != "" && !isSupportedVersion(version) {
+			report.addProblem(&ValidationProblem{
+				Type: InvalidBagItFile,
+				Path: "bagit.txt",
+				Message: fmt.Sprintf("BagIt-Version %s is not supported. Must be %s or %s",
+					version, BagItVersion097, BagItVersion10),
+			})
+		}
+		if version == BagItVersion10 && hasByteOrderMark(data) {
+			report.addProblem(&ValidationProblem{
+				Type:    InvalidBagItFile,
+				Path:    "bagit.txt",
+				Message: "bagit.txt must not begin with a byte order mark",
+			})
+		}
+	}
+}
+
+// Checks that every file listed in the manifest exists and
+// has the checksum the manifest says it should.
+func validateManifestEntries(bag bagContents, manifest *Manifest, report *ValidationReport) {
+	manifestName := bag.manifestPath(manifest)
+
+	// Sort the entries so the problems in the report come out
+	// in the same order on every run.
+	entries := make([]string, 0, len(manifest.Data))
+	for pathInBag := range manifest.Data {
+		entries = append(entries, pathInBag)
+	}
+	sort.Strings(entries)
+
+	for _, pathInBag := range entries {
+		expected := manifest.Data[pathInBag]
+		if err := bag.checkPath(pathInBag, manifestName); err != nil {
+			addUnsafePathProblem(err, pathInBag, manifestName, report)
+			continue
+		}
+		fv := report.file(pathInBag)
+		exists := bag.fileExists(pathInBag)
+		if !exists && bag.isFetchEntry(pathInBag) {
+			report.addProblem(&ValidationProblem{
+				Type:     UnfetchedFile,
+				Path:     pathInBag,
+				Manifest: manifestName,
+				Message: fmt.Sprintf("File %s is listed in fetch.txt but has not been fetched",
+					pathInBag),
+			})
+			continue
+		} else if !exists {
+			report.addProblem(&ValidationProblem{
+				Type:     MissingFile,
+				Path:     pathInBag,
+				Manifest: manifestName,
+				Message: fmt.Sprintf("File %s is listed in %s but does not exist",
+					pathInBag, manifestName),
+			})
+			continue
+		}
+		actual, err := bag.fileChecksum(pathInBag, manifest)
+		if err != nil {
+			report.addProblem(&ValidationProblem{
+				Type:      UnreadableFile,
+				Path:      pathInBag,
+				Manifest:  manifestName,
+				Algorithm: manifest.Algorithm(),
+				Message: fmt.Sprintf("Error calculating %s checksum for %s: %v",
+					manifest.Algorithm(), pathInBag, err),
+			})
+			continue
+		}
+		fv.Checksums[manifest.Algorithm()] = actual
+		if !strings.EqualFold(actual, expected) {
+			report.addProblem(&ValidationProblem{
+				Type:      ChecksumMismatch,
+				Path:      pathInBag,
+				Manifest:  manifestName,
+				Algorithm: manifest.Algorithm(),
+				Expected:  expected,
+				Actual:    actual,
+				Message: fmt.Sprintf("%s checksum for %s should be %s according to %s, "+
+					"but was %s", manifest.Algorithm(), pathInBag, expected,
+					manifestName, actual),
+			})
+		}
+	}
+}
+
+// Adds a problem for a path from manifestName, or from fetch.txt if
+// manifestName is empty, that leads outside the bag.
+func addUnsafePathProblem(err error, pathInBag string, manifestName string, report *ValidationReport) {
+	report.addProblem(&ValidationProblem{
+		Type:     UnsafePath,
+		Path:     pathInBag,
+		Manifest: manifestName,
+		Message:  err.Error(),
+	})
+}
+
+// Adds a problem for a path in fetch.txt that is not in the payload.
+func addFetchOutsidePayloadProblem(pathInBag string, report *ValidationReport) {
+	report.addProblem(&ValidationProblem{
+		Type:    FetchOutsidePayload,
+		Path:    pathInBag,
+		Message: fmt.Sprintf("File %s is listed in fetch.txt but is not in the data directory", pathInBag),
+	})
+}
+
+// Adds a problem for each of the errors from listing the payload files.
+// Links the symlink policy does not allow are reported one by one.
+func addListingProblems(err error, report *ValidationReport) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		var pathErr *fs.PathError
+		if isSymlinkError(err) && errors.As(err, &pathErr) {
+			report.addProblem(&ValidationProblem{
+				Type:    SymlinkNotAllowed,
+				Path:    pathErr.Path,
+				Message: fmt.Sprintf("Symbolic link %s is not allowed: %v", pathErr.Path, pathErr.Err),
+			})
+			continue
+		}
+		report.addProblem(&ValidationProblem{
+			Type:    UnreadableFile,
+			Path:    "data",
+			Message: fmt.Sprintf("Unable to list payload files: %v", err),
+		})
+	}
+}
+
+// Returns the paths of all files in the payload directory,
+// relative to the bag root, in sorted order. Symbolic links are
+// handled by the payload's symlink policy, with the payload directory
+// as the root. Links the policy does not allow are left out and
+// returned together as the error, with paths relative to the bag root.
+func (b *Bag) listPayloadFiles() ([]string, error) {
+	files := make([]string, 0)
+	var linkErrs []error
+	visit := func(pathToFile string, info fs.DirEntry, err error) error {
+		if isSymlinkError(err) {
+			linkErrs = append(linkErrs, symlinkError(b.relativePath(pathToFile), errors.Unwrap(err)))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, b.relativePath(pathToFile))
+		}
+		return nil
+	}
+	walker := newLinkWalker(b.fsys, b.payload.Name(), b.payload.symlinks)
+	if err := walker.walk(visit, nil); err != nil {
+		return files, err
+	}
+	sort.Strings(files)
+	return files, errors.Join(linkErrs...)
+}
+
+// Returns the raw bytes of the bag's bagit.txt file.
+func (b *Bag) readBagItFile() ([]byte, error) {
+	return fs.ReadFile(b.fsys, filepath.Join(b.Path(), "bagit.txt"))
+}
+
+// Returns the paths in fetch.txt with the OS path separator, as
+// they appear in the manifests of a bag on disk.
+func (b *Bag) fetchEntryPaths() []string {
+	paths := make([]string, 0)
+	for _, entry := range b.FetchEntries() {
+		paths = append(paths, filepath.FromSlash(entry.Path))
+	}
+	return paths
+}
+
+// Returns an *UnsafePathError if pathInBag leads outside the bag.
+func (b *Bag) checkPath(pathInBag string, source string) error {
+	_, err := b.safeJoin(pathInBag, source)
+	return err
+}
+
+// Returns true if the file at pathInBag exists.
+func (b *Bag) fileExists(pathInBag string) bool {
+	_, err := b.fsys.Stat(filepath.Join(b.Path(), pathInBag))
+	return err == nil
+}
+
+// Calculates the checksum of the file at pathInBag with the
+// manifest's algorithm.
+func (b *Bag) fileChecksum(pathInBag string, manifest *Manifest) (string, error) {
+	return fileChecksum(b.fsys, filepath.Join(b.Path(), pathInBag), manifest.hashFunc())
+}
+
+// Returns the path of the manifest relative to the bag root.
+func (b *Bag) manifestPath(manifest *Manifest) string {
+	return b.relativePath(manifest.Name())
+}
+
+// Returns pathToFile relative to the bag root. Paths that are
+// not inside the bag are returned unchanged.
+func (b *Bag) relativePath(pathToFile string) string {
+	rel, err := filepath.Rel(b.Path(), pathToFile)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return pathToFile
+	}
+	return rel
+}
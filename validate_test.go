@@ -0,0 +1,313 @@
+package bagins_test
+
+import (
+	"github.com/APTrust/bagins"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sets up a saved bag with tag manifests and two payload files.
+func setupValidationBag(bagName string) (*bagins.Bag, error) {
+	bag, err := setupCustomBag(bagName)
+	if err != nil {
+		return nil, err
+	}
+	srcDir, err := ioutil.TempDir("", "_GOTEST_VALIDATE_SRC_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(srcDir)
+	for _, name := range []string{"one.txt", "two.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(FIXSTRING), 0644); err != nil {
+			return nil, err
+		}
+	}
+	if errs := bag.AddDir(srcDir); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if errs := bag.Save(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return bag, nil
+}
+
+func TestValidate(t *testing.T) {
+	bagName := "__GO_TEST_VALIDATE__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := setupValidationBag(bagName)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up validation bag: %s", err)
+	}
+
+	// It should find no problems with a freshly saved bag.
+	report := bag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Expected a valid bag, got problems: %v", report.Errors())
+	}
+	fv, ok := report.Files[filepath.Join("data", "one.txt")]
+	if !ok {
+		t.Fatalf("Report has no results for data/one.txt")
+	}
+	if fv.Checksums["md5"] != FIXVALUE {
+		t.Errorf("Expected md5 %s for data/one.txt, got %s", FIXVALUE, fv.Checksums["md5"])
+	}
+
+	// It should find the same results when the bag is read back from disk.
+	rBag, err := bagins.ReadBag(bagPath, []string{"bagit.txt"})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if report := rBag.Validate(); !report.IsValid() {
+		t.Errorf("Expected a valid bag after ReadBag, got problems: %v", report.Errors())
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	bagName := "__GO_TEST_VALIDATE_PROBLEMS__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	if _, err := setupValidationBag(bagName); err != nil {
+		t.Fatalf("Unexpected error setting up validation bag: %s", err)
+	}
+
+	// Damage the bag in every way we can think of.
+	os.Remove(filepath.Join(bagPath, "data", "one.txt"))
+	ioutil.WriteFile(filepath.Join(bagPath, "data", "two.txt"), []byte("Corrupted"), 0644)
+	ioutil.WriteFile(filepath.Join(bagPath, "data", "three.txt"), []byte(FIXSTRING), 0644)
+	ioutil.WriteFile(filepath.Join(bagPath, "bag-info.txt"), []byte("Changed: yes\n"), 0644)
+
+	bag, err := bagins.ReadBag(bagPath, []string{"bagit.txt"})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	report := bag.Validate()
+	if report.IsValid() {
+		t.Fatalf("Damaged bag should not be valid")
+	}
+
+	one := filepath.Join("data", "one.txt")
+	two := filepath.Join("data", "two.txt")
+	three := filepath.Join("data", "three.txt")
+
+	// data/one.txt is missing from both payload manifests.
+	missing := report.ProblemsOfType(bagins.MissingFile)
+	if len(missing) != 2 {
+		t.Errorf("Expected 2 missing file problems, got %d", len(missing))
+	}
+	for _, p := range missing {
+		if p.Path != one {
+			t.Errorf("Expected missing file %s, got %s", one, p.Path)
+		}
+	}
+
+	// data/three.txt is not in either payload manifest. This is
+	// a 0.97 bag, so that's only one problem.
+	unmanifested := report.ProblemsOfType(bagins.UnmanifestedFile)
+	if len(unmanifested) != 1 {
+		t.Errorf("Expected 1 unmanifested file problem, got %d", len(unmanifested))
+	}
+	for _, p := range unmanifested {
+		if p.Path != three {
+			t.Errorf("Expected unmanifested file %s, got %s", three, p.Path)
+		}
+	}
+
+	// data/two.txt and bag-info.txt fail in both payload or both
+	// tag manifests respectively.
+	mismatches := report.ProblemsOfType(bagins.ChecksumMismatch)
+	if len(mismatches) != 4 {
+		t.Errorf("Expected 4 checksum mismatches, got %d", len(mismatches))
+	}
+	for _, p := range mismatches {
+		if p.Path != two && p.Path != "bag-info.txt" {
+			t.Errorf("Unexpected checksum mismatch for %s", p.Path)
+		}
+		if p.Expected == p.Actual || p.Algorithm == "" || p.Manifest == "" {
+			t.Errorf("Checksum mismatch for %s is missing details: %v", p.Path, p)
+		}
+	}
+	if fv := report.Files[two]; fv == nil || fv.IsValid() {
+		t.Errorf("Expected per-file problems for %s", two)
+	}
+	if len(report.Problems) != 7 {
+		t.Errorf("Expected 7 problems, got %d: %v", len(report.Problems), report.Errors())
+	}
+}
+
+func TestValidateBagItFile(t *testing.T) {
+	bagName := "__GO_TEST_VALIDATE_BAGIT__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := setupTestBag(bagName)
+	if err != nil {
+		t.Fatalf("Unexpected error setting up bag: %s", err)
+	}
+
+	// It should complain about bagit.txt with missing fields.
+	ioutil.WriteFile(filepath.Join(bagPath, "bagit.txt"), []byte("BagIt-Version: 0.97\n"), 0644)
+	report := bag.Validate()
+	if len(report.ProblemsOfType(bagins.InvalidBagItFile)) == 0 {
+		t.Errorf("Expected an invalid bagit.txt problem")
+	}
+
+	// It should complain when bagit.txt does not exist.
+	os.Remove(filepath.Join(bagPath, "bagit.txt"))
+	report = bag.Validate()
+	if len(report.ProblemsOfType(bagins.MissingBagItFile)) != 1 {
+		t.Errorf("Expected a missing bagit.txt problem")
+	}
+}
+
+func TestValidateVersion10(t *testing.T) {
+	bagName := "__GO_TEST_VALIDATE_V10__"
+	bagPath := filepath.Join(os.TempDir(), bagName)
+	defer os.RemoveAll(bagPath)
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5", "sha256"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	fi, _ := ioutil.TempFile("", "TEST_GO_VALIDATE_V10_")
+	fi.WriteString(FIXSTRING)
+	fi.Close()
+	defer os.Remove(fi.Name())
+	bag.AddFile(fi.Name(), "one.txt")
+	bag.Save()
+
+	report := bag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Expected a valid bag, got problems: %v", report.Errors())
+	}
+	if report.Version != bagins.BagItVersion10 {
+		t.Errorf("Expected report version %s, got %s", bagins.BagItVersion10, report.Version)
+	}
+	if len(report.Warnings) != 0 {
+		t.Errorf("Expected no warnings for a bag with a sha256 manifest, got %d", len(report.Warnings))
+	}
+
+	// Every payload manifest must list every payload file in 1.0.
+	delete(bag.GetManifest(bagins.PayloadManifest, "sha256").Data, filepath.Join("data", "one.txt"))
+	report = bag.Validate()
+	unmanifested := report.ProblemsOfType(bagins.UnmanifestedFile)
+	if len(unmanifested) != 1 {
+		t.Fatalf("Expected 1 unmanifested file problem, got %d", len(unmanifested))
+	}
+	if unmanifested[0].Manifest != "manifest-sha256.txt" {
+		t.Errorf("Expected problem in manifest-sha256.txt, got '%s'", unmanifested[0].Manifest)
+	}
+
+	// A byte order mark in bagit.txt makes the bag invalid.
+	bagItPath := filepath.Join(bagPath, "bagit.txt")
+	content, _ := ioutil.ReadFile(bagItPath)
+	ioutil.WriteFile(bagItPath, append([]byte("\xEF\xBB\xBF"), content...), 0644)
+	if len(bag.Validate().ProblemsOfType(bagins.InvalidBagItFile)) != 1 {
+		t.Errorf("Expected an invalid bagit.txt problem for a byte order mark")
+	}
+}
+
+func TestValidateDeprecatedAlgorithm(t *testing.T) {
+	bagName := "__GO_TEST_VALIDATE_DEPRECATED__"
+	defer os.RemoveAll(filepath.Join(os.TempDir(), bagName))
+	bag, err := bagins.NewBag(os.TempDir(), bagName, []string{"md5", "sha1"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	report := bag.Validate()
+	if !report.IsValid() {
+		t.Errorf("Warnings should not make the bag invalid: %v", report.Errors())
+	}
+	if len(report.Warnings) != 1 || report.Warnings[0].Type != bagins.DeprecatedAlgorithm {
+		t.Errorf("Expected one deprecated algorithm warning, got %v", report.Warnings)
+	}
+}
+
+func TestQuickValidate(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	writeMemFile(t, fsys, "src/two.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "quick-bag", []string{"md5", "sha256"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+
+	// Without a Payload-Oxum, only the manifests can be counted.
+	bag.AddDir("src")
+	bag.Save()
+	report := bag.QuickValidate()
+	if !report.IsValid() || len(report.Warnings) != 1 || report.Warnings[0].Type != bagins.NoPayloadOxum {
+		t.Errorf("Expected a valid bag with a NoPayloadOxum warning, got %v, %v",
+			report.Errors(), report.Warnings)
+	}
+
+	bag.SetAutoBagInfo(true)
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	rBag, err := bagins.ReadBagFS(fsys, "quick-bag", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	report = rBag.QuickValidate()
+	if !report.IsValid() || len(report.Warnings) != 0 {
+		t.Errorf("Expected a valid bag, got %v, %v", report.Errors(), report.Warnings)
+	}
+
+	// A file that arrived without being bagged should show up in
+	// the Payload-Oxum and in the manifest counts.
+	writeMemFile(t, fsys, "quick-bag/data/extra.txt", "extra")
+	report = rBag.QuickValidate()
+	mismatches := report.ProblemsOfType(bagins.PayloadOxumMismatch)
+	if len(mismatches) != 2 || mismatches[0].Expected != "88" || mismatches[0].Actual != "93" ||
+		mismatches[1].Expected != "2" || mismatches[1].Actual != "3" {
+		t.Errorf("Expected byte and file count mismatches, got %v", report.Errors())
+	}
+	counts := report.ProblemsOfType(bagins.ManifestCountMismatch)
+	if len(counts) != 2 || counts[0].Manifest != "manifest-md5.txt" || counts[0].Actual != "2" {
+		t.Errorf("Expected a count mismatch for each manifest, got %v", counts)
+	}
+	if len(report.Files) != 0 {
+		t.Errorf("QuickValidate should not check files one by one")
+	}
+
+	writeMemFile(t, fsys, "quick-bag/bag-info.txt", "Payload-Oxum: 88\n")
+	rBag, _ = bagins.ReadBagFS(fsys, "quick-bag", nil)
+	report = rBag.QuickValidate()
+	if len(report.ProblemsOfType(bagins.InvalidPayloadOxum)) != 1 {
+		t.Errorf("Expected an invalid Payload-Oxum, got %v", report.Errors())
+	}
+}
+
+func TestValidateUppercaseChecksums(t *testing.T) {
+	fsys := bagins.NewMemFileSystem()
+	writeMemFile(t, fsys, "src/one.txt", FIXSTRING)
+	bag, err := bagins.NewBagFS(fsys, ".", "upper-bag", []string{"sha256"}, false, bagins.BagItVersion10)
+	if err != nil {
+		t.Fatalf("Unexpected error creating bag: %s", err)
+	}
+	bag.AddDir("src")
+	if errs := bag.Save(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors saving bag: %v", errs)
+	}
+	data, _ := fs.ReadFile(fsys, "upper-bag/manifest-sha256.txt")
+	fields := strings.SplitN(string(data), " ", 2)
+	writeMemFile(t, fsys, "upper-bag/manifest-sha256.txt", strings.ToUpper(fields[0])+" "+fields[1])
+
+	rBag, err := bagins.ReadBagWithOptions("upper-bag", []string{},
+		&bagins.ReadBagOptions{FileSystem: fsys, ParseMode: bagins.ParseStrict})
+	if err != nil {
+		t.Fatalf("Unexpected error reading bag: %s", err)
+	}
+	if report := rBag.Validate(); !report.IsValid() {
+		t.Errorf("Uppercase checksums should be valid: %v", report.Errors())
+	}
+	if errs := rBag.RunChecksums(); len(errs) > 0 {
+		t.Errorf("Uppercase checksums should match: %v", errs)
+	}
+	if errs := rBag.GetManifest(bagins.PayloadManifest, "sha256").RunChecksums(); len(errs) > 0 {
+		t.Errorf("Uppercase checksums should match: %v", errs)
+	}
+}
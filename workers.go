@@ -0,0 +1,65 @@
+package bagins
+
+/*
+
+"Such is oft the course of deeds that move the wheels of the world:
+small hands do them because they must, while the eyes of the great are
+elsewhere."
+
+- Elrond
+
+*/
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Returns the number of workers to use for a setting of workers. Zero or
+// less means one worker per CPU.
+func workerCount(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// Calls fn once for each index from 0 to count-1, using up to workers
+// goroutines, and returns when all of the calls have finished. fn should
+// store its results by index, so they come out in the same order no
+// matter how the work was scheduled. Once ctx is done, no more calls
+// are started, so some indexes may be skipped.
+func runWorkers(ctx context.Context, workers int, count int, fn func(i int)) {
+	workers = workerCount(workers)
+	if workers > count {
+		workers = count
+	}
+	if workers <= 1 {
+		for i := 0; i < count && ctx.Err() == nil; i++ {
+			fn(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+dispatch:
+	for i := 0; i < count; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,476 @@
+package bagins
+
+/*
+
+"The Road goes ever on and on
+Down from the door where it began."
+
+- Bilbo Baggins
+
+*/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats a BagWriter can serialize a bag to.
+const (
+	TarFormat     = "tar"
+	TarGzipFormat = "tar.gz"
+)
+
+/*
+BagWriter builds a bag directly into a tar or gzipped tar stream, without
+writing the bag to disk first. Payload files are copied into the stream
+and hashed in a single read, so they are only read once.
+
+Everything in the archive is under a single top-level directory with the
+name of the bag. bagit.txt is written when the BagWriter is created,
+payload files as they are added, and tag files, manifests and tag
+manifests when Close is called. Close must be called to finish the archive.
+
+example:
+
+	bw, err := NewBagWriter(w, "bag-34323", []string{"sha256"}, true,
+		bagins.BagItVersion10, bagins.TarGzipFormat)
+	bw.AddFile("/tmp/myfile.txt", "myfile.txt")
+	bw.AddTagfile("bag-info.txt")
+	err = bw.Close()
+*/
+type BagWriter struct {
+	name                    string // name of the bag's top-level directory
+	version                 string
+	tarWriter               *tar.Writer
+	gzipWriter              *gzip.Writer // nil unless format is TarGzipFormat
+	modTime                 time.Time
+	Manifests               []*Manifest
+	tagfiles                map[string]*TagFile // Key is relative path
+	tagfileOrder            []string
+	excludeFromTagManifests map[string]bool
+	dirs                    map[string]bool // directories already in the archive
+	paths                   map[string]bool // files added, so none is added twice
+	closed                  bool
+	err                     error // first error that left the archive unusable
+}
+
+/*
+Returns a BagWriter that writes the bag with the specified name to w in
+the specified format, either TarFormat or TarGzipFormat. The hashNames,
+createTagManifests and version params work as they do for NewBag.
+
+BagWriter does not close w.
+*/
+func NewBagWriter(w io.Writer, name string, hashNames []string, createTagManifests bool, version string, format string) (*BagWriter, error) {
+	if !isSupportedVersion(version) {
+		return nil, fmt.Errorf("Unsupported BagIt version '%s'. Must be %s or %s",
+			version, BagItVersion097, BagItVersion10)
+	}
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return nil, fmt.Errorf("Illegal bag name '%s'", name)
+	}
+
+	bw := new(BagWriter)
+	bw.name = name
+	bw.version = version
+	bw.modTime = time.Now()
+	bw.Manifests = make([]*Manifest, 0)
+	bw.tagfiles = make(map[string]*TagFile)
+	bw.tagfileOrder = make([]string, 0)
+	bw.excludeFromTagManifests = make(map[string]bool)
+	bw.dirs = make(map[string]bool)
+	bw.paths = make(map[string]bool)
+
+	switch format {
+	case TarFormat:
+		bw.tarWriter = tar.NewWriter(w)
+	case TarGzipFormat:
+		bw.gzipWriter = gzip.NewWriter(w)
+		bw.tarWriter = tar.NewWriter(bw.gzipWriter)
+	default:
+		return nil, fmt.Errorf("Unsupported format '%s'. Must be %s or %s",
+			format, TarFormat, TarGzipFormat)
+	}
+
+	for _, hashName := range hashNames {
+		lcHashName := strings.ToLower(hashName)
+		manifest, err := newManifest("manifest-"+lcHashName+".txt", lcHashName, PayloadManifest)
+		if err != nil {
+			return nil, err
+		}
+		manifest.bagItVersion = version
+		bw.Manifests = append(bw.Manifests, manifest)
+
+		if createTagManifests {
+			tagmanifest, err := newManifest("tagmanifest-"+lcHashName+".txt", lcHashName, TagManifest)
+			if err != nil {
+				return nil, err
+			}
+			tagmanifest.bagItVersion = version
+			bw.Manifests = append(bw.Manifests, tagmanifest)
+		}
+	}
+
+	// Write bagit.txt first, so readers of the stream can
+	// find out what version of the spec they are dealing with.
+	bagit := &TagFile{name: "bagit.txt", Data: NewTagFieldList()}
+	bagit.Data.AddField(*NewTagField("BagIt-Version", version))
+	bagit.Data.AddField(*NewTagField("Tag-File-Character-Encoding", "UTF-8"))
+	if err := bw.writeTagFile(bagit); err != nil {
+		return nil, err
+	}
+
+	return bw, nil
+}
+
+// Returns the name of the bag's top-level directory.
+func (bw *BagWriter) Name() string {
+	return bw.name
+}
+
+// Sets the line ending of every manifest and tag manifest, either
+// LineEndingLF, the default, or LineEndingCRLF.
+func (bw *BagWriter) SetLineEnding(lineEnding LineEnding) error {
+	for _, m := range bw.Manifests {
+		if err := m.SetLineEnding(lineEnding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the manifests of the specified type, either PayloadManifest
+// or TagManifest, or an empty slice.
+func (bw *BagWriter) GetManifests(manifestType string) []*Manifest {
+	manifests := make([]*Manifest, 0)
+	for _, m := range bw.Manifests {
+		if m.Type() == manifestType {
+			manifests = append(manifests, m)
+		}
+	}
+	return manifests
+}
+
+/*
+Copies the file at src into the payload directory of the archive under
+the relative path dst, and records its checksums in the payload
+manifests. Returns the checksums keyed by algorithm, as Payload.Add does.
+*/
+func (bw *BagWriter) AddFile(src string, dst string) (map[string]string, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", src)
+	}
+	return bw.AddReader(file, fileInfo.Size(), dst)
+}
+
+/*
+Copies size bytes from r into the payload directory of the archive under
+the relative path dst, and records their checksums in the payload
+manifests. The tar format needs the size of each file before its
+contents, so size must be exact. A file can only be added at dst once.
+*/
+func (bw *BagWriter) AddReader(r io.Reader, size int64, dst string) (map[string]string, error) {
+	if err := bw.checkOpen(); err != nil {
+		return nil, err
+	}
+	pathInBag, err := bw.cleanPath(path.Join("data", dst))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(pathInBag, "data/") {
+		return nil, fmt.Errorf("Illegal payload path '%s'", dst)
+	}
+	if err := bw.addPath(pathInBag); err != nil {
+		return nil, err
+	}
+	manifests := bw.GetManifests(PayloadManifest)
+	hashes, err := bw.writeEntry(pathInBag, r, size, manifests)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	for i, m := range manifests {
+		digest := fmt.Sprintf("%x", hashes[i].Sum(nil))
+		checksums[m.Algorithm()] = digest
+		m.Data[pathInBag] = digest
+	}
+	return checksums, nil
+}
+
+/*
+Adds a tag file to the bag with the filename provided, as Bag.AddTagfile
+does. Add name-value pairs to the tag file's Data, which BagWriter
+writes to the archive when it is closed. Each name can only be added
+once, and can't be bagit.txt, fetch.txt or the name of a manifest or
+tag manifest, which BagWriter writes itself.
+*/
+func (bw *BagWriter) AddTagfile(name string) error {
+	if err := bw.checkOpen(); err != nil {
+		return err
+	}
+	pathInBag, err := bw.cleanPath(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(pathInBag, "data/") {
+		return fmt.Errorf("Illegal tag file name '%s'", name)
+	}
+	if !strings.HasSuffix(pathInBag, ".txt") {
+		return fmt.Errorf("Tagfiles must end in .txt and contain at least 1 letter.  Provided: %s",
+			path.Base(pathInBag))
+	}
+	if err := bw.addPath(pathInBag); err != nil {
+		return err
+	}
+	bw.tagfileOrder = append(bw.tagfileOrder, pathInBag)
+	bw.tagfiles[pathInBag] = &TagFile{name: pathInBag, Data: NewTagFieldList()}
+	return nil
+}
+
+// Returns the tag file added with AddTagfile under name.
+func (bw *BagWriter) TagFile(name string) (*TagFile, error) {
+	pathInBag, err := bw.cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if tf, ok := bw.tagfiles[pathInBag]; ok {
+		return tf, nil
+	}
+	return nil, fmt.Errorf("Unable to find tagfile %s", name)
+}
+
+/*
+Copies a tag file of any format from sourcePath into the archive at
+destPath, as Bag.AddCustomTagfile does. The file is written immediately.
+destPath follows the same rules as the name passed to AddTagfile.
+*/
+func (bw *BagWriter) AddCustomTagfile(sourcePath string, destPath string, includeInTagManifests bool) error {
+	if err := bw.checkOpen(); err != nil {
+		return err
+	}
+	if strings.HasPrefix(destPath, "data/") || strings.HasPrefix(destPath, "/") ||
+		strings.Contains(destPath, "..") {
+		return fmt.Errorf("Illegal value '%s' for param destPath. "+
+			"File name cannot start with '/' or 'data/' or contain '..'", destPath)
+	}
+	pathInBag, err := bw.cleanPath(destPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := bw.addPath(pathInBag); err != nil {
+		return err
+	}
+
+	manifests := bw.GetManifests(TagManifest)
+	if !includeInTagManifests {
+		manifests = nil
+		bw.excludeFromTagManifests[pathInBag] = true
+	}
+	hashes, err := bw.writeEntry(pathInBag, file, fileInfo.Size(), manifests)
+	if err != nil {
+		return err
+	}
+	for i, m := range manifests {
+		m.Data[pathInBag] = fmt.Sprintf("%x", hashes[i].Sum(nil))
+	}
+	return nil
+}
+
+/*
+Writes the tag files, payload manifests and tag manifests to the archive
+and closes it. The writer passed to NewBagWriter is not closed. The
+BagWriter can't be used after Close is called.
+*/
+func (bw *BagWriter) Close() error {
+	if err := bw.checkOpen(); err != nil {
+		return err
+	}
+	bw.closed = true
+
+	for _, name := range bw.tagfileOrder {
+		if err := bw.writeTagFile(bw.tagfiles[name]); err != nil {
+			return err
+		}
+	}
+	tagManifests := bw.GetManifests(TagManifest)
+	for _, m := range bw.GetManifests(PayloadManifest) {
+		if err := bw.writeString(m.Name(), m.ToString(), tagManifests); err != nil {
+			return err
+		}
+	}
+	for _, m := range tagManifests {
+		if err := bw.writeString(m.Name(), m.ToString(), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.tarWriter.Close(); err != nil {
+		return err
+	}
+	if bw.gzipWriter != nil {
+		return bw.gzipWriter.Close()
+	}
+	return nil
+}
+
+// Returns an error if the BagWriter has been closed, or if an earlier
+// write failed part way through an entry and left the archive unusable.
+func (bw *BagWriter) checkOpen() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.closed {
+		return fmt.Errorf("BagWriter for %s is closed", bw.name)
+	}
+	return nil
+}
+
+// Writes a tag file to the archive and records its checksums in
+// the tag manifests.
+func (bw *BagWriter) writeTagFile(tf *TagFile) error {
+	content, err := tf.ToString()
+	if err != nil {
+		return err
+	}
+	return bw.writeString(tf.Name(), content, bw.GetManifests(TagManifest))
+}
+
+// Writes content to the archive at pathInBag and records its checksums
+// in manifests.
+func (bw *BagWriter) writeString(pathInBag string, content string, manifests []*Manifest) error {
+	if bw.excludeFromTagManifests[pathInBag] {
+		manifests = nil
+	}
+	hashes, err := bw.writeEntry(pathInBag, strings.NewReader(content), int64(len(content)), manifests)
+	if err != nil {
+		return err
+	}
+	for i, m := range manifests {
+		m.Data[pathInBag] = fmt.Sprintf("%x", hashes[i].Sum(nil))
+	}
+	return nil
+}
+
+// Writes a regular file entry to the archive, hashing its content with
+// the algorithm of each manifest as it goes. Returns the hashes in the
+// same order as manifests. A tar stream can't recover from a partly
+// written entry, so any error here makes the BagWriter unusable.
+func (bw *BagWriter) writeEntry(pathInBag string, r io.Reader, size int64, manifests []*Manifest) ([]hash.Hash, error) {
+	hashes, err := bw.copyEntry(pathInBag, r, size, manifests)
+	if err != nil {
+		bw.err = fmt.Errorf("Error writing %s to archive, BagWriter for %s can't be used: %w",
+			pathInBag, bw.name, err)
+		return nil, bw.err
+	}
+	return hashes, nil
+}
+
+// Does the work of writeEntry.
+func (bw *BagWriter) copyEntry(pathInBag string, r io.Reader, size int64, manifests []*Manifest) ([]hash.Hash, error) {
+	if err := bw.writeDirs(path.Dir(pathInBag)); err != nil {
+		return nil, err
+	}
+	header := &tar.Header{
+		Name:     path.Join(bw.name, pathInBag),
+		Mode:     0644,
+		Size:     size,
+		ModTime:  bw.modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := bw.tarWriter.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	writers := []io.Writer{bw.tarWriter}
+	hashes := make([]hash.Hash, len(manifests))
+	for i, m := range manifests {
+		hashes[i] = m.hashFunc()
+		writers = append(writers, hashes[i])
+	}
+	written, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, err
+	}
+	if written != size {
+		return nil, fmt.Errorf("Expected %d bytes for %s, but got %d", size, pathInBag, written)
+	}
+	return hashes, nil
+}
+
+// Writes entries for dir and each of its parents that are
+// not already in the archive.
+func (bw *BagWriter) writeDirs(dir string) error {
+	if dir == "." || dir == "" {
+		dir = ""
+	} else if err := bw.writeDirs(path.Dir(dir)); err != nil {
+		return err
+	}
+	if bw.dirs[dir] {
+		return nil
+	}
+	bw.dirs[dir] = true
+	return bw.tarWriter.WriteHeader(&tar.Header{
+		Name:     path.Join(bw.name, dir) + "/",
+		Mode:     0755,
+		ModTime:  bw.modTime,
+		Typeflag: tar.TypeDir,
+	})
+}
+
+// Records that a file will be written to the archive at pathInBag.
+// Returns an error if a file has already been added there, or if it is
+// one of the files BagWriter writes itself: bagit.txt, fetch.txt, and
+// the manifests and tag manifests.
+func (bw *BagWriter) addPath(pathInBag string) error {
+	reserved := pathInBag == "bagit.txt" || pathInBag == "fetch.txt"
+	for _, pattern := range []string{"manifest-*", "tagmanifest-*"} {
+		if matched, _ := path.Match(pattern, pathInBag); matched {
+			reserved = true
+		}
+	}
+	if reserved {
+		return fmt.Errorf("Illegal path '%s'. BagWriter writes that file itself", pathInBag)
+	}
+	if bw.paths[pathInBag] {
+		return fmt.Errorf("A file has already been added to %s at %s", bw.name, pathInBag)
+	}
+	bw.paths[pathInBag] = true
+	return nil
+}
+
+// Converts a relative path in the bag to the clean, slash-separated
+// form used in the archive, rejecting paths that leave the bag.
+func (bw *BagWriter) cleanPath(pathInBag string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(pathInBag))
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("Illegal path '%s'", pathInBag)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,194 @@
+package bagins_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/bagins"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Reads a tar archive into a map of entry names to contents,
+// and returns the names in the order they appear.
+func readTarEntries(r io.Reader) (map[string]string, []string, error) {
+	contents := make(map[string]string)
+	names := make([]string, 0)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		contents[header.Name] = string(data)
+		names = append(names, header.Name)
+	}
+	return contents, names, nil
+}
+
+func TestBagWriter(t *testing.T) {
+	fi, _ := ioutil.TempFile("", "TEST_GO_BAGWRITER_")
+	fi.WriteString(FIXSTRING)
+	fi.Close()
+	defer os.Remove(fi.Name())
+
+	var buf bytes.Buffer
+	bw, err := bagins.NewBagWriter(&buf, "writer-bag", []string{"md5", "sha256"}, true,
+		bagins.BagItVersion097, bagins.TarFormat)
+	if err != nil {
+		t.Fatalf("Unexpected error creating BagWriter: %s", err)
+	}
+	checksums, err := bw.AddFile(fi.Name(), "dir/one.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error adding file: %s", err)
+	}
+	if checksums["md5"] != FIXVALUE || checksums["sha256"] != FIXSHA256 {
+		t.Errorf("AddFile returned wrong checksums %v", checksums)
+	}
+	bw.AddTagfile("bag-info.txt")
+	bagInfo, _ := bw.TagFile("bag-info.txt")
+	bagInfo.Data.AddField(*bagins.NewTagField("Source-Organization", "APTrust"))
+	if err := bw.AddCustomTagfile(fi.Name(), "custom/extra.bin", false); err != nil {
+		t.Errorf("Unexpected error adding custom tag file: %s", err)
+	}
+
+	// Each path can only be added once, and the files BagWriter
+	// writes itself can't be added at all.
+	if _, err := bw.AddReader(strings.NewReader(FIXSTRING), int64(len(FIXSTRING)), "dir/one.txt"); err == nil {
+		t.Errorf("AddReader should reject a payload path that was already added")
+	}
+	if err := bw.AddTagfile("bag-info.txt"); err == nil {
+		t.Errorf("AddTagfile should reject a tag file that was already added")
+	}
+	if err := bw.AddCustomTagfile(fi.Name(), "bag-info.txt", true); err == nil {
+		t.Errorf("AddCustomTagfile should reject a tag file that was already added")
+	}
+	for _, name := range []string{"bagit.txt", "fetch.txt", "manifest-md5.txt", "tagmanifest-sha1.txt"} {
+		if err := bw.AddTagfile(name); err == nil {
+			t.Errorf("AddTagfile should reject %s", name)
+		}
+		if err := bw.AddCustomTagfile(fi.Name(), name, true); err == nil {
+			t.Errorf("AddCustomTagfile should reject %s", name)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing BagWriter: %s", err)
+	}
+	if _, err := bw.AddFile(fi.Name(), "late.txt"); err == nil {
+		t.Errorf("AddFile should fail after Close")
+	}
+
+	contents, names, err := readTarEntries(&buf)
+	if err != nil {
+		t.Fatalf("Unable to read archive: %s", err)
+	}
+
+	// Everything should be under a single top-level directory.
+	for _, name := range names {
+		if !strings.HasPrefix(name, "writer-bag/") {
+			t.Errorf("Entry %s is not under the bag directory", name)
+		}
+	}
+	expected := []string{
+		"writer-bag/bagit.txt",
+		"writer-bag/data/dir/one.txt",
+		"writer-bag/bag-info.txt",
+		"writer-bag/custom/extra.bin",
+		"writer-bag/manifest-md5.txt",
+		"writer-bag/manifest-sha256.txt",
+		"writer-bag/tagmanifest-md5.txt",
+		"writer-bag/tagmanifest-sha256.txt",
+	}
+	for _, name := range expected {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("Archive is missing %s", name)
+		}
+	}
+	if names[len(names)-1] != "writer-bag/tagmanifest-sha256.txt" {
+		t.Errorf("Tag manifests should be written last, but last entry is %s", names[len(names)-1])
+	}
+
+	if contents["writer-bag/data/dir/one.txt"] != FIXSTRING {
+		t.Errorf("Payload file content is wrong")
+	}
+	if contents["writer-bag/manifest-md5.txt"] != FIXVALUE+" data/dir/one.txt\n" {
+		t.Errorf("Unexpected manifest-md5.txt %q", contents["writer-bag/manifest-md5.txt"])
+	}
+
+	// The tag manifests should have correct checksums for the tag files
+	// and payload manifests, and leave out the excluded custom tag file.
+	tagManifest := contents["writer-bag/tagmanifest-md5.txt"]
+	for _, name := range []string{"bagit.txt", "bag-info.txt", "manifest-md5.txt", "manifest-sha256.txt"} {
+		digest := fmt.Sprintf("%x", md5.Sum([]byte(contents["writer-bag/"+name])))
+		if !strings.Contains(tagManifest, digest+" "+name+"\n") {
+			t.Errorf("tagmanifest-md5.txt has no correct entry for %s:\n%s", name, tagManifest)
+		}
+	}
+	if strings.Contains(tagManifest, "custom/extra.bin") {
+		t.Errorf("Excluded custom tag file is in tagmanifest-md5.txt")
+	}
+}
+
+func TestBagWriterGzip(t *testing.T) {
+	var buf bytes.Buffer
+	bw, err := bagins.NewBagWriter(&buf, "gzip-bag", []string{"md5"}, false,
+		bagins.BagItVersion10, bagins.TarGzipFormat)
+	if err != nil {
+		t.Fatalf("Unexpected error creating BagWriter: %s", err)
+	}
+	if _, err := bw.AddReader(strings.NewReader(FIXSTRING), int64(len(FIXSTRING)), "one.txt"); err != nil {
+		t.Fatalf("Unexpected error adding reader: %s", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Unexpected error closing BagWriter: %s", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Archive is not gzipped: %s", err)
+	}
+	contents, _, err := readTarEntries(gz)
+	if err != nil {
+		t.Fatalf("Unable to read archive: %s", err)
+	}
+	if !strings.Contains(contents["gzip-bag/bagit.txt"], "1.0") {
+		t.Errorf("bagit.txt should have version 1.0: %q", contents["gzip-bag/bagit.txt"])
+	}
+	if contents["gzip-bag/manifest-md5.txt"] != FIXVALUE+" data/one.txt\n" {
+		t.Errorf("Unexpected manifest-md5.txt %q", contents["gzip-bag/manifest-md5.txt"])
+	}
+
+	// A short read leaves a partial tar entry, so the BagWriter
+	// should refuse to write anything else.
+	bw, _ = bagins.NewBagWriter(&buf, "short-bag", []string{"md5"}, false,
+		bagins.BagItVersion10, bagins.TarFormat)
+	if _, err := bw.AddReader(strings.NewReader("short"), 10, "bad.txt"); err == nil {
+		t.Errorf("AddReader should fail when the size is wrong")
+	}
+	if _, err := bw.AddReader(strings.NewReader("ok"), 2, "ok.txt"); err == nil {
+		t.Errorf("AddReader should fail after an incomplete entry")
+	}
+	if err := bw.Close(); err == nil {
+		t.Errorf("Close should fail after an incomplete entry")
+	}
+
+	// It should reject unknown formats and bad bag names.
+	if _, err := bagins.NewBagWriter(&buf, "bag", []string{"md5"}, false, bagins.BagItVersion10, "rar"); err == nil {
+		t.Errorf("NewBagWriter should reject format rar")
+	}
+	if _, err := bagins.NewBagWriter(&buf, "../bag", []string{"md5"}, false, bagins.BagItVersion10, bagins.TarFormat); err == nil {
+		t.Errorf("NewBagWriter should reject bag name ../bag")
+	}
+}